@@ -0,0 +1,287 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import "github.com/maxymania/blobserver/binascii"
+import "github.com/maxymania/blobserver/plusbinary"
+import "github.com/maxymania/blobserver/istorage"
+import "encoding/binary"
+import "encoding/hex"
+import "bytes"
+import "context"
+import "time"
+
+const (
+	statsListable = 1
+	statsCompress = 2
+	statsVersion  = 3
+)
+
+// BlobStat describes a stored blob, as reported by StatBlob.
+type BlobStat struct{
+	Stored int    // Size of the payload as stored.
+	Codec  string // Name of the codec, if the payload is compressed.
+	Size   int    // Uncompressed size, if the payload is compressed, otherwise 0.
+	Sum    uint32
+	HasSum bool
+}
+
+// A ListEntry is one blob of a storage, as reported by ListBlobs.
+type ListEntry struct{
+	ID  []byte
+	Day time.Time
+}
+
+// StorageStat describes one storage of a server.
+type StorageStat struct{
+	Node     []byte
+	Free     int64
+	Listable bool
+	Mode     istorage.Mode
+	Used     int64   // -1 if unknown.
+	Drained  float64 // Fraction of the data gone, while Mode is istorage.Draining.
+	
+	// Compression decisions of the storage, if HasCompress.
+	Compress    istorage.CompressCounts
+	HasCompress bool
+}
+
+func (c *Client) StatBlob(node,ID []byte) (*BlobStat,error) {
+	return c.StatBlobCtx(context.Background(),node,ID)
+}
+func (c *Client) StatBlobCtx(ctx context.Context, node,ID []byte) (st *BlobStat,err error) {
+	err = c.call(ctx,true,func(e *exchange) {
+		req := e.req
+		req.SetMethodStr("stat")
+		{
+			path := append(c.tempbuf[:0],"/blobs/"...)
+			path  = binascii.EncodeLe190(node,path)
+			path  = append(path,'/')
+			path  = binascii.EncodeLe190(ID,path)
+			req.SetPath(path)
+		}
+	},func(e *exchange) error {
+		var sum [4]byte
+		resp := e.resp
+		if resp.Code()!=200 { return &StatusError{"stat",resp.Code()} }
+		st = &BlobStat{Stored:istorage.HeaderInt(resp.GetHeaderK("stored-size")),Codec:string(resp.GetHeaderK("codec")),Size:istorage.HeaderInt(resp.GetHeaderK("decoded-size"))}
+		if st.Codec=="" {
+			if st.Size = istorage.HeaderInt(resp.GetHeaderK("lz4-size")) ; st.Size>0 { st.Codec = "lz4" }
+		}
+		if h := resp.GetHeaderK("content-crc32c") ; len(h)>0 {
+			if n,err := hex.Decode(sum[:],h) ; err!=nil || n!=4 { return ErrChecksum }
+			st.Sum,st.HasSum = binary.BigEndian.Uint32(sum[:]),true
+		}
+		return nil
+	})
+	return
+}
+
+func (c *Client) ListBlobs(node []byte, day time.Time) ([]ListEntry,error) {
+	return c.ListBlobsCtx(context.Background(),node,day)
+}
+
+// ListBlobsCtx lists the blobs of a storage, day by day. If day is not zero,
+// only the blobs of that day are listed.
+func (c *Client) ListBlobsCtx(ctx context.Context, node []byte, day time.Time) (list []ListEntry,err error) {
+	err = c.call(ctx,true,func(e *exchange) {
+		path := append(c.tempbuf[:0],"/list/"...)
+		path  = binascii.EncodeLe190(node,path)
+		if !day.IsZero() {
+			path = append(path,'/')
+			path = binascii.IntToLe190(binascii.Unsigned(day.Unix()),path)
+		}
+		e.req.SetMethodStr("list")
+		e.req.SetPath(path)
+	},func(e *exchange) error {
+		if e.resp.Code()!=200 { return &StatusError{"list",e.resp.Code()} }
+		r := bytes.NewReader(e.resp.Body().B)
+		list = list[:0]
+		for r.Len()>0 {
+			id,err := plusbinary.ReadFrame(r,nil,maxBatchFrame)
+			if err!=nil { return errShortBatch }
+			ts,err := plusbinary.ReadVarint(r)
+			if err!=nil { return errShortBatch }
+			list = append(list,ListEntry{id,time.Unix(ts,0).UTC()})
+		}
+		return nil
+	})
+	return
+}
+
+func (c *Client) Stats() ([]StorageStat,error) {
+	return c.StatsCtx(context.Background())
+}
+// StatsCtx reports the storages of the server. Older servers leave out
+// some fields: Mode is ReadWrite and Used -1 then, and HasCompress is false.
+func (c *Client) StatsCtx(ctx context.Context) (stats []StorageStat,err error) {
+	err = c.call(ctx,true,func(e *exchange) {
+		e.req.SetMethodStr("stats")
+		e.req.SetPath([]byte("/admin/stats"))
+		e.req.SetIntHeader(istorage.HeaderStatsVersion,statsVersion)
+	},func(e *exchange) error {
+		if e.resp.Code()!=200 { return &StatusError{"stats",e.resp.Code()} }
+		ver := istorage.HeaderInt(e.resp.GetHeaderK(istorage.HeaderStatsVersion))
+		r := bytes.NewReader(e.resp.Body().B)
+		stats = stats[:0]
+		for r.Len()>0 {
+			node,err := plusbinary.ReadFrame(r,nil,maxBatchFrame)
+			if err!=nil { return errShortBatch }
+			free,err := plusbinary.ReadVarint(r)
+			if err!=nil { return errShortBatch }
+			flags,err := plusbinary.ReadUvarint(r)
+			if err!=nil { return errShortBatch }
+			st := StorageStat{Node:node,Free:free,Listable:(flags&statsListable)!=0,Used:-1}
+			if ver>=2 {
+				mode,err := plusbinary.ReadUvarint(r)
+				if err!=nil { return errShortBatch }
+				used,err := plusbinary.ReadVarint(r)
+				if err!=nil { return errShortBatch }
+				drained,err := plusbinary.ReadUvarint(r)
+				if err!=nil { return errShortBatch }
+				st.Mode,st.Used,st.Drained = istorage.Mode(mode),used,float64(drained)/1000
+			}
+			if ver>=3 {
+				var cc [5]int64
+				for i := range cc {
+					u,err := plusbinary.ReadUvarint(r)
+					if err!=nil { return errShortBatch }
+					cc[i] = int64(u)
+				}
+				st.Compress = istorage.CompressCounts{cc[0],cc[1],cc[2],cc[3],cc[4]}
+				st.HasCompress = (flags&statsCompress)!=0
+			}
+			stats = append(stats,st)
+		}
+		return nil
+	})
+	return
+}
+
+func (c *Client) Reload() error {
+	return c.ReloadCtx(context.Background())
+}
+
+// ReloadCtx asks the server to reload its storage configuration.
+func (c *Client) ReloadCtx(ctx context.Context) error {
+	return c.call(ctx,false,func(e *exchange) {
+		e.req.SetMethodStr("reload")
+		e.req.SetPath([]byte("/admin/reload"))
+	},func(e *exchange) error {
+		if e.resp.Code()!=200 { return &StatusError{"reload",e.resp.Code()} }
+		return nil
+	})
+}
+
+func (c *Client) SetMode(node []byte, mode istorage.Mode) error {
+	return c.SetModeCtx(context.Background(),node,mode)
+}
+
+// SetModeCtx changes the mode of a storage until the next reload, that changes
+// the mode in its configuration.
+func (c *Client) SetModeCtx(ctx context.Context, node []byte, mode istorage.Mode) error {
+	return c.call(ctx,true,func(e *exchange) {
+		path := append(c.tempbuf[:0],"/admin/mode/"...)
+		path  = binascii.EncodeLe190(node,path)
+		e.req.SetMethodStr("mode")
+		e.req.SetPath(path)
+		e.req.Body().SetString(mode.String())
+	},func(e *exchange) error {
+		if e.resp.Code()!=200 { return &StatusError{"mode",e.resp.Code()} }
+		return nil
+	})
+}
+
+// A Forward maps a moved blob to its new location, see AddForwards.
+type Forward struct{
+	Node,ID       []byte
+	NewNode,NewID []byte
+	Day           time.Time // The day, the blob is filed under.
+}
+
+func (c *Client) AddForwards(fwd []Forward) error {
+	return c.AddForwardsCtx(context.Background(),fwd)
+}
+
+// AddForwardsCtx adds entries to the forwarding table of the server, so that
+// loads of Node/ID are served from NewNode/NewID.
+func (c *Client) AddForwardsCtx(ctx context.Context, fwd []Forward) error {
+	return c.call(ctx,true,func(e *exchange) {
+		e.req.SetMethodStr("forward")
+		e.req.SetPath([]byte("/admin/forward"))
+		body := e.req.Body()
+		body.Reset()
+		for _,f := range fwd {
+			plusbinary.WriteFrame(body,f.Node)
+			plusbinary.WriteFrame(body,f.ID)
+			plusbinary.WriteFrame(body,f.NewNode)
+			plusbinary.WriteFrame(body,f.NewID)
+			plusbinary.WriteVarint(body,f.Day.Unix())
+		}
+	},func(e *exchange) error {
+		if e.resp.Code()!=200 { return &StatusError{"forward",e.resp.Code()} }
+		return nil
+	})
+}
+
+func (c *Client) PurgeDay(node []byte, day time.Time) error {
+	return c.PurgeDayCtx(context.Background(),node,day)
+}
+
+// PurgeDayCtx destroys the key of a day on a storage, that seals each day with
+// a key of its own. Its blobs can't be read anymore. The day must be past.
+func (c *Client) PurgeDayCtx(ctx context.Context, node []byte, day time.Time) error {
+	return c.call(ctx,true,func(e *exchange) {
+		path := append(c.tempbuf[:0],"/admin/purge/"...)
+		path  = binascii.EncodeLe190(node,path)
+		path  = append(path,'/')
+		path  = binascii.IntToLe190(binascii.Unsigned(day.Unix()),path)
+		e.req.SetMethodStr("purge")
+		e.req.SetPath(path)
+	},func(e *exchange) error {
+		if e.resp.Code()!=200 { return &StatusError{"purge",e.resp.Code()} }
+		return nil
+	})
+}
+
+func (c *Client) GCForwards() (int,error) {
+	return c.GCForwardsCtx(context.Background())
+}
+
+// GCForwardsCtx removes the forwarding entries of the days, that expired
+// on the server, and returns their number. The server does this on every
+// EXPIRE as well.
+func (c *Client) GCForwardsCtx(ctx context.Context) (n int,err error) {
+	err = c.call(ctx,true,func(e *exchange) {
+		e.req.SetMethodStr("gc")
+		e.req.SetPath([]byte("/admin/forward-gc"))
+	},func(e *exchange) error {
+		if e.resp.Code()!=200 { return &StatusError{"gc",e.resp.Code()} }
+		u,err := plusbinary.ReadUvarint(bytes.NewReader(e.resp.Body().B))
+		if err!=nil { return errShortBatch }
+		n = int(u)
+		return nil
+	})
+	return
+}
@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import "github.com/maxymania/blobserver/plusbinary"
+import "github.com/maxymania/blobserver/istorage"
+import "encoding/binary"
+import "bytes"
+import "context"
+import "errors"
+import "io"
+import "time"
+
+var ErrRejected = errors.New("blob rejected by server")
+var ErrNotFound = errors.New("blob not found")
+var errShortBatch = errors.New("batch response too short")
+
+const (
+	batchFound  = 1
+	batchHasSum = 2
+	batchCodec  = 4
+	maxBatchFrame = 1<<30
+)
+
+// BatchResponseLimit is the size in bytes, that GetBatch asks the server to
+// keep each response under. A single larger blob still comes in one piece.
+var BatchResponseLimit = 16<<20
+
+// A PutItem is one blob of a batch upload. Node, ID and Err are set by PostBatch.
+type PutItem struct{
+	Blob []byte
+	Time time.Time
+	
+	Node []byte
+	ID   []byte
+	Err  error
+}
+
+// A GetItem is one blob of a batch download. Blob and Err are set by GetBatch.
+type GetItem struct{
+	Node []byte
+	ID   []byte
+	
+	Blob []byte
+	Err  error
+}
+
+func (c *Client) PostBatch(items []PutItem) error {
+	return c.PostBatchCtx(context.Background(),items)
+}
+
+// PostBatchCtx uploads all items in a single request. The returned error
+// concerns the request as a whole; per-item failures are reported in Err.
+func (c *Client) PostBatchCtx(ctx context.Context, items []PutItem) error {
+	return c.call(ctx,false,func(e *exchange) {
+		e.req.SetMethodStr("post")
+		e.req.SetPath([]byte("/batch/"))
+		body := e.req.Body()
+		for i := range items {
+			plusbinary.WriteVarint(body,items[i].Time.Unix())
+			plusbinary.WriteFrame(body,items[i].Blob)
+		}
+	},func(e *exchange) error {
+		if e.resp.Code()!=200 { return &StatusError{"post-batch",e.resp.Code()} }
+		r := bytes.NewReader(e.resp.Body().B)
+		for i := range items {
+			it := &items[i]
+			node,err := plusbinary.ReadFrame(r,nil,maxBatchFrame)
+			if err!=nil { return errShortBatch }
+			id,err := plusbinary.ReadFrame(r,nil,maxBatchFrame)
+			if err!=nil { return errShortBatch }
+			it.Node,it.ID,it.Err = node,id,nil
+			if len(id)==0 { it.Err = ErrRejected }
+		}
+		return nil
+	})
+}
+
+func (c *Client) GetBatch(items []GetItem) error {
+	return c.GetBatchCtx(context.Background(),items)
+}
+
+// GetBatchCtx downloads all items. Each blob is verified against its
+// checksum, if the server sent one. The server answers at most about
+// BatchResponseLimit bytes per request; the rest is requested anew.
+func (c *Client) GetBatchCtx(ctx context.Context, items []GetItem) error {
+	for len(items)>0 {
+		n,err := c.getBatch(ctx,items)
+		if err!=nil { return err }
+		items = items[n:]
+	}
+	return nil
+}
+
+// getBatch downloads a prefix of items and returns its length.
+func (c *Client) getBatch(ctx context.Context, items []GetItem) (got int,err error) {
+	err = c.call(ctx,true,func(e *exchange) {
+		e.req.SetMethodStr("mget")
+		e.req.SetHeader([]byte(HeaderAcceptCodec),acceptCodec())
+		e.req.SetIntHeader(istorage.HeaderBatchLimit,BatchResponseLimit)
+		e.req.SetPath([]byte("/batch/"))
+		body := e.req.Body()
+		for i := range items {
+			plusbinary.WriteFrame(body,items[i].Node)
+			plusbinary.WriteFrame(body,items[i].ID)
+		}
+	},func(e *exchange) error {
+		var sum [4]byte
+		if e.resp.Code()!=200 { return &StatusError{"get-batch",e.resp.Code()} }
+		got = len(items)
+		if n := istorage.HeaderInt(e.resp.GetHeaderK(istorage.HeaderBatchCount)) ; n>0 && n<got { got = n }
+		r := bytes.NewReader(e.resp.Body().B)
+		for i := range items[:got] {
+			it := &items[i]
+			flags,err := plusbinary.ReadUvarint(r)
+			if err!=nil { return errShortBatch }
+			if (flags&batchFound)==0 {
+				it.Blob,it.Err = nil,ErrNotFound
+				continue
+			}
+			size,err := plusbinary.ReadUvarint(r)
+			if err!=nil { return errShortBatch }
+			meta := istorage.Meta{Size:int(size)}
+			if size>0 { meta.Codec = istorage.CodecLZ4 }
+			if (flags&batchCodec)!=0 {
+				codec,err := plusbinary.ReadUvarint(r)
+				if err!=nil || codec>255 { return errShortBatch }
+				meta.Codec = uint8(codec)
+			}
+			if (flags&batchHasSum)!=0 {
+				if _,err = io.ReadFull(r,sum[:]) ; err!=nil { return errShortBatch }
+			}
+			payload,err := plusbinary.ReadFrame(r,nil,maxBatchFrame)
+			if err!=nil { return errShortBatch }
+			it.Blob,it.Err = payload,nil
+			if size>0 {
+				if it.Blob,err = istorage.Unpack(meta,payload,nil) ; err!=nil { it.Blob,it.Err = nil,err ; continue }
+			}
+			if (flags&batchHasSum)!=0 && binary.BigEndian.Uint32(sum[:])!=Checksum(it.Blob) {
+				it.Blob,it.Err = nil,ErrChecksum
+			}
+		}
+		return nil
+	})
+	return
+}
+
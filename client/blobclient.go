@@ -24,93 +24,215 @@ SOFTWARE.
 package client
 
 import "github.com/maxymania/blobserver/binascii"
+import "github.com/maxymania/blobserver/trace"
 import "github.com/byte-mug/gocom/notrest"
-import "github.com/pierrec/lz4"
+import "github.com/maxymania/blobserver/istorage"
+import "context"
+import "encoding/hex"
+import "encoding/binary"
+import "strconv"
+import "sync"
 import "time"
 
-func realloc(buf []byte, i int) []byte {
-	if cap(buf)<i { return make([]byte,i) }
-	return buf[:i]
+// Redirects to moved blobs are followed at most this often.
+const maxRedirects = 4
+
+// ErrUnknownCodec is returned for blobs compressed by a codec, that this
+// client doesn't know.
+var ErrUnknownCodec = istorage.ErrUnknownCodec
+
+// acceptCodec lists the codecs, that the client decodes, for the
+// accept-codec header. Other payloads are decompressed by the server.
+func acceptCodec() []byte {
+	var b []byte
+	for _,n := range istorage.CodecNames() {
+		if n=="none" { continue }
+		if len(b)>0 { b = append(b,',') }
+		b = append(b,n...)
+	}
+	return b
 }
 
-func decint(str []byte) (i int) {
-	for _,b := range str {
-		if b<'0' || '9'<b { continue }
-		i = (i*10) + int(b-'0')
+// payloadMeta reads the codec and decoded size of the payload from the
+// headers. Servers, that predate codecs, only send lz4-size.
+func payloadMeta(resp *notrest.Response) (meta istorage.Meta,err error) {
+	if name := resp.GetHeaderK("codec") ; len(name)>0 {
+		c,ok := istorage.Codecs[string(name)]
+		if !ok { return meta,ErrUnknownCodec }
+		meta.Codec,meta.Size = c.ID,istorage.HeaderInt(resp.GetHeaderK("decoded-size"))
+	} else if n := istorage.HeaderInt(resp.GetHeaderK("lz4-size")) ; n>0 {
+		meta.Codec,meta.Size = istorage.CodecLZ4,n
 	}
 	return
 }
 
+// verify checks blob against the content-crc32c header, if present.
+func verify(resp *notrest.Response, blob []byte) error {
+	var sum [4]byte
+	h := resp.GetHeaderK("content-crc32c")
+	if len(h)==0 { return nil }
+	if n,err := hex.Decode(sum[:],h) ; err!=nil || n!=4 { return ErrChecksum }
+	if binary.BigEndian.Uint32(sum[:])!=Checksum(blob) { return ErrChecksum }
+	return nil
+}
+
 type Client struct{
 	Client *notrest.Client
+	// Name identifies the server in BlobRefs. It may be empty.
+	Name   string
+	// Retry is the retry policy. If nil, DefaultRetryPolicy is used.
+	Retry  *RetryPolicy
+	// Timeout limits each attempt of a call, if >0.
+	Timeout time.Duration
+	// Pool is the connection pooling policy. If nil, all round trips share
+	// Client. It must not be changed after the first call.
+	Pool    *PoolPolicy
 	tempbuf [128]byte
+	
+	poolOnce sync.Once
+	pool     *connPool
 }
 
-func (c *Client) PostBlob(blob []byte, t time.Time, nbuf,ibuf []byte) (
-			node []byte,ID []byte,ok bool,err error) {
-	req  := notrest.AckquireRequest ()
-	resp := notrest.AckquireResponse()
-	defer notrest.ReleaseRequest (req )
-	defer notrest.ReleaseResponse(resp)
+// exchange holds a pooled request/response pair. If the context of a call
+// is done before the server answered, the pair is abandoned to the pending
+// round trip, which releases it once it returns.
+type exchange struct{
+	req       *notrest.Request
+	resp      *notrest.Response
+	abandoned bool
+}
+func newExchange() *exchange {
+	return &exchange{req:notrest.AckquireRequest(),resp:notrest.AckquireResponse()}
+}
+func (e *exchange) release() {
+	if e.abandoned { return }
+	notrest.ReleaseRequest (e.req )
+	notrest.ReleaseResponse(e.resp)
+}
+
+// do sends the trace headers derived from ctx and performs the round trip.
+func (c *Client) do(ctx context.Context, e *exchange) error {
+	if err := ctx.Err() ; err!=nil { return err }
+	ctx = trace.Ensure(ctx)
+	e.req.SetHeader([]byte(trace.HeaderTraceID),[]byte(trace.ID(ctx)))
+	if istorage.NoCompress(ctx) { e.req.SetHeader([]byte(HeaderNoCompress),[]byte("1")) }
+	if dl,ok := ctx.Deadline() ; ok {
+		ms := time.Until(dl)/time.Millisecond
+		if ms<=0 { return context.DeadlineExceeded }
+		e.req.SetHeader([]byte(trace.HeaderTimeout),strconv.AppendInt(nil,int64(ms),10))
+	}
+	nc,release,err := c.conn(ctx)
+	if err!=nil { return err }
+	if ctx.Done()==nil { defer release(); return nc.Do(e.req,e.resp) }
 	
-	req.SetMethodStr("post")
-	{
-		path := append(c.tempbuf[:0],"/blobs/"...)
-		path  = binascii.IntToLe190(binascii.Unsigned(t.Unix()),path)
-		req.SetPath(path)
+	done := make(chan error,1)
+	go func() { err := nc.Do(e.req,e.resp); release(); done <- err }()
+	select {
+	case err := <-done: return err
+	case <-ctx.Done():
 	}
-	req.Body().Set(blob)
-	err = c.Client.Do(req,resp)
-	if err!=nil || resp.Code()!=204 { return }
-	node,_ = binascii.DecodeLe190(resp.GetHeaderK("node"),nbuf)
-	ID  ,_ = binascii.DecodeLe190(resp.GetHeaderK("id"),ibuf)
-	ok     = len(ID)>0
+	// The round trip is still pending; hand the pair over to it.
+	e.abandoned = true
+	go func(req *notrest.Request, resp *notrest.Response) {
+		<-done
+		notrest.ReleaseRequest (req )
+		notrest.ReleaseResponse(resp)
+	}(e.req,e.resp)
+	return ctx.Err()
+}
+
+func (c *Client) PostBlob(blob []byte, t time.Time, nbuf,ibuf []byte) (
+			node []byte,ID []byte,ok bool,err error) {
+	return c.PostBlobCtx(context.Background(),blob,t,nbuf,ibuf)
+}
+func (c *Client) PostBlobCtx(ctx context.Context, blob []byte, t time.Time, nbuf,ibuf []byte) (
+			node []byte,ID []byte,ok bool,err error) {
+	retry := c.policy().RetryPost
+	var ikey []byte
+	if retry { ikey = []byte(trace.NewID()) }
+	err = c.call(ctx,retry,func(e *exchange) {
+		req := e.req
+		req.SetMethodStr("post")
+		{
+			path := append(c.tempbuf[:0],"/blobs/"...)
+			path  = binascii.IntToLe190(binascii.Unsigned(t.Unix()),path)
+			req.SetPath(path)
+		}
+		if ikey!=nil { req.SetHeader([]byte(HeaderIdempotencyKey),ikey) }
+		req.Body().Set(blob)
+	},func(e *exchange) error {
+		resp := e.resp
+		if resp.Code()!=204 { return &StatusError{"post",resp.Code()} }
+		node,_ = binascii.DecodeLe190(resp.GetHeaderK("node"),nbuf)
+		ID  ,_ = binascii.DecodeLe190(resp.GetHeaderK("id"),ibuf)
+		return nil
+	})
+	ok = err==nil && len(ID)>0
 	return
 }
 func (c *Client) GetBlob(node []byte,ID []byte,blobbuf []byte) (blob []byte,ok bool,err error) {
-	req  := notrest.AckquireRequest ()
-	resp := notrest.AckquireResponse()
-	defer notrest.ReleaseRequest (req )
-	defer notrest.ReleaseResponse(resp)
-	
-	req.SetMethodStr("get")
-	{
-		path := append(c.tempbuf[:0],"/blobs/"...)
-		path  = binascii.EncodeLe190(node,path)
-		path  = append(path,'/')
-		path  = binascii.EncodeLe190(ID,path)
-		req.SetPath(path)
-	}
-	err = c.Client.Do(req,resp)
-	if err!=nil || resp.Code()!=200 { return }
-	
-	if decomp := decint(resp.GetHeaderK("lz4-size")) ; 0 < decomp {
-		buf := realloc(blobbuf,decomp)
-		decomp,err = lz4.UncompressBlock(resp.Body().B,buf,0)
-		if err!=nil { return }
-		blob = buf[:decomp]
-		ok = true
-		return
+	return c.GetBlobCtx(context.Background(),node,ID,blobbuf)
+}
+
+// GetBlobCtx loads a blob. Redirects to the new location of a moved blob
+// are followed.
+func (c *Client) GetBlobCtx(ctx context.Context, node []byte,ID []byte,blobbuf []byte) (blob []byte,ok bool,err error) {
+	for hops := 0 ; ; hops++ {
+		moved := false
+		err = c.call(ctx,true,func(e *exchange) {
+			req := e.req
+			req.SetMethodStr("get")
+			req.SetHeader([]byte(HeaderAcceptCodec),acceptCodec())
+			{
+				path := append(c.tempbuf[:0],"/blobs/"...)
+				path  = binascii.EncodeLe190(node,path)
+				path  = append(path,'/')
+				path  = binascii.EncodeLe190(ID,path)
+				req.SetPath(path)
+			}
+		},func(e *exchange) error {
+			resp := e.resp
+			if resp.Code()==307 && hops<maxRedirects {
+				node,_ = binascii.DecodeLe190(resp.GetHeaderK("node"),nil)
+				ID  ,_ = binascii.DecodeLe190(resp.GetHeaderK("id"),nil)
+				moved = true
+				return nil
+			}
+			if resp.Code()!=200 { return &StatusError{"get",resp.Code()} }
+			
+			meta,err := payloadMeta(resp)
+			if err!=nil { return err }
+			if meta.Size>0 {
+				buf,err := istorage.Unpack(meta,resp.Body().B,blobbuf[:0])
+				if err!=nil { return err }
+				if err = verify(resp,buf) ; err!=nil { return err }
+				blob = buf
+				return nil
+			}
+			
+			if err := verify(resp,resp.Body().B) ; err!=nil { return err }
+			blob = append(blobbuf[:0],resp.Body().B...)
+			return nil
+		})
+		if err!=nil || !moved { break }
 	}
-	
-	blob = append(blobbuf[:0],resp.Body().B...)
-	ok = true
+	ok = err==nil
 	return
 }
 func (c *Client) Expire(t time.Time) (err error) {
-	req  := notrest.AckquireRequest ()
-	resp := notrest.AckquireResponse()
-	defer notrest.ReleaseRequest (req )
-	defer notrest.ReleaseResponse(resp)
-	
-	req.SetMethodStr("expire")
-	{
-		path := append(c.tempbuf[:0],"/expire/"...)
-		path  = binascii.IntToLe190(binascii.Unsigned(t.Unix()),path)
-		req.SetPath(path)
-	}
-	err = c.Client.Do(req,resp)
-	return
+	return c.ExpireCtx(context.Background(),t)
+}
+func (c *Client) ExpireCtx(ctx context.Context, t time.Time) (err error) {
+	return c.call(ctx,true,func(e *exchange) {
+		req := e.req
+		req.SetMethodStr("expire")
+		{
+			path := append(c.tempbuf[:0],"/expire/"...)
+			path  = binascii.IntToLe190(binascii.Unsigned(t.Unix()),path)
+			req.SetPath(path)
+		}
+	},func(e *exchange) error {
+		if e.resp.Code()!=200 { return &StatusError{"expire",e.resp.Code()} }
+		return nil
+	})
 }
-
-
@@ -0,0 +1,201 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import "github.com/maxymania/blobserver/binascii"
+import "github.com/maxymania/blobserver/istorage"
+import "encoding/binary"
+import "bytes"
+import "errors"
+import "context"
+import "time"
+
+var ErrInvalidRef = errors.New("invalid blob reference")
+
+// ErrChecksum is returned, if a downloaded blob does not match its checksum.
+var ErrChecksum   = errors.New("blob corrupted: checksum mismatch")
+
+// Checksum computes the CRC-32C of an uncompressed blob, as stored in BlobRef.Sum
+// and sent by the server.
+func Checksum(blob []byte) uint32 {
+	return istorage.Checksum(blob)
+}
+
+const (
+	refVersion = 1
+	refHasSum  = 1
+	refPrefix  = "br1:"
+)
+
+// BlobRef is a self-describing reference to a stored blob. It bundles the
+// name of the server (may be empty), the node UUID and backend key returned
+// by PostBlob and, optionally, a CRC-32C of the uncompressed content.
+//
+// The binary encoding is:
+//	version(1) flags(1) uvarint(len) server uvarint(len) node uvarint(len) key [sum(4)]
+// The text encoding is "br1:" followed by the binary encoding in unpadded,
+// URL-safe base64.
+type BlobRef struct{
+	Server string
+	Node   []byte
+	Key    []byte
+	Sum    uint32
+	HasSum bool
+}
+
+func appendField(buf, f []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	i := binary.PutUvarint(tmp[:],uint64(len(f)))
+	return append(append(buf,tmp[:i]...),f...)
+}
+func readField(buf []byte) (f,rest []byte,err error) {
+	l,i := binary.Uvarint(buf)
+	if i<=0 || uint64(len(buf)-i)<l { return nil,nil,ErrInvalidRef }
+	buf = buf[i:]
+	return buf[:l:l],buf[l:],nil
+}
+
+// AppendBinary appends the binary encoding of r to buf.
+func (r *BlobRef) AppendBinary(buf []byte) []byte {
+	var flags byte
+	if r.HasSum { flags |= refHasSum }
+	buf = append(buf,refVersion,flags)
+	buf = appendField(buf,[]byte(r.Server))
+	buf = appendField(buf,r.Node)
+	buf = appendField(buf,r.Key)
+	if r.HasSum {
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:],r.Sum)
+		buf = append(buf,sum[:]...)
+	}
+	return buf
+}
+func (r *BlobRef) MarshalBinary() ([]byte,error) {
+	return r.AppendBinary(nil),nil
+}
+func (r *BlobRef) UnmarshalBinary(data []byte) error {
+	if len(data)<2 || data[0]!=refVersion { return ErrInvalidRef }
+	flags := data[1]
+	srv,data,err := readField(data[2:])
+	if err!=nil { return err }
+	node,data,err := readField(data)
+	if err!=nil { return err }
+	key,data,err := readField(data)
+	if err!=nil { return err }
+	nr := BlobRef{Server:string(srv),Node:append([]byte(nil),node...),Key:append([]byte(nil),key...)}
+	if (flags&refHasSum)!=0 {
+		if len(data)<4 { return ErrInvalidRef }
+		nr.Sum    = binary.BigEndian.Uint32(data)
+		nr.HasSum = true
+		data = data[4:]
+	}
+	if len(data)!=0 { return ErrInvalidRef }
+	*r = nr
+	return nil
+}
+func (r *BlobRef) MarshalText() ([]byte,error) {
+	return binascii.EncodeBase64Raw(r.AppendBinary(nil),[]byte(refPrefix)),nil
+}
+func (r *BlobRef) UnmarshalText(text []byte) error {
+	if !bytes.HasPrefix(text,[]byte(refPrefix)) { return ErrInvalidRef }
+	data,err := binascii.DecodeBase64Raw(text[len(refPrefix):],nil)
+	if err!=nil { return ErrInvalidRef }
+	return r.UnmarshalBinary(data)
+}
+func (r *BlobRef) String() string {
+	text,_ := r.MarshalText()
+	return string(text)
+}
+
+// ParseBlobRef decodes the text encoding of a BlobRef.
+func ParseBlobRef(s string) (*BlobRef,error) {
+	r := new(BlobRef)
+	err := r.UnmarshalText([]byte(s))
+	if err!=nil { return nil,err }
+	return r,nil
+}
+
+// verify checks blob against the checksum of r, if any.
+func (r *BlobRef) verify(blob []byte) error {
+	if r.HasSum && Checksum(blob)!=r.Sum { return ErrChecksum }
+	return nil
+}
+
+func (c *Client) PostBlobRef(blob []byte, t time.Time) (*BlobRef,error) {
+	return c.PostBlobRefCtx(context.Background(),blob,t)
+}
+
+// PostBlobRefCtx stores blob and returns a reference including its checksum.
+func (c *Client) PostBlobRefCtx(ctx context.Context, blob []byte, t time.Time) (*BlobRef,error) {
+	node,ID,ok,err := c.PostBlobCtx(ctx,blob,t,nil,nil)
+	if err!=nil { return nil,err }
+	if !ok { return nil,ErrNoServer }
+	return &BlobRef{Server:c.Name,Node:node,Key:ID,Sum:Checksum(blob),HasSum:true},nil
+}
+
+func (c *Client) GetBlobRef(r *BlobRef, blobbuf []byte) (blob []byte,ok bool,err error) {
+	return c.GetBlobRefCtx(context.Background(),r,blobbuf)
+}
+
+// GetBlobRefCtx loads the blob r refers to and verifies its checksum.
+func (c *Client) GetBlobRefCtx(ctx context.Context, r *BlobRef, blobbuf []byte) (blob []byte,ok bool,err error) {
+	blob,ok,err = c.GetBlobCtx(ctx,r.Node,r.Key,blobbuf)
+	if !ok { return }
+	if err = r.verify(blob) ; err!=nil { ok = false }
+	return
+}
+
+func (c *Cluster) PostBlobRef(blob []byte, t time.Time) (*BlobRef,error) {
+	return c.PostBlobRefCtx(context.Background(),blob,t)
+}
+
+// PostBlobRefCtx stores blob and returns a reference naming the member, that
+// took it.
+func (c *Cluster) PostBlobRefCtx(ctx context.Context, blob []byte, t time.Time) (*BlobRef,error) {
+	node,ID,ok,err := c.PostBlobCtx(ctx,blob,t,nil,nil)
+	if !ok {
+		if err==nil { err = ErrNoServer }
+		return nil,err
+	}
+	r := &BlobRef{Node:node,Key:ID,Sum:Checksum(blob),HasSum:true}
+	if m := c.Owner(node) ; m!=nil { r.Server = m.Name }
+	return r,nil
+}
+
+func (c *Cluster) GetBlobRef(r *BlobRef, blobbuf []byte) (blob []byte,ok bool,err error) {
+	return c.GetBlobRefCtx(context.Background(),r,blobbuf)
+}
+
+// GetBlobRefCtx loads the blob r refers to. If the node's owner is not known
+// yet, the server named in r is tried first.
+func (c *Cluster) GetBlobRefCtx(ctx context.Context, r *BlobRef, blobbuf []byte) (blob []byte,ok bool,err error) {
+	if c.Owner(r.Node)==nil {
+		if m := c.Member(r.Server) ; m!=nil { c.SetOwner(r.Node,m) }
+	}
+	blob,ok,err = c.GetBlobCtx(ctx,r.Node,r.Key,blobbuf)
+	if !ok { return }
+	if err = r.verify(blob) ; err!=nil { ok = false }
+	return
+}
+
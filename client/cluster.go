@@ -0,0 +1,208 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import "context"
+import "errors"
+import "hash/fnv"
+import "sort"
+import "strconv"
+import "sync"
+import "time"
+
+var ErrNoServer = errors.New("no server available")
+var ErrUnknownNode = errors.New("no server owns the node")
+
+// Replicas per unit of weight on the hash ring.
+const ringReplicas = 64
+
+// A Member is one blobserver instance within a Cluster.
+type Member struct{
+	Name   string
+	Client *Client
+	Weight int // Values <=0 count as 1.
+}
+
+type ringPoint struct{
+	hash   uint64
+	member *Member
+}
+
+// Cluster spreads writes across several servers using a weighted consistent
+// hash ring, and routes reads to the server that owns the node UUID.
+//
+// Ownership is learned from PostBlob responses. Nodes, that are not known yet,
+// are looked up by asking every member in turn.
+type Cluster struct{
+	members []*Member
+	ring    []ringPoint
+	
+	mutex   sync.RWMutex
+	owners  map[string]*Member
+}
+
+func hash64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+func NewCluster(members ...*Member) *Cluster {
+	c := &Cluster{members:members,owners:make(map[string]*Member)}
+	var buf []byte
+	for _,m := range members {
+		w := m.Weight
+		if w<=0 { w = 1 }
+		for i := 0 ; i<w*ringReplicas ; i++ {
+			buf = append(append(buf[:0],m.Name...),'#')
+			buf = strconv.AppendInt(buf,int64(i),10)
+			c.ring = append(c.ring,ringPoint{hash64(buf),m})
+		}
+	}
+	sort.Slice(c.ring,func(i,j int) bool { return c.ring[i].hash<c.ring[j].hash })
+	return c
+}
+
+// candidates returns the members in ring order, starting with the owner of h.
+func (c *Cluster) candidates(h uint64) []*Member {
+	n := len(c.ring)
+	if n==0 { return nil }
+	i := sort.Search(n,func(i int) bool { return c.ring[i].hash>=h })
+	res  := make([]*Member,0,len(c.members))
+	seen := make(map[*Member]bool,len(c.members))
+	for j := 0 ; j<n && len(res)<len(c.members) ; j++ {
+		m := c.ring[(i+j)%n].member
+		if seen[m] { continue }
+		seen[m] = true
+		res = append(res,m)
+	}
+	return res
+}
+
+// Member returns the member named name, or nil.
+func (c *Cluster) Member(name string) *Member {
+	if name=="" { return nil }
+	for _,m := range c.members {
+		if m.Name==name { return m }
+	}
+	return nil
+}
+
+// Owner returns the member, that owns the node UUID, or nil.
+func (c *Cluster) Owner(node []byte) *Member {
+	c.mutex.RLock(); defer c.mutex.RUnlock()
+	return c.owners[string(node)]
+}
+
+// SetOwner records, that node lives on m.
+func (c *Cluster) SetOwner(node []byte, m *Member) {
+	c.mutex.Lock(); defer c.mutex.Unlock()
+	c.owners[string(node)] = m
+}
+
+func (c *Cluster) PostBlob(blob []byte, t time.Time, nbuf,ibuf []byte) (
+			node []byte,ID []byte,ok bool,err error) {
+	return c.PostBlobCtx(context.Background(),blob,t,nbuf,ibuf)
+}
+
+// PostBlobCtx stores the blob on the member, that the hash of blob maps to.
+// If that member fails, the next member on the ring is tried.
+func (c *Cluster) PostBlobCtx(ctx context.Context, blob []byte, t time.Time, nbuf,ibuf []byte) (
+			node []byte,ID []byte,ok bool,err error) {
+	err = ErrNoServer
+	for _,m := range c.candidates(hash64(blob)) {
+		node,ID,ok,err = m.Client.PostBlobCtx(ctx,blob,t,nbuf,ibuf)
+		if ok {
+			c.SetOwner(node,m)
+			return
+		}
+		if ctx.Err()!=nil { return }
+	}
+	return
+}
+
+func (c *Cluster) GetBlob(node []byte,ID []byte,blobbuf []byte) (blob []byte,ok bool,err error) {
+	return c.GetBlobCtx(context.Background(),node,ID,blobbuf)
+}
+
+// GetBlobCtx loads the blob from the member, that owns node.
+func (c *Cluster) GetBlobCtx(ctx context.Context, node []byte,ID []byte,blobbuf []byte) (blob []byte,ok bool,err error) {
+	return c.getBlob(ctx,node,ID,blobbuf,nil)
+}
+
+// corrupted reports, whether err tells of a damaged copy of a blob.
+func corrupted(err error) bool { return err==ErrChecksum || err==ErrDecrypt }
+
+// getBlob is GetBlobCtx. If open is not nil, it is applied to each copy, and
+// a copy, that it rejects with ErrChecksum or ErrDecrypt, counts as corrupted.
+func (c *Cluster) getBlob(ctx context.Context, node []byte,ID []byte,blobbuf []byte, open func(blob []byte) ([]byte,error)) (blob []byte,ok bool,err error) {
+	final := false // open failed, but not for a corrupted copy, such as for a missing key.
+	get := func(m *Member) ([]byte,bool,error) {
+		blob,ok,err := m.Client.GetBlobCtx(ctx,node,ID,blobbuf)
+		if !ok || open==nil { return blob,ok,err }
+		blob,err = open(blob)
+		final = err!=nil && !corrupted(err)
+		return blob,err==nil,err
+	}
+	if m := c.Owner(node) ; m!=nil {
+		blob,ok,err = get(m)
+		if ok || final || IsStatus(err) { return }
+		if ctx.Err()!=nil { return }
+		// Connection error or corruption: the node might have moved or have
+		// been copied elsewhere. Ask everybody.
+	}
+	var lastErr error
+	var skip *Member // The owner, if it served a corrupted copy.
+	if corrupted(err) { skip,lastErr = c.Owner(node),err }
+	for _,m := range c.members {
+		if skip!=nil && m==skip { continue }
+		blob,ok,err = get(m)
+		if ok {
+			c.SetOwner(node,m)
+			return
+		}
+		if final { return }
+		if ctx.Err()!=nil { return }
+		if !IsStatus(err) { lastErr = err }
+	}
+	// If every member answered, none of them has the node.
+	err = lastErr
+	if err==nil { err = ErrUnknownNode }
+	return
+}
+
+func (c *Cluster) Expire(t time.Time) (err error) {
+	return c.ExpireCtx(context.Background(),t)
+}
+
+// ExpireCtx sends the expire request to every member. It returns the first
+// error encountered, but always tries all members.
+func (c *Cluster) ExpireCtx(ctx context.Context, t time.Time) (err error) {
+	for _,m := range c.members {
+		e := m.Client.ExpireCtx(ctx,t)
+		if err==nil { err = e }
+	}
+	return
+}
+
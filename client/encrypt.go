@@ -0,0 +1,274 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package client
+
+import "github.com/maxymania/blobserver/istorage"
+import "crypto/aes"
+import "crypto/cipher"
+import "crypto/rand"
+import "context"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "sync"
+import "time"
+
+var ErrNotEncrypted = errors.New("blob is not encrypted")
+
+// ErrDecrypt is returned, if an envelope is damaged or forged. Like
+// ErrChecksum, it makes a Cluster try the other members.
+var ErrDecrypt      = errors.New("blob decryption failed")
+
+// A KeyProvider supplies the 256-bit AES keys of an Encrypted client. It may
+// fetch them from a key management service; keys are cached by ID.
+type KeyProvider interface{
+	// CurrentKey returns the key, that new blobs are encrypted with.
+	CurrentKey(ctx context.Context) (id uint32,key []byte,err error)
+	
+	// Key returns the key with the given ID.
+	Key(ctx context.Context, id uint32) ([]byte,error)
+}
+
+// StaticKeys is a KeyProvider, that holds its keys in memory.
+type StaticKeys struct{
+	Current uint32
+	Keys    map[uint32][]byte
+}
+// LoadKeyfile reads StaticKeys from a keyfile, see istorage.ReadKeyfile.
+func LoadKeyfile(path string) (*StaticKeys,error) {
+	current,keys,err := istorage.ReadKeyfile(path)
+	if err!=nil { return nil,err }
+	return &StaticKeys{current,keys},nil
+}
+func (s *StaticKeys) CurrentKey(ctx context.Context) (uint32,[]byte,error) {
+	k,err := s.Key(ctx,s.Current)
+	return s.Current,k,err
+}
+func (s *StaticKeys) Key(ctx context.Context, id uint32) ([]byte,error) {
+	k,ok := s.Keys[id]
+	if !ok { return nil,fmt.Errorf("no key with ID %d",id) }
+	return k,nil
+}
+
+// BlobClient is implemented by Client and Cluster.
+type BlobClient interface{
+	PostBlobCtx(ctx context.Context, blob []byte, t time.Time, nbuf,ibuf []byte) (node []byte,ID []byte,ok bool,err error)
+	GetBlobCtx(ctx context.Context, node []byte,ID []byte,blobbuf []byte) (blob []byte,ok bool,err error)
+}
+
+/*
+Encrypted encrypts blobs before they are posted and decrypts them after they
+are loaded, so that the server never sees their content. As encrypted blobs
+don't compress, they are compressed here, and posted with the no-compress hint.
+
+Envelope layout:
+	[1]  version (1)
+	[4]  key ID
+	[12] nonce
+	[*]  AES-256-GCM ciphertext of a record written by istorage.PutHead, and its tag
+The version and key ID are authenticated as additional data.
+*/
+type Encrypted struct{
+	Client BlobClient
+	Keys   KeyProvider
+	
+	// Codec compresses the blobs. If nil, istorage.DefaultCodec is used.
+	Codec  *istorage.Codec
+	
+	// KeyTTL is, how long the result of Keys.CurrentKey is used, one minute
+	// if 0. A rotation takes effect after this time.
+	KeyTTL time.Duration
+	
+	once   sync.Once
+	comp   *istorage.Compressor
+	mutex  sync.Mutex
+	aeads  map[uint32]cipher.AEAD
+	cur    uint32
+	curAt  time.Time // When cur was fetched, zero if never.
+}
+
+const (
+	envVersion = 1
+	envHead    = 1+4+12
+	envTag     = 16
+)
+
+func (e *Encrypted) init() {
+	e.once.Do(func() {
+		c := e.Codec
+		if c==nil { c = istorage.DefaultCodec }
+		e.comp  = istorage.NewCompressor(c)
+		e.aeads = make(map[uint32]cipher.AEAD)
+	})
+}
+
+// aead returns the cipher of key id, and fetches the key, if it isn't cached.
+func (e *Encrypted) aead(ctx context.Context, id uint32) (cipher.AEAD,error) {
+	e.mutex.Lock()
+	a,ok := e.aeads[id]
+	e.mutex.Unlock()
+	if ok { return a,nil }
+	key,err := e.Keys.Key(ctx,id)
+	if err!=nil { return nil,err }
+	return e.addKey(id,key)
+}
+func (e *Encrypted) addKey(id uint32, key []byte) (cipher.AEAD,error) {
+	e.mutex.Lock(); defer e.mutex.Unlock()
+	if a,ok := e.aeads[id] ; ok { return a,nil }
+	b,err := aes.NewCipher(key)
+	if err!=nil { return nil,err }
+	a,err := cipher.NewGCM(b)
+	if err!=nil { return nil,err }
+	e.aeads[id] = a
+	return a,nil
+}
+
+// current returns the ID and cipher of the current key, see KeyTTL.
+func (e *Encrypted) current(ctx context.Context) (uint32,cipher.AEAD,error) {
+	ttl := e.KeyTTL
+	if ttl<=0 { ttl = time.Minute }
+	e.mutex.Lock()
+	id,at := e.cur,e.curAt
+	e.mutex.Unlock()
+	if !at.IsZero() && time.Since(at)<ttl {
+		a,err := e.aead(ctx,id)
+		return id,a,err
+	}
+	id,key,err := e.Keys.CurrentKey(ctx)
+	if err!=nil { return 0,nil,err }
+	a,err := e.addKey(id,key)
+	if err!=nil { return 0,nil,err }
+	e.mutex.Lock()
+	e.cur,e.curAt = id,time.Now()
+	e.mutex.Unlock()
+	return id,a,nil
+}
+
+// CompressCounts returns the compression decisions made so far.
+func (e *Encrypted) CompressCounts() istorage.CompressCounts {
+	e.init()
+	return e.comp.Counts()
+}
+
+// Seal compresses and encrypts blob, and appends its envelope to dst.
+func (e *Encrypted) Seal(ctx context.Context, dst, blob []byte) ([]byte,error) {
+	e.init()
+	id,a,err := e.current(ctx)
+	if err!=nil { return nil,err }
+	
+	rec,meta := e.comp.Compress(ctx,make([]byte,istorage.HeadLen,istorage.HeadLen+len(blob)),blob)
+	istorage.PutHead(rec,meta)
+	
+	l := len(dst)
+	if cap(dst)-l<envHead+len(rec)+envTag {
+		nd := make([]byte,l,l+envHead+len(rec)+envTag)
+		copy(nd,dst)
+		dst = nd
+	}
+	dst = dst[:l+envHead]
+	dst[l] = envVersion
+	binary.BigEndian.PutUint32(dst[l+1:],id)
+	nonce := dst[l+5:l+envHead]
+	if _,err = io.ReadFull(rand.Reader,nonce) ; err!=nil { return nil,err }
+	return a.Seal(dst,nonce,rec,dst[l:l+5]),nil
+}
+
+// Open decrypts and decompresses an envelope written by Seal. The result may
+// alias env or blobbuf.
+func (e *Encrypted) Open(ctx context.Context, env, blobbuf []byte) ([]byte,error) {
+	e.init()
+	if len(env)<envHead+envTag || env[0]!=envVersion { return nil,ErrNotEncrypted }
+	a,err := e.aead(ctx,binary.BigEndian.Uint32(env[1:]))
+	if err!=nil { return nil,err }
+	ct := env[envHead:]
+	rec,err := a.Open(ct[:0],env[5:envHead],ct,env[:5])
+	if err!=nil { return nil,ErrDecrypt }
+	meta,payload,ok := istorage.ParseHead(rec)
+	if !ok { return nil,ErrDecrypt }
+	return istorage.Unpack(meta,payload,blobbuf)
+}
+
+func (e *Encrypted) PostBlob(blob []byte, t time.Time, nbuf,ibuf []byte) (
+			node []byte,ID []byte,ok bool,err error) {
+	return e.PostBlobCtx(context.Background(),blob,t,nbuf,ibuf)
+}
+
+// PostBlobCtx encrypts blob and posts it.
+func (e *Encrypted) PostBlobCtx(ctx context.Context, blob []byte, t time.Time, nbuf,ibuf []byte) (
+			node []byte,ID []byte,ok bool,err error) {
+	env,err := e.Seal(ctx,nil,blob)
+	if err!=nil { return }
+	return e.Client.PostBlobCtx(istorage.WithNoCompress(ctx),env,t,nbuf,ibuf)
+}
+
+func (e *Encrypted) GetBlob(node []byte,ID []byte,blobbuf []byte) (blob []byte,ok bool,err error) {
+	return e.GetBlobCtx(context.Background(),node,ID,blobbuf)
+}
+
+// GetBlobCtx loads a blob and decrypts it.
+func (e *Encrypted) GetBlobCtx(ctx context.Context, node []byte,ID []byte,blobbuf []byte) (blob []byte,ok bool,err error) {
+	return e.getBlob(ctx,node,ID,blobbuf,nil)
+}
+
+// getBlob loads a blob, decrypts it and checks it with verify, if not nil.
+// A Cluster tries the other members, if that fails.
+func (e *Encrypted) getBlob(ctx context.Context, node []byte,ID []byte,blobbuf []byte, verify func(blob []byte) error) (blob []byte,ok bool,err error) {
+	open := func(env []byte) ([]byte,error) {
+		blob,err := e.Open(ctx,env,blobbuf[:0])
+		if err==nil && verify!=nil { err = verify(blob) }
+		return blob,err
+	}
+	if c,isCluster := e.Client.(*Cluster) ; isCluster { return c.getBlob(ctx,node,ID,nil,open) }
+	env,ok,err := e.Client.GetBlobCtx(ctx,node,ID,nil)
+	if !ok { return }
+	blob,err = open(env)
+	ok = err==nil
+	return
+}
+
+func (e *Encrypted) PostBlobRef(blob []byte, t time.Time) (*BlobRef,error) {
+	return e.PostBlobRefCtx(context.Background(),blob,t)
+}
+
+// PostBlobRefCtx encrypts and stores blob, and returns a reference including
+// the checksum of its plain content.
+func (e *Encrypted) PostBlobRefCtx(ctx context.Context, blob []byte, t time.Time) (*BlobRef,error) {
+	node,ID,ok,err := e.PostBlobCtx(ctx,blob,t,nil,nil)
+	if err!=nil { return nil,err }
+	if !ok { return nil,ErrNoServer }
+	r := &BlobRef{Node:node,Key:ID,Sum:Checksum(blob),HasSum:true}
+	if c,ok := e.Client.(*Client) ; ok { r.Server = c.Name }
+	return r,nil
+}
+
+func (e *Encrypted) GetBlobRef(r *BlobRef, blobbuf []byte) (blob []byte,ok bool,err error) {
+	return e.GetBlobRefCtx(context.Background(),r,blobbuf)
+}
+
+// GetBlobRefCtx loads the blob r refers to, decrypts it and verifies its checksum.
+func (e *Encrypted) GetBlobRefCtx(ctx context.Context, r *BlobRef, blobbuf []byte) (blob []byte,ok bool,err error) {
+	return e.getBlob(ctx,r.Node,r.Key,blobbuf,r.verify)
+}
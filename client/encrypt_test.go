@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package client_test
+
+import "github.com/maxymania/blobserver/client"
+import "bytes"
+import "context"
+import "testing"
+
+// countingKeys counts the calls of a StaticKeys.
+type countingKeys struct{
+	client.StaticKeys
+	current,key int
+}
+func (c *countingKeys) CurrentKey(ctx context.Context) (uint32,[]byte,error) {
+	c.current++
+	return c.StaticKeys.CurrentKey(ctx)
+}
+func (c *countingKeys) Key(ctx context.Context, id uint32) ([]byte,error) {
+	c.key++
+	return c.StaticKeys.Key(ctx,id)
+}
+
+func newKeys() *countingKeys {
+	k := &countingKeys{StaticKeys:client.StaticKeys{Current:1,Keys:map[uint32][]byte{}}}
+	k.Keys[1] = bytes.Repeat([]byte{1},32)
+	k.Keys[2] = bytes.Repeat([]byte{2},32)
+	return k
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	e := &client.Encrypted{Keys:newKeys()}
+	for _,blob := range [][]byte{nil,[]byte("hello"),bytes.Repeat([]byte("compressible "),1000)} {
+		env,err := e.Seal(ctx,nil,blob)
+		if err!=nil { t.Fatal(err) }
+		got,err := e.Open(ctx,env,nil)
+		if err!=nil { t.Fatal(err) }
+		if !bytes.Equal(got,blob) { t.Fatalf("got %q, want %q",got,blob) }
+	}
+}
+
+// Envelopes are opened with the key, whose ID they carry, and keys are
+// fetched only once.
+func TestEncryptedKeyLookup(t *testing.T) {
+	ctx := context.Background()
+	keys := newKeys()
+	e := &client.Encrypted{Keys:keys}
+	env1,err := e.Seal(ctx,nil,[]byte("one"))
+	if err!=nil { t.Fatal(err) }
+	keys.Current = 2
+	e.Seal(ctx,nil,[]byte("cached"))
+	if keys.current!=1 { t.Fatalf("CurrentKey called %d times, want 1",keys.current) }
+	
+	e2 := &client.Encrypted{Keys:keys}
+	env2,err := e2.Seal(ctx,nil,[]byte("two"))
+	if err!=nil { t.Fatal(err) }
+	for i := 0 ; i<3 ; i++ {
+		for _,env := range [][]byte{env1,env2} {
+			if _,err = e2.Open(ctx,append([]byte(nil),env...),nil) ; err!=nil { t.Fatal(err) }
+		}
+	}
+	if keys.key!=1 { t.Fatalf("Key called %d times, want 1",keys.key) }
+	
+	delete(keys.Keys,1)
+	if _,err = (&client.Encrypted{Keys:keys}).Open(ctx,env1,nil) ; err==nil { t.Fatal("opened with a missing key") }
+}
+
+func TestEncryptedTamper(t *testing.T) {
+	ctx := context.Background()
+	e := &client.Encrypted{Keys:newKeys()}
+	env,err := e.Seal(ctx,nil,[]byte("do not touch"))
+	if err!=nil { t.Fatal(err) }
+	for i := range env {
+		if i==0 { continue } // The version byte.
+		bad := append([]byte(nil),env...)
+		bad[i] ^= 1
+		_,err = e.Open(ctx,bad,nil)
+		if i>=1 && i<5 {
+			// A different key ID either names an unknown key or fails to open.
+			if err==nil { t.Fatalf("byte %d: tampered key ID accepted",i) }
+			continue
+		}
+		if err!=client.ErrDecrypt { t.Fatalf("byte %d: got %v, want ErrDecrypt",i,err) }
+	}
+	if _,err = e.Open(ctx,env[:len(env)-1],nil) ; err!=client.ErrDecrypt { t.Fatalf("truncated: got %v",err) }
+}
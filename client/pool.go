@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package client
+
+import "github.com/byte-mug/gocom/notrest"
+import "context"
+import "sync"
+
+// PoolPolicy spreads the round trips of a Client over several connections
+// and bounds how many of them are in flight.
+type PoolPolicy struct{
+	// Conns is the number of connections. Values <=1 use Client.Client alone.
+	Conns       int
+	// MaxInflight limits the round trips per connection, if >0. Further
+	// calls wait for a free slot, or until their context is done.
+	MaxInflight int
+	// Dial creates the connections besides Client.Client. If nil, they
+	// dial the Addr of Client.Client.
+	Dial        func() *notrest.Client
+}
+
+type connPool struct{
+	mutex sync.Mutex
+	conns []*notrest.Client
+	busy  []int
+	slots chan struct{} // nil, if unbounded.
+}
+
+func newConnPool(first *notrest.Client, p *PoolPolicy) *connPool {
+	n := p.Conns
+	if n<1 { n = 1 }
+	cp := &connPool{conns:make([]*notrest.Client,n),busy:make([]int,n)}
+	cp.conns[0] = first
+	for i := 1 ; i<n ; i++ {
+		if p.Dial!=nil {
+			cp.conns[i] = p.Dial()
+		} else {
+			cp.conns[i] = &notrest.Client{Addr:first.Addr}
+		}
+	}
+	if p.MaxInflight>0 { cp.slots = make(chan struct{},n*p.MaxInflight) }
+	return cp
+}
+
+// acquire picks the least busy connection.
+func (cp *connPool) acquire(ctx context.Context) (*notrest.Client,int,error) {
+	if cp.slots!=nil {
+		select {
+		case cp.slots <- struct{}{}:
+		case <-ctx.Done(): return nil,0,ctx.Err()
+		}
+	}
+	cp.mutex.Lock(); defer cp.mutex.Unlock()
+	j := 0
+	for i,b := range cp.busy {
+		if b<cp.busy[j] { j = i }
+	}
+	cp.busy[j]++
+	return cp.conns[j],j,nil
+}
+func (cp *connPool) release(j int) {
+	cp.mutex.Lock()
+	cp.busy[j]--
+	cp.mutex.Unlock()
+	if cp.slots!=nil { <-cp.slots }
+}
+
+// conn returns the connection for the next round trip. The returned
+// function must be called, once the round trip is over.
+func (c *Client) conn(ctx context.Context) (*notrest.Client,func(),error) {
+	if c.Pool==nil { return c.Client,func(){},nil }
+	c.poolOnce.Do(func() { c.pool = newConnPool(c.Client,c.Pool) })
+	nc,j,err := c.pool.acquire(ctx)
+	if err!=nil { return nil,nil,err }
+	return nc,func() { c.pool.release(j) },nil
+}
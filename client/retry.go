@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/maxymania/blobserver/trace"
+import "context"
+import "fmt"
+import "math/rand"
+import "time"
+
+// HeaderIdempotencyKey names the header, that marks retried POSTs as such.
+const HeaderIdempotencyKey = istorage.HeaderIdempotencyKey
+
+// HeaderNoCompress names the header, that asks the server to store uploads
+// uncompressed. It is sent, if the context of a call carries
+// istorage.WithNoCompress.
+const HeaderNoCompress = istorage.HeaderNoCompress
+
+// HeaderAcceptCodec names the header, that lists the codecs a client decodes.
+const HeaderAcceptCodec = istorage.HeaderAcceptCodec
+
+// StatusError is returned, if the server answered with an unexpected status.
+type StatusError struct{
+	Op   string
+	Code int
+}
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("blobserver: %s: unexpected status %d",e.Op,e.Code)
+}
+
+// IsStatus reports, whether err is a *StatusError, meaning the server
+// was reached and answered.
+func IsStatus(err error) bool {
+	_,ok := err.(*StatusError)
+	return ok
+}
+
+// RetryPolicy controls how often and how fast failed calls are retried.
+// Only transport errors, checksum mismatches and 5xx responses are retried.
+type RetryPolicy struct{
+	MaxAttempts    int // Total number of attempts; values <=1 disable retries.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	
+	// Retry POSTs too. Each PostBlob sends an idempotency key, so that the
+	// server stores the blob only once, even if a response got lost.
+	RetryPost      bool
+}
+
+// DefaultRetryPolicy is used by a Client, whose Retry field is nil.
+// It retries GETs and EXPIREs, but not POSTs.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts   : 3,
+	InitialBackoff: 50*time.Millisecond,
+	MaxBackoff    : 2*time.Second,
+	Multiplier    : 2,
+}
+
+// NoRetry disables retries.
+var NoRetry = RetryPolicy{MaxAttempts:1}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1 ; i<attempt ; i++ {
+		d *= p.Multiplier
+		if p.MaxBackoff>0 && d>float64(p.MaxBackoff) { d = float64(p.MaxBackoff); break }
+	}
+	// Full jitter between d/2 and d.
+	return time.Duration(d/2 + rand.Float64()*d/2)
+}
+
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err()!=nil { return false }
+	if se,ok := err.(*StatusError) ; ok { return se.Code>=500 }
+	if err==ErrUnknownCodec { return false }
+	return true // Transport errors and ErrChecksum (the download might be damaged).
+}
+
+func (c *Client) policy() *RetryPolicy {
+	if c.Retry!=nil { return c.Retry }
+	return &DefaultRetryPolicy
+}
+
+// attempt performs one round trip with the per-call timeout applied.
+// prep fills the request, fin evaluates the response.
+func (c *Client) attempt(ctx context.Context, prep func(e *exchange), fin func(e *exchange) error) error {
+	if c.Timeout>0 {
+		var cancel context.CancelFunc
+		ctx,cancel = context.WithTimeout(ctx,c.Timeout)
+		defer cancel()
+	}
+	e := newExchange()
+	defer e.release()
+	prep(e)
+	if err := c.do(ctx,e) ; err!=nil { return err }
+	return fin(e)
+}
+
+// call runs attempt, retrying it according to the retry policy, if
+// idempotent is true.
+func (c *Client) call(ctx context.Context, idempotent bool, prep func(e *exchange), fin func(e *exchange) error) error {
+	p := c.policy()
+	ctx = trace.Ensure(ctx) // Retries share the trace ID.
+	for n := 1 ; ; n++ {
+		err := c.attempt(ctx,prep,fin)
+		if err==nil || !idempotent || n>=p.MaxAttempts || !retryable(ctx,err) { return err }
+		t := time.NewTimer(p.backoff(n))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
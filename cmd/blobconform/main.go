@@ -0,0 +1,76 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// Command blobconform runs the conformance suite against the built-in storage backends.
+//
+//	blobconform [-method name] [-dir tmpdir]
+package main
+
+import "github.com/maxymania/blobserver/storage"
+import "github.com/maxymania/blobserver/storage/conformance"
+import _ "github.com/maxymania/blobserver/storage/filebased"
+import _ "github.com/maxymania/blobserver/storage/gobasedb"
+import _ "github.com/maxymania/blobserver/storage/czniclldb"
+import _ "github.com/maxymania/blobserver/storage/memory"
+import "flag"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "sort"
+
+func main() {
+	method := flag.String("method","","backend to check (default: all)")
+	tmp    := flag.String("dir","","parent directory for scratch storages")
+	flag.Parse()
+	
+	var methods []string
+	for m := range conformance.Profiles {
+		if *method=="" || *method==m { methods = append(methods,m) }
+	}
+	if len(methods)==0 { fmt.Fprintf(os.Stderr,"unknown method %q\n",*method); os.Exit(2) }
+	sort.Strings(methods)
+	
+	root,err := ioutil.TempDir(*tmp,"blobconform")
+	if err!=nil { fmt.Fprintln(os.Stderr,err); os.Exit(1) }
+	defer os.RemoveAll(root)
+	mkdir := func() (string,error) { return ioutil.TempDir(root,"st") }
+	
+	failed := 0
+	for _,m := range methods {
+		loader,ok := storage.Backends[m]
+		if !ok { continue }
+		for _,r := range conformance.Run(m,loader,mkdir,conformance.Profiles[m]) {
+			if r.Err!=nil {
+				failed++
+				fmt.Printf("FAIL %s %s: %v\n",m,r.Name,r.Err)
+			} else {
+				fmt.Printf("ok   %s %s\n",m,r.Name)
+			}
+		}
+	}
+	if failed>0 {
+		os.RemoveAll(root)
+		os.Exit(1)
+	}
+}
+
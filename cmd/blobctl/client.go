@@ -0,0 +1,274 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package main
+
+import "github.com/maxymania/blobserver/client"
+import "github.com/maxymania/blobserver/binascii"
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/byte-mug/gocom/notrest"
+import "context"
+import "flag"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "time"
+
+func init() {
+	commands["put"]    = &command{"upload a file (or stdin) and print its reference",put}
+	commands["get"]    = &command{"download a blob by reference",get}
+	commands["stat"]   = &command{"show the stored size and checksum of a blob",stat}
+	commands["list"]   = &command{"list the blobs of a storage node",list}
+	commands["expire"] = &command{"expire all days up to a date",expire}
+	commands["stats"]  = &command{"show the storage nodes of a server",stats}
+	commands["reload"] = &command{"make the server reload its storage configuration",reload}
+	commands["mode"]   = &command{"set the mode of a storage node",mode}
+	commands["purge"]  = &command{"destroy the key of a day on a storage node",purge}
+}
+
+func serverFlag(fs *flag.FlagSet) *string {
+	def := os.Getenv("BLOBSERVER")
+	if def=="" { def = "localhost:7070" }
+	return fs.String("server",def,"server address (default: $BLOBSERVER)")
+}
+
+func dial(addr string) *client.Client {
+	return &client.Client{Client:&notrest.Client{Addr:addr},Name:addr}
+}
+
+// parseTime accepts RFC 3339, YYYY-MM-DD and unix seconds.
+func parseTime(s string) (time.Time,error) {
+	if s=="" || s=="now" { return time.Now(),nil }
+	if t,err := time.Parse(time.RFC3339,s) ; err==nil { return t,nil }
+	if t,err := time.Parse("2006-01-02",s) ; err==nil { return t,nil }
+	if u,err := strconv.ParseInt(s,10,64) ; err==nil { return time.Unix(u,0),nil }
+	return time.Time{},fmt.Errorf("invalid time %q",s)
+}
+
+func encodeNode(node []byte) string { return string(binascii.EncodeBase64Raw(node,nil)) }
+
+// refArg parses the only argument of fs as a BlobRef.
+func refArg(fs *flag.FlagSet) (*client.BlobRef,error) {
+	if fs.NArg()!=1 { return nil,fmt.Errorf("expected exactly one reference") }
+	return client.ParseBlobRef(fs.Arg(0))
+}
+
+func put(fs *flag.FlagSet, args []string) error {
+	srv := serverFlag(fs)
+	ts  := fs.String("t","now","timestamp of the blob: RFC 3339, YYYY-MM-DD or unix seconds")
+	raw := fs.Bool("no-compress",false,"store the blob uncompressed")
+	kf  := fs.String("keyfile","","encrypt the blob with the last key of this keyfile")
+	fs.Parse(args)
+	t,err := parseTime(*ts)
+	if err!=nil { return err }
+	var blob []byte
+	switch fs.NArg() {
+	case 0: blob,err = ioutil.ReadAll(os.Stdin)
+	case 1: blob,err = ioutil.ReadFile(fs.Arg(0))
+	default: return fmt.Errorf("expected at most one file")
+	}
+	if err!=nil { return err }
+	ctx := context.Background()
+	if *raw { ctx = istorage.WithNoCompress(ctx) }
+	var ref *client.BlobRef
+	if *kf!="" {
+		var keys *client.StaticKeys
+		if keys,err = client.LoadKeyfile(*kf) ; err!=nil { return err }
+		ref,err = (&client.Encrypted{Client:dial(*srv),Keys:keys}).PostBlobRefCtx(ctx,blob,t)
+	} else {
+		ref,err = dial(*srv).PostBlobRefCtx(ctx,blob,t)
+	}
+	if err!=nil { return err }
+	fmt.Println(ref)
+	return nil
+}
+
+func get(fs *flag.FlagSet, args []string) error {
+	srv := serverFlag(fs)
+	out := fs.String("o","","output file (default: stdout)")
+	kf  := fs.String("keyfile","","decrypt the blob with a key of this keyfile")
+	fs.Parse(args)
+	ref,err := refArg(fs)
+	if err!=nil { return err }
+	addr := *srv
+	if ref.Server!="" && !flagSet(fs,"server") { addr = ref.Server }
+	var blob []byte
+	if *kf!="" {
+		var keys *client.StaticKeys
+		if keys,err = client.LoadKeyfile(*kf) ; err!=nil { return err }
+		blob,_,err = (&client.Encrypted{Client:dial(addr),Keys:keys}).GetBlobRef(ref,nil)
+	} else {
+		blob,_,err = dial(addr).GetBlobRef(ref,nil)
+	}
+	if err!=nil { return err }
+	if *out=="" {
+		_,err = os.Stdout.Write(blob)
+		return err
+	}
+	return ioutil.WriteFile(*out,blob,0644)
+}
+
+func stat(fs *flag.FlagSet, args []string) error {
+	srv := serverFlag(fs)
+	fs.Parse(args)
+	ref,err := refArg(fs)
+	if err!=nil { return err }
+	addr := *srv
+	if ref.Server!="" && !flagSet(fs,"server") { addr = ref.Server }
+	st,err := dial(addr).StatBlob(ref.Node,ref.Key)
+	if err!=nil { return err }
+	fmt.Printf("server:  %s\nnode:    %s\nkey:     %s\nstored:  %d\n",addr,encodeNode(ref.Node),encodeNode(ref.Key),st.Stored)
+	if st.Size>0 { fmt.Printf("size:    %d (%s)\n",st.Size,st.Codec) } else { fmt.Printf("size:    %d\n",st.Stored) }
+	if st.HasSum { fmt.Printf("crc32c:  %08x\n",st.Sum) }
+	if ref.HasSum && st.HasSum && ref.Sum!=st.Sum { return client.ErrChecksum }
+	return nil
+}
+
+func flagSet(fs *flag.FlagSet, name string) (set bool) {
+	fs.Visit(func(f *flag.Flag) { if f.Name==name { set = true } })
+	return
+}
+
+func list(fs *flag.FlagSet, args []string) error {
+	srv  := serverFlag(fs)
+	node := fs.String("node","","storage node as printed by stats (default: all listable nodes)")
+	day  := fs.String("day","","only list the blobs of this day")
+	fs.Parse(args)
+	var t time.Time
+	if *day!="" {
+		var err error
+		if t,err = parseTime(*day) ; err!=nil { return err }
+	}
+	c := dial(*srv)
+	nodes,err := listNodes(c,*node)
+	if err!=nil { return err }
+	for _,n := range nodes {
+		entries,err := c.ListBlobs(n,t)
+		if err!=nil { return fmt.Errorf("node %s: %v",encodeNode(n),err) }
+		for _,e := range entries {
+			ref := &client.BlobRef{Server:*srv,Node:n,Key:e.ID}
+			fmt.Printf("%s %s\n",e.Day.Format("2006-01-02"),ref)
+		}
+	}
+	return nil
+}
+
+// listNodes returns the node named by enc, or all listable nodes of c.
+func listNodes(c *client.Client, enc string) ([][]byte,error) {
+	if enc!="" {
+		n,err := binascii.DecodeBase64Raw([]byte(enc),nil)
+		if err!=nil { return nil,fmt.Errorf("invalid node %q",enc) }
+		return [][]byte{n},nil
+	}
+	st,err := c.Stats()
+	if err!=nil { return nil,err }
+	var nodes [][]byte
+	for _,s := range st {
+		if s.Listable { nodes = append(nodes,s.Node) }
+	}
+	return nodes,nil
+}
+
+func expire(fs *flag.FlagSet, args []string) error {
+	srv    := serverFlag(fs)
+	before := fs.String("before","","expire this day and all days before it (required)")
+	dry    := fs.Bool("dry-run",false,"only count the blobs, that would be expired")
+	fs.Parse(args)
+	if *before=="" { fs.Usage(); return fmt.Errorf("-before is required") }
+	t,err := parseTime(*before)
+	if err!=nil { return err }
+	c := dial(*srv)
+	if !*dry { return c.Expire(t) }
+	
+	// Backends drop whole days, up to and including the day of t.
+	last := t.UTC().Truncate(24*time.Hour)
+	nodes,err := listNodes(c,"")
+	if err!=nil { return err }
+	total := 0
+	for _,n := range nodes {
+		entries,err := c.ListBlobs(n,time.Time{})
+		if err!=nil { return fmt.Errorf("node %s: %v",encodeNode(n),err) }
+		count := 0
+		for _,e := range entries {
+			if !e.Day.After(last) { count++ }
+		}
+		fmt.Printf("node %s: %d of %d blobs would expire\n",encodeNode(n),count,len(entries))
+		total += count
+	}
+	fmt.Printf("%d blobs up to %s would expire\n",total,last.Format("2006-01-02"))
+	return nil
+}
+
+func stats(fs *flag.FlagSet, args []string) error {
+	srv := serverFlag(fs)
+	fs.Parse(args)
+	st,err := dial(*srv).Stats()
+	if err!=nil { return err }
+	for _,s := range st {
+		extra := ""
+		if s.Listable { extra += " listable" }
+		if s.Used>=0 { extra += fmt.Sprintf(" used=%d",s.Used) }
+		if s.Mode==istorage.Draining { extra += fmt.Sprintf(" drained=%.1f%%",s.Drained*100) }
+		if c := s.Compress ; s.HasCompress {
+			extra += fmt.Sprintf(" compressed=%d raw(hint/estimate/failed)=%d/%d/%d saved=%d",c.Compressed,c.Hinted,c.Estimated,c.Failed,c.Saved)
+		}
+		fmt.Printf("%s mode=%s free=%d%s\n",encodeNode(s.Node),s.Mode,s.Free,extra)
+	}
+	return nil
+}
+
+func reload(fs *flag.FlagSet, args []string) error {
+	srv := serverFlag(fs)
+	fs.Parse(args)
+	return dial(*srv).Reload()
+}
+
+func mode(fs *flag.FlagSet, args []string) error {
+	srv  := serverFlag(fs)
+	node := fs.String("node","","storage node as printed by stats (required)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr,"usage: blobctl mode -node <node> read-write|read-only|draining|offline")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *node=="" || fs.NArg()!=1 { fs.Usage(); os.Exit(2) }
+	n,err := binascii.DecodeBase64Raw([]byte(*node),nil)
+	if err!=nil { return fmt.Errorf("invalid node %q",*node) }
+	m,err := istorage.ParseMode(fs.Arg(0))
+	if err!=nil { return err }
+	return dial(*srv).SetMode(n,m)
+}
+
+func purge(fs *flag.FlagSet, args []string) error {
+	srv  := serverFlag(fs)
+	node := fs.String("node","","storage node as printed by stats (required)")
+	day  := fs.String("day","","the day to purge, a past one (required)")
+	fs.Parse(args)
+	if *node=="" || *day=="" { fs.Usage(); return fmt.Errorf("-node and -day are required") }
+	n,err := binascii.DecodeBase64Raw([]byte(*node),nil)
+	if err!=nil { return fmt.Errorf("invalid node %q",*node) }
+	t,err := parseTime(*day)
+	if err!=nil { return err }
+	return dial(*srv).PurgeDay(n,t)
+}
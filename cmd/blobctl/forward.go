@@ -0,0 +1,95 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package main
+
+import "github.com/maxymania/blobserver/client"
+import "github.com/maxymania/blobserver/binascii"
+import "bufio"
+import "flag"
+import "fmt"
+import "os"
+import "strings"
+import "time"
+
+func init() {
+	commands["forward"]    = &command{"load a key mapping of migrate into the forwarding table of a server",forward}
+	commands["forward-gc"] = &command{"remove forwarding entries of expired days",forwardGC}
+}
+
+// Entries are sent in batches of this size.
+const forwardBatch = 4096
+
+func forward(fs *flag.FlagSet, args []string) error {
+	srv  := serverFlag(fs)
+	mapf := fs.String("map","","key mapping file, as written by migrate (default: stdin)")
+	fs.Parse(args)
+	in := os.Stdin
+	if *mapf!="" {
+		f,err := os.Open(*mapf)
+		if err!=nil { return err }
+		defer f.Close()
+		in = f
+	}
+	c := dial(*srv)
+	var batch []client.Forward
+	total := 0
+	flush := func() error {
+		if len(batch)==0 { return nil }
+		if err := c.AddForwards(batch) ; err!=nil { return err }
+		total += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	sc := bufio.NewScanner(in)
+	for lineno := 1 ; sc.Scan() ; lineno++ {
+		f := strings.Fields(sc.Text())
+		if len(f)==0 { continue }
+		if len(f)!=5 { return fmt.Errorf("line %d: expected 5 fields, got %d",lineno,len(f)) }
+		var keys [4][]byte
+		for i := range keys {
+			k,err := binascii.DecodeBase64Raw([]byte(f[i]),nil)
+			if err!=nil || len(k)==0 { return fmt.Errorf("line %d: invalid key %q",lineno,f[i]) }
+			keys[i] = k
+		}
+		day,err := time.Parse("2006-01-02",f[4])
+		if err!=nil { return fmt.Errorf("line %d: %v",lineno,err) }
+		batch = append(batch,client.Forward{keys[0],keys[1],keys[2],keys[3],day})
+		if len(batch)>=forwardBatch {
+			if err = flush() ; err!=nil { return err }
+		}
+	}
+	if err := sc.Err() ; err!=nil { return err }
+	if err := flush() ; err!=nil { return err }
+	fmt.Printf("%d entries added\n",total)
+	return nil
+}
+
+func forwardGC(fs *flag.FlagSet, args []string) error {
+	srv := serverFlag(fs)
+	fs.Parse(args)
+	n,err := dial(*srv).GCForwards()
+	if err!=nil { return err }
+	fmt.Printf("%d entries removed\n",n)
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package main
+
+import "github.com/maxymania/blobserver/storage"
+import "github.com/maxymania/blobserver/istorage"
+import "flag"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+
+func init() {
+	commands["fsck"] = &command{"check the structure of a storage directory",fsck}
+}
+
+// detectMethod guesses the backend of a storage directory from its files.
+func detectMethod(dir string) (string,error) {
+	if _,err := os.Stat(filepath.Join(dir,"clldb.dat")) ; err==nil { return "clldb",nil }
+	if _,err := os.Stat(filepath.Join(dir,"gobasedb.dat")) ; err==nil { return "basedb",nil }
+	fis,err := ioutil.ReadDir(dir)
+	if err!=nil { return "",err }
+	for _,fi := range fis {
+		if isDayfile(fi.Name()) { return "dayfile",nil }
+	}
+	return "",fmt.Errorf("can't tell the method of %s, use -method",dir)
+}
+
+func isDayfile(name string) bool {
+	if len(name)!=8 { return false }
+	for _,b := range []byte(name) {
+		if b<'0' || '9'<b { return false }
+	}
+	return true
+}
+
+func fsck(fs *flag.FlagSet, args []string) error {
+	method := fs.String("method","","backend of the storage (default: detect)")
+	repair := fs.Bool("repair",false,"repair the storage, where possible")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr,"usage: blobctl fsck [-method name] [-repair] <dir>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg()!=1 { fs.Usage(); os.Exit(2) }
+	dir := fs.Arg(0)
+	
+	if *method=="" {
+		m,err := detectMethod(dir)
+		if err!=nil { return err }
+		*method = m
+	}
+	check,ok := storage.Checkers[*method]
+	if !ok { return fmt.Errorf("method %q has no checker",*method) }
+	
+	logger := istorage.With(istorage.NewLogfmtLogger(os.Stderr),"backend",*method,"path",dir)
+	rep,err := check(dir,*repair,logger)
+	if rep!=nil {
+		for _,p := range rep.Problems { fmt.Println("problem:",p) }
+		for _,n := range rep.Notes    { fmt.Println("note:   ",n) }
+		fmt.Printf("%d blobs, %d bytes, %d sealed blobs, %d orphaned bytes, %d repaired bytes, %d problems\n",
+			rep.Blobs,rep.Bytes,rep.Sealed,rep.Orphaned,rep.Repaired,len(rep.Problems))
+	}
+	if err!=nil { return err }
+	if len(rep.Problems)>0 { return fmt.Errorf("%d problems found",len(rep.Problems)) }
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// Command blobctl is the administration tool for blob servers and storages.
+//
+//	blobctl <command> [flags] [args]
+//
+// Run "blobctl help" for the list of commands.
+package main
+
+import "github.com/maxymania/blobserver/storage"
+import "github.com/maxymania/blobserver/istorage"
+import _ "github.com/maxymania/blobserver/storage/filebased"
+import _ "github.com/maxymania/blobserver/storage/gobasedb"
+import _ "github.com/maxymania/blobserver/storage/czniclldb"
+import _ "github.com/maxymania/blobserver/storage/memory"
+import "flag"
+import "fmt"
+import "os"
+import "sort"
+
+type command struct{
+	usage string
+	run   func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]*command{}
+
+func usage() {
+	names := make([]string,0,len(commands))
+	for n := range commands { names = append(names,n) }
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr,"usage: blobctl <command> [flags] [args]\n\ncommands:")
+	for _,n := range names { fmt.Fprintf(os.Stderr,"  %-10s %s\n",n,commands[n].usage) }
+}
+
+// openStorage opens the storage at path with the given backend. capacity is
+// in GiB. codec applies to new blobs; if empty, the default is used. If
+// keyfile is not empty, new blobs are sealed and sealed blobs can be read.
+// With dayKeys, new storages seal each day with a key of its own.
+func openStorage(method, path string, capacity uint, codec, keyfile string, dayKeys bool, logger istorage.Logger) (string,istorage.Storage,error) {
+	return loadStorage(method,path,capacity,codec,keyfile,dayKeys,false,logger)
+}
+
+// openSource opens the storage at path read-only, see storage.StorageConfig.
+func openSource(method, path, keyfile string, logger istorage.Logger) (string,istorage.Storage,error) {
+	return loadStorage(method,path,0,"",keyfile,false,true,logger)
+}
+
+func loadStorage(method, path string, capacity uint, codec, keyfile string, dayKeys, ro bool, logger istorage.Logger) (string,istorage.Storage,error) {
+	loader,ok := storage.Backends[method]
+	if !ok { return "",nil,fmt.Errorf("No such method: %q",method) }
+	if _,ok := istorage.Codecs[codec] ; codec!="" && !ok { return "",nil,fmt.Errorf("No such codec: %q",codec) }
+	cfg := &storage.StorageConfig{Method:method,Capacity:&storage.Size{Bytes:int64(capacity)<<30},MaxOpenFiles:64,Codec:codec,ReadOnly:ro}
+	if keyfile!="" {
+		if spec := storage.Specs[method] ; spec==nil || !spec.Seal { return "",nil,fmt.Errorf("Method %q doesn't support encryption",method) }
+		keys,err := istorage.LoadKeyring(keyfile)
+		if err!=nil { return "",nil,err }
+		cfg.Keyfile,cfg.Keys = keyfile,keys
+		cfg.DayKeys = dayKeys
+	}
+	return loader(path,cfg,istorage.With(logger,"backend",method,"path",path))
+}
+
+func main() {
+	if len(os.Args)<2 { usage(); os.Exit(2) }
+	cmd,ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1]!="help" { fmt.Fprintf(os.Stderr,"unknown command %q\n\n",os.Args[1]) }
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("blobctl "+os.Args[1],flag.ExitOnError)
+	if err := cmd.run(fs,os.Args[2:]) ; err!=nil {
+		fmt.Fprintln(os.Stderr,"blobctl:",err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package main
+
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/maxymania/blobserver/binascii"
+import "github.com/valyala/bytebufferpool"
+import "bufio"
+import "bytes"
+import "context"
+import "flag"
+import "fmt"
+import "io"
+import "os"
+import "strings"
+import "time"
+
+func init() {
+	commands["migrate"] = &command{"copy all blobs from one storage into another",migrate}
+}
+
+// migrate copies every blob of the source storage into the destination,
+// filed under the same day. Each copy is read back and compared. The key
+// mapping is written as lines of "old-node old-key new-node new-key day",
+// the keys in unpadded URL-safe base64, the day as YYYY-MM-DD. The
+// forward command loads such a mapping into a server. With -codec, the
+// blobs are recompressed. With -dst-keyfile, they are sealed, which is how
+// plain storages get encrypted. The source is opened read-only; a source,
+// that a crash left with an unfinished reseal or journal, must be opened
+// writable once, such as by fsck -repair.
+func migrate(fs *flag.FlagSet, args []string) error {
+	srcm := fs.String("src-method","","backend of the source storage")
+	src  := fs.String("src","","source storage directory")
+	dstm := fs.String("dst-method","dayfile","backend of the destination storage")
+	dst  := fs.String("dst","","destination storage directory")
+	capa := fs.Uint("capacity",0,"capacity of the destination in GiB")
+	skeys := fs.String("src-keyfile","","keyfile of the source storage, if it is encrypted")
+	dkeys := fs.String("dst-keyfile","","keyfile to encrypt the destination with")
+	ddays := fs.Bool("dst-day-keys",false,"seal each day of the destination with a key of its own")
+	codec := fs.String("codec","","compression of the destination: "+strings.Join(istorage.CodecNames(),", ")+" (default: lz4)")
+	mapf := fs.String("map","","key mapping output file (default: stdout)")
+	fs.Parse(args)
+	if *srcm=="" || *src=="" || *dst=="" { fs.Usage(); return fmt.Errorf("-src-method, -src and -dst are required") }
+	
+	logger := istorage.NewLogfmtLogger(os.Stderr)
+	snode,srcSt,err := openSource(*srcm,*src,*skeys,logger)
+	if err!=nil { return err }
+	if c,ok := srcSt.(io.Closer) ; ok { defer c.Close() }
+	walker,ok := srcSt.(istorage.Walker)
+	if !ok { return fmt.Errorf("method %q does not support enumerating blobs",*srcm) }
+	dnode,dstSt,err := openStorage(*dstm,*dst,*capa,*codec,*dkeys,*ddays,logger)
+	if err!=nil { return err }
+	if c,ok := dstSt.(io.Closer) ; ok { defer c.Close() }
+	
+	out := os.Stdout
+	if *mapf!="" {
+		out,err = os.Create(*mapf)
+		if err!=nil { return err }
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	
+	sn := binascii.EncodeBase64Raw([]byte(snode),nil)
+	dn := binascii.EncodeBase64Raw([]byte(dnode),nil)
+	ctx := context.Background()
+	lbuf,vbuf := bytebufferpool.Get(),bytebufferpool.Get()
+	defer bytebufferpool.Put(lbuf)
+	defer bytebufferpool.Put(vbuf)
+	var blobbuf,vblobbuf,line []byte
+	copied,bytesc := 0,int64(0)
+	err = walker.WalkBlobs(ctx,func(key []byte, day time.Time) error {
+		lbuf.Reset()
+		meta,ok := srcSt.LoadBlob(ctx,key,lbuf)
+		if !ok { return fmt.Errorf("load %x from %s failed",key,day.Format("2006-01-02")) }
+		blob,err := istorage.Unpack(meta,lbuf.B,blobbuf)
+		if err!=nil { return fmt.Errorf("blob %x: %v",key,err) }
+		if meta.Size>0 { blobbuf = blob }
+		
+		nkey,ok := dstSt.StoreBlob(ctx,blob,day)
+		if !ok { return fmt.Errorf("store into %s failed",*dst) }
+		vbuf.Reset()
+		vmeta,ok := dstSt.LoadBlob(ctx,nkey,vbuf)
+		if !ok { return fmt.Errorf("verify %x: reload failed",nkey) }
+		vblob,err := istorage.Unpack(vmeta,vbuf.B,vblobbuf)
+		if err!=nil { return fmt.Errorf("verify %x: %v",nkey,err) }
+		if vmeta.Size>0 { vblobbuf = vblob }
+		if !bytes.Equal(blob,vblob) { return fmt.Errorf("verify %x: copy differs",nkey) }
+		
+		line = append(line[:0],sn...)
+		line = append(line,' ')
+		line = binascii.EncodeBase64Raw(key,line)
+		line = append(line,' ')
+		line = append(line,dn...)
+		line = append(line,' ')
+		line = binascii.EncodeBase64Raw(nkey,line)
+		line = append(line,' ')
+		line = day.UTC().AppendFormat(line,"2006-01-02")
+		line = append(line,'\n')
+		if _,err = w.Write(line) ; err!=nil { return err }
+		copied++
+		bytesc += int64(len(blob))
+		return nil
+	})
+	if ferr := w.Flush() ; err==nil { err = ferr }
+	logger.Log("event","migrate","blobs",copied,"bytes",bytesc,"err",err)
+	return err
+}
@@ -0,0 +1,67 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package main
+
+import "github.com/maxymania/blobserver/istorage"
+import "context"
+import "flag"
+import "fmt"
+import "io"
+import "os"
+
+func init() {
+	commands["reencrypt"] = &command{"reseal the records of a storage with its current key",reencrypt}
+}
+
+// reencrypt reseals every record of a storage, that was sealed with an older
+// key than the last one in the keyfile. Records keep their keys. Plain records
+// are left alone; migrate them with -dst-keyfile to encrypt them. Day keys
+// are resealed, when their store is opened. The storage must not be in use by
+// a server.
+func reencrypt(fs *flag.FlagSet, args []string) error {
+	method  := fs.String("method","","backend of the storage (default: detect)")
+	keyfile := fs.String("keyfile","","keyfile of the storage")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr,"usage: blobctl reencrypt [-method name] -keyfile file <dir>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg()!=1 || *keyfile=="" { fs.Usage(); os.Exit(2) }
+	dir := fs.Arg(0)
+	
+	if *method=="" {
+		m,err := detectMethod(dir)
+		if err!=nil { return err }
+		*method = m
+	}
+	_,st,err := openStorage(*method,dir,0,"",*keyfile,false,istorage.NewLogfmtLogger(os.Stderr))
+	if err!=nil { return err }
+	if c,ok := st.(io.Closer) ; ok { defer c.Close() }
+	rs,ok := st.(istorage.Resealer)
+	if !ok { return fmt.Errorf("method %q can't reseal records in place",*method) }
+	n,err := rs.Reseal(context.Background())
+	fmt.Printf("%d records resealed\n",n)
+	return err
+}
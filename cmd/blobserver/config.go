@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package main
+
+import "github.com/maxymania/blobserver/server"
+import "github.com/maxymania/blobserver/storage"
+import "github.com/lytics/confl"
+import "io/ioutil"
+import "fmt"
+import "path/filepath"
+import "time"
+
+/*
+Example configuration:
+
+	listen    = ":7070"
+	storage   = "/srv/blobs"     # directory, that contains storage.conf
+	roots     = ["/mnt/disk[0-9]/blobs"] # more such directories, may be globs
+	placement = "most_free"      # or "weighted_free"
+	limits {
+		max_conns        = 1024
+		idle_timeout     = 300   # seconds
+		shutdown_timeout = 30    # seconds
+		drain_timeout    = 60    # seconds, before a removed storage is closed
+	}
+	forward_file = "forward.log" # locations of moved blobs
+	redirect     = false         # answer GETs of moved blobs with 307, instead of serving them
+	rebalance {
+		interval  = 600      # seconds between rounds, 0 disables the rebalancer
+		threshold = 10       # percent of fill level difference to tolerate
+		rate      = "32MiB"  # copied bytes per second, unlimited if omitted
+		grace     = 5        # seconds, to wait after making a storage read-only
+	}
+
+Relative paths are resolved against the directory of the configuration file.
+Without storage and roots, the storage.conf next to the configuration file is used.
+The rebalancer needs a forward_file.
+*/
+type Config struct{
+	Listen    string   `confl:"listen"`
+	Storage   string   `confl:"storage"`
+	Roots     []string `confl:"roots"`
+	Placement string   `confl:"placement"`
+	Limits    Limits   `confl:"limits"`
+	Forward   string   `confl:"forward_file"`
+	Redirect  bool     `confl:"redirect"`
+	Rebalance Rebalance `confl:"rebalance"`
+}
+
+type Rebalance struct{
+	Interval  int     `confl:"interval"`
+	Threshold float64 `confl:"threshold"`
+	RawRate   string  `confl:"rate"`
+	Grace     int     `confl:"grace"`
+	
+	Rate      int64   `confl:"-"`
+}
+
+type Limits struct{
+	MaxConns        int `confl:"max_conns"`
+	IdleTimeout     int `confl:"idle_timeout"`
+	ShutdownTimeout int `confl:"shutdown_timeout"`
+	DrainTimeout    int `confl:"drain_timeout"`
+}
+
+func (l *Limits) idle() time.Duration { return time.Duration(l.IdleTimeout)*time.Second }
+func (l *Limits) shutdown() time.Duration { return time.Duration(l.ShutdownTimeout)*time.Second }
+func (l *Limits) drain() time.Duration { return time.Duration(l.DrainTimeout)*time.Second }
+
+func (c *Config) sameRoots(o *Config) bool {
+	if len(c.Roots)!=len(o.Roots) { return false }
+	for i := range c.Roots {
+		if c.Roots[i]!=o.Roots[i] { return false }
+	}
+	return true
+}
+
+func loadConfig(file string) (*Config,error) {
+	data,err := ioutil.ReadFile(file)
+	if err!=nil { return nil,err }
+	cfg := &Config{
+		Listen   : ":7070",
+		Placement: "most_free",
+		Limits   : Limits{MaxConns:1024,IdleTimeout:300,ShutdownTimeout:30,DrainTimeout:60},
+	}
+	if err = confl.Unmarshal(data,cfg) ; err!=nil { return nil,fmt.Errorf("%s: %v",file,err) }
+	if cfg.Storage=="" && len(cfg.Roots)==0 { cfg.Storage = "." }
+	if cfg.Storage!="" { cfg.Roots = append([]string{cfg.Storage},cfg.Roots...) }
+	for i,r := range cfg.Roots {
+		if !filepath.IsAbs(r) { cfg.Roots[i] = filepath.Join(filepath.Dir(file),r) }
+	}
+	if _,ok := server.Placements[cfg.Placement] ; !ok { return nil,fmt.Errorf("%s: placement: unknown value %q",file,cfg.Placement) }
+	if cfg.Limits.MaxConns<=0 { return nil,fmt.Errorf("%s: limits.max_conns: must be positive",file) }
+	if cfg.Forward!="" && !filepath.IsAbs(cfg.Forward) { cfg.Forward = filepath.Join(filepath.Dir(file),cfg.Forward) }
+	rb := &cfg.Rebalance
+	if rb.Interval>0 && cfg.Forward=="" { return nil,fmt.Errorf("%s: rebalance: needs forward_file",file) }
+	if rb.Threshold<0 || rb.Threshold>=100 { return nil,fmt.Errorf("%s: rebalance.threshold: must be between 0 and 100",file) }
+	if rb.RawRate!="" {
+		sz,err := storage.ParseSize(rb.RawRate)
+		if err!=nil { return nil,fmt.Errorf("%s: rebalance.rate: %v",file,err) }
+		rb.Rate = sz.Bytes
+	}
+	return cfg,nil
+}
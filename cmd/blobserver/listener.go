@@ -0,0 +1,120 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package main
+
+import "github.com/byte-mug/gocom/notrest"
+import "github.com/byte-mug/gocom/notrest/route"
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/maxymania/blobserver/server"
+import "net"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// listener accepts connections and serves them with the router, within the
+// current limits.
+type listener struct{
+	ln     net.Listener
+	router *route.Router
+	log    istorage.Logger
+	limits atomic.Value // Limits
+	active int64
+	
+	mutex  sync.Mutex
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+func newListener(ln net.Listener, router *route.Router, limits Limits, logger istorage.Logger) *listener {
+	l := &listener{ln:ln,router:router,log:logger,conns:make(map[net.Conn]struct{})}
+	l.limits.Store(limits)
+	return l
+}
+func (l *listener) setLimits(limits Limits) { l.limits.Store(limits) }
+func (l *listener) getLimits() Limits { return l.limits.Load().(Limits) }
+
+// deadlineConn pushes the deadline forward on every read.
+type deadlineConn struct{
+	net.Conn
+	idle time.Duration
+}
+func (d deadlineConn) Read(b []byte) (int,error) {
+	if d.idle>0 { d.Conn.SetReadDeadline(time.Now().Add(d.idle)) }
+	return d.Conn.Read(b)
+}
+
+func (l *listener) serve() error {
+	for {
+		c,err := l.ln.Accept()
+		if err!=nil { return err }
+		lim := l.getLimits()
+		if atomic.AddInt64(&l.active,1)>int64(lim.MaxConns) {
+			atomic.AddInt64(&l.active,-1)
+			l.log.Log("event","conn_rejected","remote",c.RemoteAddr().String(),"max_conns",lim.MaxConns)
+			c.Close()
+			continue
+		}
+		l.mutex.Lock()
+		l.conns[c] = struct{}{}
+		l.mutex.Unlock()
+		l.wg.Add(1)
+		go l.handle(c,lim)
+	}
+}
+func (l *listener) handle(c net.Conn, lim Limits) {
+	defer l.wg.Done()
+	defer atomic.AddInt64(&l.active,-1)
+	defer func() {
+		l.mutex.Lock()
+		delete(l.conns,c)
+		l.mutex.Unlock()
+		c.Close()
+	}()
+	wc,h := server.WatchConn(c,l.router)
+	notrest.ServeConn(deadlineConn{wc,lim.idle()},h)
+}
+
+// shutdown stops accepting, lets the open connections finish their requests
+// and closes the rest after timeout.
+func (l *listener) shutdown(timeout time.Duration) {
+	l.ln.Close()
+	done := make(chan struct{})
+	go func() { l.wg.Wait(); close(done) }()
+	
+	// Idle connections are waiting for the next request; wake them up.
+	l.mutex.Lock()
+	for c := range l.conns { c.SetReadDeadline(time.Now().Add(time.Second)) }
+	l.mutex.Unlock()
+	
+	select {
+	case <-done: return
+	case <-time.After(timeout):
+	}
+	l.mutex.Lock()
+	n := len(l.conns)
+	for c := range l.conns { c.Close() }
+	l.mutex.Unlock()
+	l.log.Log("event","shutdown_forced","conns",n)
+	<-done
+}
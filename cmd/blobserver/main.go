@@ -0,0 +1,147 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+// Command blobserver runs a blob server.
+//
+//	blobserver [-config file]
+//
+// SIGINT and SIGTERM shut the server down gracefully: pending requests and
+// expiries are finished, then the storages are closed. SIGHUP, as well as
+// "RELOAD /admin/reload", reloads the configuration file and the storage
+// configurations: new storages are opened, removed ones drained and closed.
+// Changes of the listen address, the placement, forward_file, redirect or
+// rebalance need a restart.
+package main
+
+import "github.com/maxymania/blobserver/server"
+import "github.com/maxymania/blobserver/istorage"
+import _ "github.com/maxymania/blobserver/storage/filebased"
+import _ "github.com/maxymania/blobserver/storage/gobasedb"
+import _ "github.com/maxymania/blobserver/storage/czniclldb"
+import _ "github.com/maxymania/blobserver/storage/memory"
+import "github.com/byte-mug/gocom/notrest/route"
+import "context"
+import "flag"
+import "net"
+import "os"
+import "os/signal"
+import "strings"
+import "sync"
+import "syscall"
+import "time"
+
+func main() {
+	file := flag.String("config","blobserver.conf","server configuration file")
+	flag.Parse()
+	logger := istorage.NewLogfmtLogger(os.Stderr)
+	
+	cfg,err := loadConfig(*file)
+	if err!=nil {
+		logger.Log("event","config_error","file",*file,"err",err)
+		os.Exit(1)
+	}
+	logger.Log("event","starting","config",*file,"listen",cfg.Listen,"roots",strings.Join(cfg.Roots,","),"placement",cfg.Placement)
+	
+	stors := newStorages(logger)
+	if err = stors.load(cfg.Roots,cfg.Limits.drain()) ; err!=nil { os.Exit(1) }
+	if len(stors.m.All())==0 { logger.Log("event","warning","msg","no storage configured, all uploads will fail") }
+	
+	srv := &server.Server{StorMap:stors.m,Placement:server.Placements[cfg.Placement],Redirect:cfg.Redirect}
+	if cfg.Forward!="" {
+		if srv.Forward,err = server.OpenForwardTable(cfg.Forward) ; err!=nil {
+			logger.Log("event","forward_failed","file",cfg.Forward,"err",err)
+			os.Exit(1)
+		}
+		logger.Log("event","forward_loaded","file",cfg.Forward,"entries",srv.Forward.Len())
+	}
+	ctx,cancel := context.WithCancel(context.Background())
+	rdone := make(chan struct{}) // Closed, once the rebalancer stopped.
+	if rb := cfg.Rebalance ; rb.Interval>0 {
+		r := &server.Rebalancer{
+			Server   : srv,
+			Threshold: rb.Threshold/100,
+			Rate     : rb.Rate,
+			Grace    : time.Duration(rb.Grace)*time.Second,
+			Log      : istorage.With(logger,"component","rebalancer"),
+		}
+		go func() {
+			r.Run(ctx,time.Duration(rb.Interval)*time.Second)
+			close(rdone)
+		}()
+	} else {
+		close(rdone)
+	}
+	router := new(route.Router)
+	srv.WireUp(router)
+	
+	ln,err := net.Listen("tcp",cfg.Listen)
+	if err!=nil {
+		logger.Log("event","listen_failed","listen",cfg.Listen,"err",err)
+		os.Exit(1)
+	}
+	l := newListener(ln,router,cfg.Limits,logger)
+	
+	var mutex sync.Mutex
+	reload := func() error {
+		mutex.Lock(); defer mutex.Unlock()
+		ncfg,err := loadConfig(*file)
+		if err!=nil {
+			logger.Log("event","reload_failed","file",*file,"err",err)
+			return err
+		}
+		if ncfg.Listen!=cfg.Listen || ncfg.Placement!=cfg.Placement {
+			logger.Log("event","warning","msg","listen and placement changes need a restart")
+		}
+		l.setLimits(ncfg.Limits)
+		cfg.Limits,cfg.Roots = ncfg.Limits,ncfg.Roots
+		err = stors.load(ncfg.Roots,ncfg.Limits.drain())
+		if err!=nil { logger.Log("event","reload_failed","file",*file,"err",err) }
+		logger.Log("event","reloaded","file",*file,"storages",len(stors.m.All()),"max_conns",ncfg.Limits.MaxConns)
+		return err
+	}
+	srv.Reload = func(ctx context.Context) error { return reload() }
+	
+	// Serve only now, so that the first admin request sees srv.Reload.
+	go func() {
+		if err := l.serve() ; err!=nil { logger.Log("event","accept_stopped","err",err) }
+	}()
+	logger.Log("event","listening","addr",ln.Addr().String(),"storages",len(stors.m.All()))
+	
+	sig := make(chan os.Signal,1)
+	signal.Notify(sig,syscall.SIGINT,syscall.SIGTERM,syscall.SIGHUP)
+	for s := range sig {
+		if s!=syscall.SIGHUP { break }
+		reload()
+	}
+	mutex.Lock()
+	logger.Log("event","shutdown","timeout",cfg.Limits.ShutdownTimeout)
+	cancel()
+	l.shutdown(cfg.Limits.shutdown())
+	<-rdone
+	srv.Wait()
+	stors.closeAll()
+	if srv.Forward!=nil {
+		if err = srv.Forward.Close() ; err!=nil { logger.Log("event","forward_failed","file",cfg.Forward,"err",err) }
+	}
+	logger.Log("event","stopped")
+}
@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package main
+
+import "github.com/maxymania/blobserver/server"
+import "github.com/maxymania/blobserver/storage"
+import "github.com/maxymania/blobserver/istorage"
+import "encoding/hex"
+import "fmt"
+import "io"
+import "sync"
+import "time"
+
+type opened struct{
+	key    string
+	path   string
+	stor   istorage.Storage
+	cfg    *storage.StorageConfig
+	cancel chan struct{} // Closed to abort draining.
+}
+
+// storages tracks the open storages by path, so that a reload only opens
+// the new ones and drains the removed ones.
+type storages struct{
+	mutex    sync.Mutex
+	m        *server.StorMap
+	byPath   map[string]*opened
+	draining map[string]*opened
+	log      istorage.Logger
+}
+
+func newStorages(logger istorage.Logger) *storages {
+	return &storages{
+		m       : server.NewStorMap(nil),
+		byPath  : make(map[string]*opened),
+		draining: make(map[string]*opened),
+		log     : logger,
+	}
+}
+
+func (s *storages) inUse(key string) (string,bool) {
+	for _,o := range s.byPath   { if o.key==key { return o.path,true } }
+	for _,o := range s.draining { if o.key==key { return o.path,true } }
+	return "",false
+}
+
+/*
+load brings the open storages in line with the configurations of roots.
+
+New storages are opened first and then added at once. Removed storages
+become read-only and are closed after drain. Capacity changes are applied
+to running storages, if they support it. A failing storage does not keep
+the others from loading; the first error is returned.
+*/
+func (s *storages) load(roots []string, drain time.Duration) (err error) {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	entries,err := storage.ReadConfigs(s.log,roots...)
+	if err!=nil { return err }
+	
+	seen  := make(map[string]bool)
+	var added []*opened
+	for _,e := range entries {
+		seen[e.Path] = true
+		if o,ok := s.draining[e.Path] ; ok { // Back in the configuration.
+			close(o.cancel)
+			delete(s.draining,e.Path)
+			s.byPath[e.Path] = o
+			s.m.SetMode(o.key,configMode(o.cfg))
+			s.log.Log("event","drain_aborted","path",e.Path)
+		}
+		if o,ok := s.byPath[e.Path] ; ok {
+			s.update(o,e.Config)
+			continue
+		}
+		key,st,e2 := storage.OpenEntry(e,s.log)
+		if e2!=nil {
+			if err==nil { err = e2 }
+			continue
+		}
+		if prev,dup := s.inUse(key) ; dup {
+			if c,ok := st.(io.Closer) ; ok { c.Close() }
+			s.log.Log("event","duplicate_uuid","node",hex.EncodeToString([]byte(key)),"path",e.Path,"first",prev)
+			if err==nil { err = fmt.Errorf("storage %s has the same UUID as %s",e.Path,prev) }
+			continue
+		}
+		o := &opened{key:key,path:e.Path,stor:st,cfg:e.Config}
+		s.byPath[e.Path] = o
+		added = append(added,o)
+	}
+	s.m.Update(func(all map[string]istorage.Storage, modes map[string]istorage.Mode) {
+		for _,o := range added {
+			all[o.key] = o.stor
+			modes[o.key] = configMode(o.cfg)
+		}
+	})
+	for path,o := range s.byPath {
+		if seen[path] { continue }
+		delete(s.byPath,path)
+		o.cancel = make(chan struct{})
+		s.draining[path] = o
+		s.m.SetMode(o.key,istorage.ReadOnly)
+		s.log.Log("event","drain","path",path,"node",hex.EncodeToString([]byte(o.key)),"timeout",drain.Seconds())
+		go s.close(o,drain)
+	}
+	return
+}
+
+// configMode returns the mode of cfg. It has been validated by ReadConfigs.
+func configMode(cfg *storage.StorageConfig) istorage.Mode {
+	m,_ := istorage.ParseMode(cfg.Mode)
+	return m
+}
+
+// update applies the changes of a running storage's configuration.
+func (s *storages) update(o *opened, cfg *storage.StorageConfig) {
+	l := istorage.With(s.log,"path",o.path)
+	if cfg.Method!=o.cfg.Method {
+		l.Log("event","warning","msg","method changes need a restart","method",o.cfg.Method,"new_method",cfg.Method)
+		return
+	}
+	if cfg.Mode!=o.cfg.Mode {
+		s.m.SetMode(o.key,configMode(cfg))
+		l.Log("event","mode_changed","mode",configMode(cfg).String())
+	}
+	oc,nc := o.cfg.Capacity.Int64(),cfg.Capacity.Int64()
+	if oc!=nc {
+		if r,ok := o.stor.(istorage.Resizer) ; ok {
+			r.SetCapacity(nc)
+			l.Log("event","capacity_changed","capacity",nc,"old",oc)
+		} else {
+			l.Log("event","warning","msg","capacity change needs a restart","method",cfg.Method)
+			cfg.Capacity = o.cfg.Capacity
+		}
+	}
+	o.cfg = cfg
+}
+
+// close removes o after drain, unless draining is aborted.
+func (s *storages) close(o *opened, drain time.Duration) {
+	t := time.NewTimer(drain)
+	defer t.Stop()
+	select {
+	case <-o.cancel: return
+	case <-t.C:
+	}
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	select {
+	case <-o.cancel: return // Raced with a reload.
+	default:
+	}
+	delete(s.draining,o.path)
+	s.m.Remove(o.key)
+	var err error
+	if c,ok := o.stor.(io.Closer) ; ok { err = c.Close() }
+	s.log.Log("event","closed","path",o.path,"node",hex.EncodeToString([]byte(o.key)),"err",err)
+}
+
+// closeAll closes every storage, the draining ones included. It is called on
+// shutdown, once no request is served anymore.
+func (s *storages) closeAll() {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	for path,o := range s.draining {
+		close(o.cancel)
+		delete(s.draining,path)
+	}
+	for key,st := range s.m.All() {
+		c,ok := st.(io.Closer)
+		if !ok { continue }
+		err := c.Close()
+		s.log.Log("event","closed","node",hex.EncodeToString([]byte(key)),"err",err)
+	}
+	s.byPath = make(map[string]*opened)
+	s.m.Update(func(all map[string]istorage.Storage, modes map[string]istorage.Mode) {
+		for k := range all { delete(all,k) }
+	})
+}
@@ -0,0 +1,215 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package istorage
+
+import "github.com/pierrec/lz4"
+import "github.com/golang/snappy"
+import "bytes"
+import "compress/flate"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "sort"
+
+var ErrUnknownCodec = errors.New("unknown codec")
+var errCodecSize    = errors.New("decompressed size mismatch")
+
+// Codec IDs are stored in records and sent over the wire; never renumber them.
+const (
+	CodecNone    = 0
+	CodecLZ4     = 1
+	CodecSnappy  = 2
+	CodecDeflate = 3
+)
+
+// A Codec compresses blobs. It is selected per storage by StorageConfig.Codec.
+type Codec struct{
+	ID   uint8
+	Name string
+	
+	// Compress appends the compressed blob to dst. It returns false, if the
+	// blob can't be compressed or doesn't shrink.
+	Compress   func(dst, blob []byte) ([]byte,bool)
+	
+	// Decompress decodes payload into dst, whose length is the uncompressed size.
+	Decompress func(dst, payload []byte) error
+}
+
+var codecIDs [256]*Codec
+
+// Codecs holds the registered codecs by name.
+var Codecs = make(map[string]*Codec)
+
+// RegisterCodec adds c to Codecs. It panics, if the ID or name is taken.
+func RegisterCodec(c *Codec) {
+	if codecIDs[c.ID]!=nil || Codecs[c.Name]!=nil { panic(fmt.Sprintf("codec %d/%q registered twice",c.ID,c.Name)) }
+	codecIDs[c.ID] = c
+	Codecs[c.Name] = c
+}
+
+// CodecByID returns the codec with the given ID, or nil.
+func CodecByID(id uint8) *Codec { return codecIDs[id] }
+
+// CodecNames returns the names of all registered codecs, sorted.
+func CodecNames() []string {
+	n := make([]string,0,len(Codecs))
+	for k := range Codecs { n = append(n,k) }
+	sort.Strings(n)
+	return n
+}
+
+// DefaultCodec is used by storages, that don't configure one.
+var DefaultCodec *Codec
+
+func grow(dst []byte, n int) []byte {
+	if cap(dst)-len(dst)<n {
+		nb := make([]byte,len(dst),len(dst)+n)
+		copy(nb,dst)
+		dst = nb
+	}
+	return dst
+}
+
+func init() {
+	RegisterCodec(&Codec{ID:CodecNone,Name:"none",
+		Compress  : func(dst, blob []byte) ([]byte,bool) { return dst,false },
+		Decompress: func(dst, payload []byte) error { return ErrUnknownCodec },
+	})
+	DefaultCodec = &Codec{ID:CodecLZ4,Name:"lz4",
+		Compress  : func(dst, blob []byte) ([]byte,bool) {
+			dst = grow(dst,lz4.CompressBlockBound(len(blob)))
+			j,e := lz4.CompressBlock(blob,dst[len(dst):cap(dst)],0)
+			if e!=nil || j==0 || j>=len(blob) { return dst,false }
+			return dst[:len(dst)+j],true
+		},
+		Decompress: func(dst, payload []byte) error {
+			n,err := lz4.UncompressBlock(payload,dst,0)
+			if err==nil && n!=len(dst) { err = errCodecSize }
+			return err
+		},
+	}
+	RegisterCodec(DefaultCodec)
+	RegisterCodec(&Codec{ID:CodecSnappy,Name:"snappy",
+		Compress  : func(dst, blob []byte) ([]byte,bool) {
+			dst = grow(dst,snappy.MaxEncodedLen(len(blob)))
+			enc := snappy.Encode(dst[len(dst):cap(dst)],blob)
+			if len(enc)>=len(blob) { return dst,false }
+			return dst[:len(dst)+len(enc)],true
+		},
+		Decompress: func(dst, payload []byte) error {
+			if n,err := snappy.DecodedLen(payload) ; err!=nil || n!=len(dst) {
+				if err==nil { err = errCodecSize }
+				return err
+			}
+			_,err := snappy.Decode(dst,payload)
+			return err
+		},
+	})
+	// Deflate is slow, but compresses best. It suits cold archives.
+	RegisterCodec(&Codec{ID:CodecDeflate,Name:"deflate",
+		Compress  : func(dst, blob []byte) ([]byte,bool) {
+			b := bytes.NewBuffer(dst)
+			w,_ := flate.NewWriter(b,flate.BestCompression)
+			if _,err := w.Write(blob) ; err!=nil { return dst,false }
+			if err := w.Close() ; err!=nil { return dst,false }
+			out := b.Bytes()
+			if len(out)-len(dst)>=len(blob) { return dst,false }
+			return out,true
+		},
+		Decompress: func(dst, payload []byte) error {
+			r := flate.NewReader(bytes.NewReader(payload))
+			defer r.Close()
+			if _,err := io.ReadFull(r,dst) ; err!=nil { return err }
+			var one [1]byte
+			if n,_ := r.Read(one[:]) ; n!=0 { return errCodecSize }
+			return nil
+		},
+	})
+}
+
+// CodecFlag is set in the 32-bit size field of a stored record, if a codec
+// byte follows the checksum. Records written before codecs existed lack it;
+// their payload is LZ4 compressed, if their size is not 0.
+const CodecFlag = 1<<30
+
+// HeadLen is the length of a record head written by PutHead.
+const HeadLen = 9
+
+// Compress appends blob, compressed by c, to dst. If the blob doesn't shrink,
+// it is appended raw. Blobs too large for the size field are always stored raw.
+func Compress(dst []byte, c *Codec, blob []byte) ([]byte,Meta) {
+	meta := Meta{Sum:Checksum(blob),HasSum:true}
+	if c!=nil && c.ID!=CodecNone && len(blob)<CodecFlag {
+		if out,ok := c.Compress(dst,blob) ; ok {
+			meta.Codec,meta.Size = c.ID,len(blob)
+			return out,meta
+		}
+	}
+	return append(dst,blob...),meta
+}
+
+// SizeField returns the 32-bit size field of a record of m.
+func (m Meta) SizeField() uint32 {
+	f := uint32(m.Size)|CodecFlag
+	if m.HasSum { f |= SumFlag }
+	return f
+}
+
+// ParseSizeField decodes a size field. If codec is true, the caller must read
+// the codec byte into meta.Codec.
+func ParseSizeField(f uint32) (meta Meta,codec bool) {
+	meta.Size = int(f &^ (SumFlag|CodecFlag))
+	meta.HasSum = (f&SumFlag)!=0
+	codec = (f&CodecFlag)!=0
+	if !codec && meta.Size>0 { meta.Codec = CodecLZ4 }
+	return
+}
+
+// PutHead writes the head of a record, [4] size field, [4] CRC-32C, [1] codec,
+// into the first HeadLen bytes of b.
+func PutHead(b []byte, m Meta) {
+	binary.BigEndian.PutUint32(b[:4],m.SizeField())
+	binary.BigEndian.PutUint32(b[4:8],m.Sum)
+	b[8] = m.Codec
+}
+
+// ParseHead splits a record into meta and payload. It accepts records written
+// before checksums and codecs existed.
+func ParseHead(rec []byte) (meta Meta,payload []byte,ok bool) {
+	if len(rec)<4 { return }
+	meta,codec := ParseSizeField(binary.BigEndian.Uint32(rec))
+	rec = rec[4:]
+	if meta.HasSum {
+		if len(rec)<4 { return }
+		meta.Sum = binary.BigEndian.Uint32(rec)
+		rec = rec[4:]
+	}
+	if codec {
+		if len(rec)<1 { return }
+		meta.Codec = rec[0]
+		rec = rec[1:]
+	}
+	return meta,rec,true
+}
@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package istorage
+
+import "bytes"
+import "context"
+import "math"
+import "sync/atomic"
+
+type noCompressKey struct{}
+
+// WithNoCompress returns a copy of ctx, that tells StoreBlob not to compress
+// the blob, such as when the client knows it to be compressed already.
+func WithNoCompress(ctx context.Context) context.Context {
+	return context.WithValue(ctx,noCompressKey{},true)
+}
+
+// NoCompress reports, whether ctx carries the hint of WithNoCompress.
+func NoCompress(ctx context.Context) bool {
+	b,_ := ctx.Value(noCompressKey{}).(bool)
+	return b
+}
+
+// Formats, that are compressed already.
+var magics = []struct{ off int ; magic string }{
+	{0,"\xff\xd8\xff"},              // JPEG
+	{0,"\x89PNG\r\n\x1a\n"},         // PNG
+	{0,"GIF8"},                      // GIF
+	{0,"PK\x03\x04"},                // ZIP, JAR, OOXML, ODF, EPUB
+	{0,"\x1f\x8b"},                  // gzip
+	{0,"BZh"},                       // bzip2
+	{0,"\xfd7zXZ\x00"},              // xz
+	{0,"\x28\xb5\x2f\xfd"},          // zstd
+	{0,"\x04\x22\x4d\x18"},          // LZ4 frame
+	{0,"7z\xbc\xaf\x27\x1c"},        // 7-Zip
+	{0,"Rar!\x1a\x07"},              // RAR
+	{0,"OggS"},                      // Ogg
+	{0,"fLaC"},                      // FLAC
+	{0,"ID3"},                       // MP3
+	{0,"\x1a\x45\xdf\xa3"},          // Matroska, WebM
+	{4,"ftyp"},                      // MP4, MOV, HEIF, AVIF
+	{8,"WEBP"},                      // WebP
+}
+
+const (
+	// Blobs shorter than this are compressed without estimate.
+	estimateMin   = 512
+	// The estimate samples this many windows of estimateWindow bytes.
+	estimateWins  = 16
+	estimateWindow= 256
+	// Samples with more bits of entropy per byte are deemed incompressible.
+	maxEntropy    = 7.5
+)
+
+// Compressible estimates, whether compressing blob is worth a try. It looks
+// for the signatures of compressed formats and computes the byte entropy of
+// a sample.
+func Compressible(blob []byte) bool {
+	if len(blob)<estimateMin { return true }
+	for _,m := range magics {
+		if len(blob)>=m.off+len(m.magic) && bytes.Equal(blob[m.off:m.off+len(m.magic)],[]byte(m.magic)) { return false }
+	}
+	var hist [256]int
+	n := 0
+	if len(blob)<=estimateWins*estimateWindow {
+		for _,b := range blob { hist[b]++ }
+		n = len(blob)
+	} else {
+		step := (len(blob)-estimateWindow)/(estimateWins-1)
+		for i := 0 ; i<estimateWins ; i++ {
+			for _,b := range blob[i*step:i*step+estimateWindow] { hist[b]++ }
+		}
+		n = estimateWins*estimateWindow
+	}
+	// H = log2(n) - sum(c*log2(c))/n
+	s := 0.0
+	for _,c := range hist {
+		if c>1 { s += float64(c)*math.Log2(float64(c)) }
+	}
+	return math.Log2(float64(n))-s/float64(n) <= maxEntropy
+}
+
+// CompressCounts tells, how a storage decided on compression.
+type CompressCounts struct{
+	Compressed int64 // Blobs stored compressed.
+	Hinted     int64 // Blobs stored raw, due to the no-compress hint.
+	Estimated  int64 // Blobs stored raw, since Compressible said so.
+	Failed     int64 // Blobs stored raw, since they didn't shrink.
+	Saved      int64 // Bytes saved by compression.
+}
+
+// CompressReporter is implemented by storages, that count their compression
+// decisions.
+type CompressReporter interface{
+	CompressStats() CompressCounts
+}
+
+// A Compressor compresses blobs with Codec, skipping blobs that won't shrink,
+// and counts its decisions. It is safe for concurrent use.
+type Compressor struct{
+	Codec  *Codec
+	counts CompressCounts
+}
+
+func NewCompressor(c *Codec) *Compressor { return &Compressor{Codec:c} }
+
+// Compress is like the package level Compress, but honors WithNoCompress and
+// skips blobs, that are not Compressible.
+func (p *Compressor) Compress(ctx context.Context, dst, blob []byte) ([]byte,Meta) {
+	c := p.Codec
+	if c==nil || c.ID==CodecNone { return Compress(dst,nil,blob) }
+	if NoCompress(ctx) {
+		atomic.AddInt64(&p.counts.Hinted,1)
+		return Compress(dst,nil,blob)
+	}
+	if !Compressible(blob) {
+		atomic.AddInt64(&p.counts.Estimated,1)
+		return Compress(dst,nil,blob)
+	}
+	l := len(dst)
+	dst,meta := Compress(dst,c,blob)
+	if meta.Size==0 {
+		atomic.AddInt64(&p.counts.Failed,1)
+	} else {
+		atomic.AddInt64(&p.counts.Compressed,1)
+		atomic.AddInt64(&p.counts.Saved,int64(len(blob)-(len(dst)-l)))
+	}
+	return dst,meta
+}
+
+func (p *Compressor) Counts() CompressCounts {
+	return CompressCounts{
+		Compressed: atomic.LoadInt64(&p.counts.Compressed),
+		Hinted    : atomic.LoadInt64(&p.counts.Hinted),
+		Estimated : atomic.LoadInt64(&p.counts.Estimated),
+		Failed    : atomic.LoadInt64(&p.counts.Failed),
+		Saved     : atomic.LoadInt64(&p.counts.Saved),
+	}
+}
@@ -0,0 +1,346 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package istorage
+
+import "crypto/cipher"
+import "crypto/rand"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "sync"
+import "time"
+
+var ErrNoDayKeys = errors.New("day keys are not enabled")
+
+const daySeconds = 60*60*24
+
+func unixDay(t time.Time) uint32 { return uint32(t.Unix()/daySeconds) }
+
+type dayKey struct{
+	raw  []byte // nil, if the key was shredded.
+	aead cipher.AEAD
+}
+
+// dayKeysMagic starts a key store with a wrapping key. Older stores start
+// with the last expired unix day, which is below 2^31.
+const dayKeysMagic = 0xda1c0002
+
+// A slot of the wrapping key file: [4] generation, [1] 1, sealed key.
+const wrapSlot = 5+SealOverhead+32
+
+/*
+DayKeys is a Sealer, that seals the records of each day with a data key of
+their own. Destroying a day's key makes its records unreadable, without
+relying on the file system to erase anything.
+
+The data keys are kept in a small file, sealed by a wrapping key:
+	[4] dayKeysMagic, [4] generation, [4] the last expired unix day
+	{ [4] unix day, [1] 1, [SealOverhead+32] sealed key }*
+	{ [4] unix day, [1] 0 }* (shredded days)
+The file is replaced as a whole, whenever a key is added or destroyed, so
+old copies of it may linger on the disk. Therefore, whenever a key is
+destroyed, the file is sealed by a new wrapping key, and the old one is
+overwritten. The wrapping keys are sealed by the Keyring, and kept in two
+slots of the file path+".wrap", one per generation, which is written in place.
+The wrapping key is renewed on open, after the keyfile was rotated.
+
+Records sealed by the Keyring are still opened.
+*/
+type DayKeys struct{
+	path    string
+	keys    *Keyring
+	mutex   sync.RWMutex
+	expired uint32
+	days    map[uint32]*dayKey
+	gen     uint32      // Generation of the wrapping key.
+	wrap    cipher.AEAD // Wrapping key, nil before the first save.
+	ro      bool
+}
+
+// OpenDayKeys opens the key store at path, or creates it. A store without a
+// wrapping key, as older versions wrote it, gets one.
+func OpenDayKeys(path string, k *Keyring) (*DayKeys,error) { return openDayKeys(path,k,false) }
+
+// ReadDayKeys opens the key store at path without writing to it: it is
+// neither created, nor upgraded, nor renewed. It seals only days, that have
+// a key already.
+func ReadDayKeys(path string, k *Keyring) (*DayKeys,error) { return openDayKeys(path,k,true) }
+
+func openDayKeys(path string, k *Keyring, ro bool) (*DayKeys,error) {
+	d := &DayKeys{path:path,keys:k,days:make(map[uint32]*dayKey),ro:ro}
+	data,err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) { return d,nil }
+	if err!=nil { return nil,err }
+	if len(data)<4 { return nil,fmt.Errorf("%s: too short",path) }
+	stale := true
+	open := k.Open
+	if binary.BigEndian.Uint32(data)==dayKeysMagic {
+		if len(data)<12 { return nil,fmt.Errorf("%s: too short",path) }
+		d.gen = binary.BigEndian.Uint32(data[4:])
+		if d.wrap,stale,err = d.readSlot(d.gen) ; err!=nil { return nil,err }
+		open = func(env []byte) ([]byte,error) {
+			if binary.BigEndian.Uint32(env)!=d.gen { return nil,ErrNoKey }
+			return openWith(d.wrap,env)
+		}
+		data = data[8:]
+	}
+	d.expired = binary.BigEndian.Uint32(data)
+	data = data[4:]
+	for len(data)>0 {
+		if len(data)<5 || (data[4]==1 && len(data)<5+SealOverhead+32) { return nil,fmt.Errorf("%s: truncated",path) }
+		day := binary.BigEndian.Uint32(data)
+		if data[4]!=1 {
+			d.days[day] = new(dayKey)
+			data = data[5:]
+			continue
+		}
+		env := data[5:5+SealOverhead+32]
+		data = data[5+SealOverhead+32:]
+		raw,err := open(env)
+		if err!=nil { return nil,fmt.Errorf("%s: key of day %s: %v",path,dayName(day),err) }
+		aead,err := newAEAD(raw)
+		if err!=nil { return nil,err }
+		d.days[day] = &dayKey{raw,aead}
+	}
+	if ro { return d,nil }
+	if stale {
+		if err = d.save(true) ; err!=nil { return nil,err }
+	}
+	if err = d.clearStale() ; err!=nil { return nil,err }
+	return d,nil
+}
+
+func dayName(day uint32) string { return time.Unix(int64(day)*daySeconds,0).UTC().Format("2006-01-02") }
+
+func openWith(aead cipher.AEAD, env []byte) ([]byte,error) {
+	if len(env)<SealOverhead { return nil,ErrUnseal }
+	ct := env[envHead:]
+	rec,err := aead.Open(ct[:0],env[4:envHead],ct,env[:4])
+	if err!=nil { return nil,ErrUnseal }
+	return rec,nil
+}
+
+// readSlot reads the wrapping key of generation gen. stale is true, if the
+// Keyring sealed it with an older key.
+func (d *DayKeys) readSlot(gen uint32) (aead cipher.AEAD,stale bool,err error) {
+	f,err := os.Open(d.path+".wrap")
+	if err!=nil { return }
+	defer f.Close()
+	b := make([]byte,wrapSlot)
+	if _,err = f.ReadAt(b,int64(gen%2)*wrapSlot) ; err!=nil { return }
+	if binary.BigEndian.Uint32(b)!=gen || b[4]!=1 {
+		return nil,false,fmt.Errorf("%s.wrap: the wrapping key of generation %d is missing",d.path,gen)
+	}
+	stale = binary.BigEndian.Uint32(b[5:])!=d.keys.current
+	raw,err := d.keys.Open(b[5:])
+	if err!=nil { return nil,false,fmt.Errorf("%s.wrap: %v",d.path,err) }
+	aead,err = newAEAD(raw)
+	return
+}
+
+// writeSlot writes the slot of generation gen, and syncs it. raw is nil to
+// overwrite the slot with zeros.
+func (d *DayKeys) writeSlot(gen uint32, raw []byte) error {
+	b := make([]byte,5,wrapSlot)
+	if raw!=nil {
+		binary.BigEndian.PutUint32(b,gen)
+		b[4] = 1
+		var err error
+		if b,err = d.keys.Seal(b,raw,time.Time{}) ; err!=nil { return err }
+	}
+	b = b[:wrapSlot]
+	f,err := os.OpenFile(d.path+".wrap",os.O_CREATE|os.O_WRONLY,0600)
+	if err!=nil { return err }
+	_,err = f.WriteAt(b,int64(gen%2)*wrapSlot)
+	if err==nil { err = f.Sync() }
+	if e := f.Close() ; err==nil { err = e }
+	return err
+}
+
+// clearStale overwrites the wrapping key of the previous generation, unless
+// it is gone already. The caller holds the write lock.
+func (d *DayKeys) clearStale() error {
+	f,err := os.Open(d.path+".wrap")
+	if err!=nil { return err }
+	var b [wrapSlot]byte
+	_,err = f.ReadAt(b[:],int64((d.gen+1)%2)*wrapSlot)
+	f.Close()
+	if err==io.EOF || (err==nil && b==[wrapSlot]byte{}) { return nil }
+	if err!=nil { return err }
+	return d.writeSlot(d.gen+1,nil)
+}
+
+// save replaces the file with the current keys. With renew, they are sealed
+// with a new wrapping key; call clearStale afterwards to destroy the old one.
+// The caller holds the write lock.
+func (d *DayKeys) save(renew bool) error {
+	gen,wrap := d.gen,d.wrap
+	if renew || wrap==nil {
+		raw := make([]byte,32)
+		if _,err := io.ReadFull(rand.Reader,raw) ; err!=nil { return err }
+		var err error
+		if wrap,err = newAEAD(raw) ; err!=nil { return err }
+		gen++
+		if err = d.writeSlot(gen,raw) ; err!=nil { return err }
+	}
+	days := make([]uint32,0,len(d.days))
+	for day := range d.days { days = append(days,day) }
+	sort.Slice(days,func(i, j int) bool { return days[i]<days[j] })
+	buf := make([]byte,12,12+len(days)*(5+SealOverhead+32))
+	binary.BigEndian.PutUint32(buf,dayKeysMagic)
+	binary.BigEndian.PutUint32(buf[4:],gen)
+	binary.BigEndian.PutUint32(buf[8:],d.expired)
+	for _,day := range days {
+		var h [5]byte
+		binary.BigEndian.PutUint32(h[:],day)
+		dk := d.days[day]
+		if dk.raw==nil {
+			buf = append(buf,h[:]...)
+			continue
+		}
+		h[4] = 1
+		var err error
+		buf,err = seal(append(buf,h[:]...),gen,wrap,dk.raw)
+		if err!=nil { return err }
+	}
+	tmp := d.path+".tmp"
+	f,err := os.OpenFile(tmp,os.O_CREATE|os.O_TRUNC|os.O_WRONLY,0600)
+	if err!=nil { return err }
+	_,err = f.Write(buf)
+	if err==nil { err = f.Sync() }
+	if e := f.Close() ; err==nil { err = e }
+	if err==nil { err = os.Rename(tmp,d.path) }
+	if err!=nil {
+		os.Remove(tmp)
+		return err
+	}
+	if dir,e := os.Open(filepath.Dir(d.path)) ; e==nil { dir.Sync(); dir.Close() }
+	d.gen,d.wrap = gen,wrap
+	return nil
+}
+
+// key returns the key of day, and creates it, if needed.
+func (d *DayKeys) key(day uint32) (cipher.AEAD,error) {
+	d.mutex.RLock()
+	dk,expired := d.days[day],d.expired
+	d.mutex.RUnlock()
+	if dk==nil && day>expired {
+		if d.ro { return nil,ErrReadOnly }
+		d.mutex.Lock(); defer d.mutex.Unlock()
+		if dk = d.days[day] ; dk==nil && day>d.expired {
+			raw := make([]byte,32)
+			if _,err := io.ReadFull(rand.Reader,raw) ; err!=nil { return nil,err }
+			aead,err := newAEAD(raw)
+			if err!=nil { return nil,err }
+			dk = &dayKey{raw,aead}
+			d.days[day] = dk
+			if err = d.save(false) ; err!=nil {
+				delete(d.days,day)
+				return nil,err
+			}
+		}
+	}
+	if dk==nil || dk.raw==nil { return nil,ErrShredded }
+	return dk.aead,nil
+}
+
+// Seal implements Sealer.
+func (d *DayKeys) Seal(dst, rec []byte, day time.Time) ([]byte,error) {
+	u := unixDay(day)
+	aead,err := d.key(u)
+	if err!=nil { return nil,err }
+	return seal(dst,DayKeyID|u,aead,rec)
+}
+
+// Open implements Sealer.
+func (d *DayKeys) Open(env []byte) ([]byte,error) {
+	if len(env)<SealOverhead { return nil,ErrUnseal }
+	id := binary.BigEndian.Uint32(env)
+	if (id&DayKeyID)==0 { return d.keys.Open(env) }
+	day := id&^DayKeyID
+	d.mutex.RLock()
+	dk,expired := d.days[day],d.expired
+	d.mutex.RUnlock()
+	if dk==nil {
+		if day<=expired { return nil,ErrShredded }
+		return nil,ErrNoKey
+	}
+	if dk.raw==nil { return nil,ErrShredded }
+	ct := env[envHead:]
+	rec,err := dk.aead.Open(ct[:0],env[4:envHead],ct,env[:4])
+	if err!=nil { return nil,ErrUnseal }
+	return rec,nil
+}
+
+// Reseal implements Sealer. Only records sealed by the Keyring are resealed;
+// the day keys themselves are resealed on open.
+func (d *DayKeys) Reseal(env []byte) (bool,error) {
+	return d.keys.Reseal(env)
+}
+
+// Shred destroys the key of the day of t.
+func (d *DayKeys) Shred(t time.Time) error {
+	if d.ro { return ErrReadOnly }
+	day := unixDay(t)
+	d.mutex.Lock(); defer d.mutex.Unlock()
+	old,ok := d.days[day]
+	if ok && old.raw==nil { return nil }
+	d.days[day] = new(dayKey)
+	if err := d.save(true) ; err!=nil {
+		if ok { d.days[day] = old } else { delete(d.days,day) }
+		return err
+	}
+	return d.clearStale()
+}
+
+// Expire destroys the keys of the day of t and all days before, and returns
+// their number.
+func (d *DayKeys) Expire(t time.Time) (int,error) {
+	if d.ro { return 0,ErrReadOnly }
+	day := unixDay(t)
+	d.mutex.Lock(); defer d.mutex.Unlock()
+	if day<=d.expired { return 0,nil }
+	old := make(map[uint32]*dayKey)
+	n := 0
+	for k,dk := range d.days {
+		if k>day { continue }
+		old[k] = dk
+		if dk.raw!=nil { n++ }
+		delete(d.days,k)
+	}
+	oe := d.expired
+	d.expired = day
+	if err := d.save(true) ; err!=nil {
+		for k,dk := range old { d.days[k] = dk }
+		d.expired = oe
+		return 0,err
+	}
+	return n,d.clearStale()
+}
@@ -0,0 +1,198 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package istorage
+
+import "bytes"
+import "encoding/binary"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+// sealDay seals rec with the key of day.
+func sealDay(t *testing.T, d *DayKeys, rec []byte, day time.Time) []byte {
+	env,err := SealRecord(nil,d,rec,day)
+	if err!=nil { t.Fatalf("seal %v: %v",day,err) }
+	return env
+}
+
+// openDay opens a copy of env.
+func openDay(d Sealer, env []byte) ([]byte,error) {
+	return OpenRecord(d,append([]byte(nil),env...))
+}
+
+// slots reads the generations of the two slots of the wrapping key file, 0
+// for a cleared one, and the Keyring key IDs, that sealed them.
+func slots(t *testing.T, path string) (gen,kid [2]uint32) {
+	b,err := ioutil.ReadFile(path+".wrap")
+	if err!=nil { t.Fatal(err) }
+	if len(b)!=2*wrapSlot { t.Fatalf("%d bytes in the wrapping key file",len(b)) }
+	for i := range gen {
+		s := b[i*wrapSlot:(i+1)*wrapSlot]
+		if s[4]==0 {
+			if !bytes.Equal(s,make([]byte,wrapSlot)) { t.Fatalf("slot %d is not cleared",i) }
+			continue
+		}
+		gen[i],kid[i] = binary.BigEndian.Uint32(s),binary.BigEndian.Uint32(s[5:])
+	}
+	return
+}
+
+func TestDayKeysShred(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir,"daykeys")
+	k := keyfile(t,dir,1)
+	d,err := OpenDayKeys(path,k)
+	if err!=nil { t.Fatal(err) }
+	d1 := time.Date(2017,3,1,12,0,0,0,time.UTC)
+	d2 := d1.Add(24*time.Hour)
+	rec := record("hello")
+	e1,e2 := sealDay(t,d,rec,d1),sealDay(t,d,rec,d2)
+	old := append([]byte(nil),sealDay(t,d,rec,d1)...)
+	
+	if err = d.Shred(d1.Add(6*time.Hour)) ; err!=nil { t.Fatal(err) }
+	if _,err = openDay(d,e1) ; err!=ErrShredded { t.Fatalf("open of a shredded day: %v",err) }
+	
+	d,err = OpenDayKeys(path,k)
+	if err!=nil { t.Fatal(err) }
+	for _,e := range [][]byte{e1,old} {
+		if _,err = openDay(d,e) ; err!=ErrShredded { t.Fatalf("open of a shredded day after reopen: %v",err) }
+	}
+	if got,err := openDay(d,e2) ; err!=nil || !bytes.Equal(got,rec) { t.Fatalf("open of the other day: %q %v",got,err) }
+	if _,err = SealRecord(nil,d,rec,d1) ; err!=ErrShredded { t.Fatalf("seal into a shredded day: %v",err) }
+}
+
+func TestDayKeysExpire(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir,"daykeys")
+	k := keyfile(t,dir,1)
+	d,err := OpenDayKeys(path,k)
+	if err!=nil { t.Fatal(err) }
+	d0 := time.Date(2017,3,1,0,0,0,0,time.UTC)
+	rec := record("hello")
+	var envs [3][]byte
+	for i := range envs { envs[i] = sealDay(t,d,rec,d0.Add(time.Duration(i)*24*time.Hour)) }
+	
+	n,err := d.Expire(d0.Add(30*time.Hour))
+	if n!=2 || err!=nil { t.Fatalf("expired %d keys: %v",n,err) }
+	if n,err = d.Expire(d0) ; n!=0 || err!=nil { t.Fatalf("expired %d keys again: %v",n,err) }
+	
+	d,err = OpenDayKeys(path,k)
+	if err!=nil { t.Fatal(err) }
+	for i,e := range envs[:2] {
+		if _,err = openDay(d,e) ; err!=ErrShredded { t.Fatalf("open of expired day %d after reopen: %v",i,err) }
+	}
+	if got,err := openDay(d,envs[2]) ; err!=nil || !bytes.Equal(got,rec) { t.Fatalf("open of the live day: %q %v",got,err) }
+	if _,err = SealRecord(nil,d,rec,d0) ; err!=ErrShredded { t.Fatalf("seal into an expired day: %v",err) }
+}
+
+// Every shred renews the wrapping key and clears the old slot; so does an
+// open after the keyfile was rotated.
+func TestDayKeysRenew(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir,"daykeys")
+	d,err := OpenDayKeys(path,keyfile(t,dir,1))
+	if err!=nil { t.Fatal(err) }
+	d1 := time.Date(2017,3,1,0,0,0,0,time.UTC)
+	d2 := d1.Add(24*time.Hour)
+	rec := record("hello")
+	e1,e2 := sealDay(t,d,rec,d1),sealDay(t,d,rec,d2)
+	if gen,_ := slots(t,path) ; gen!=[2]uint32{0,1} { t.Fatalf("slots %v after the first key",gen) }
+	
+	if err = d.Shred(d1) ; err!=nil { t.Fatal(err) }
+	if gen,kid := slots(t,path) ; gen!=[2]uint32{2,0} || kid[0]!=1 { t.Fatalf("slots %v sealed by %v after a shred",gen,kid) }
+	
+	// Rotate the keyfile: the wrapping key is sealed with the new key.
+	d,err = OpenDayKeys(path,keyfile(t,dir,1,2))
+	if err!=nil { t.Fatal(err) }
+	if gen,kid := slots(t,path) ; gen!=[2]uint32{0,3} || kid[1]!=2 { t.Fatalf("slots %v sealed by %v after the rotation",gen,kid) }
+	
+	// Without the old key, the store still opens.
+	d,err = OpenDayKeys(path,keyfile(t,dir,2))
+	if err!=nil { t.Fatal(err) }
+	if gen,_ := slots(t,path) ; gen!=[2]uint32{0,3} { t.Fatalf("slots %v after a plain reopen",gen) }
+	if _,err = openDay(d,e1) ; err!=ErrShredded { t.Fatalf("open of the shredded day: %v",err) }
+	if got,err := openDay(d,e2) ; err!=nil || !bytes.Equal(got,rec) { t.Fatalf("open of the live day: %q %v",got,err) }
+	
+	// A left over slot of the previous generation is cleared on open.
+	b,err := ioutil.ReadFile(path+".wrap")
+	if err!=nil { t.Fatal(err) }
+	copy(b[:wrapSlot],bytes.Repeat([]byte{1},wrapSlot))
+	if err = ioutil.WriteFile(path+".wrap",b,0600) ; err!=nil { t.Fatal(err) }
+	if _,err = OpenDayKeys(path,keyfile(t,dir,2)) ; err!=nil { t.Fatal(err) }
+	if gen,_ := slots(t,path) ; gen!=[2]uint32{0,3} { t.Fatalf("slots %v, the stale slot was not cleared",gen) }
+}
+
+// A store, as older versions wrote it, has no wrapping key: the Keyring seals
+// the day keys. It is upgraded on open, but not by ReadDayKeys.
+func TestDayKeysUpgrade(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir,"daykeys")
+	k := keyfile(t,dir,1)
+	d1 := time.Date(2017,3,1,0,0,0,0,time.UTC)
+	d2 := d1.Add(24*time.Hour)
+	raw := bytes.Repeat([]byte{7},32)
+	aead,err := newAEAD(raw)
+	if err!=nil { t.Fatal(err) }
+	
+	old := make([]byte,4)
+	binary.BigEndian.PutUint32(old,unixDay(d1)-1)
+	old = append(old,0,0,0,0,0)
+	binary.BigEndian.PutUint32(old[4:],unixDay(d1))
+	h := make([]byte,5)
+	binary.BigEndian.PutUint32(h,unixDay(d2))
+	h[4] = 1
+	if old,err = seal(append(old,h...),1,k.keys[1],raw) ; err!=nil { t.Fatal(err) }
+	if err = ioutil.WriteFile(path,old,0600) ; err!=nil { t.Fatal(err) }
+	
+	rec := record("hello")
+	env,err := seal([]byte{0,0,0,0},DayKeyID|unixDay(d2),aead,rec)
+	if err!=nil { t.Fatal(err) }
+	binary.BigEndian.PutUint32(env,SealField)
+	
+	r,err := ReadDayKeys(path,k)
+	if err!=nil { t.Fatal(err) }
+	if got,err := openDay(r,env) ; err!=nil || !bytes.Equal(got,rec) { t.Fatalf("read-only open of the old format: %q %v",got,err) }
+	if _,err = SealRecord(nil,r,rec,d2.Add(24*time.Hour)) ; err!=ErrReadOnly { t.Fatalf("read-only seal of a new day: %v",err) }
+	if b,_ := ioutil.ReadFile(path) ; !bytes.Equal(b,old) { t.Fatal("ReadDayKeys changed the store") }
+	if _,err = os.Stat(path+".wrap") ; !os.IsNotExist(err) { t.Fatalf("ReadDayKeys created the wrapping key file: %v",err) }
+	
+	d,err := OpenDayKeys(path,k)
+	if err!=nil { t.Fatal(err) }
+	if b,_ := ioutil.ReadFile(path) ; binary.BigEndian.Uint32(b)!=dayKeysMagic { t.Fatal("the store was not upgraded") }
+	if gen,_ := slots(t,path) ; gen!=[2]uint32{0,1} { t.Fatalf("slots %v after the upgrade",gen) }
+	for _,s := range []*DayKeys{d,nil} {
+		if s==nil {
+			if s,err = OpenDayKeys(path,k) ; err!=nil { t.Fatal(err) }
+		}
+		if got,err := openDay(s,env) ; err!=nil || !bytes.Equal(got,rec) { t.Fatalf("open after the upgrade: %q %v",got,err) }
+		if _,err = SealRecord(nil,s,rec,d1) ; err!=ErrShredded { t.Fatalf("seal into the shredded day: %v",err) }
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package istorage
+
+// Names of request headers, that both the server and the client use.
+const (
+	// HeaderIdempotencyKey marks retried POSTs as such, so that the server
+	// stores the blob only once.
+	HeaderIdempotencyKey = "idempotency-key"
+	
+	// HeaderBatchLimit caps the size of an MGET response in bytes. The server
+	// stops after the first blob, that reaches the cap, and answers with
+	// HeaderBatchCount. The client requests the remaining blobs anew.
+	HeaderBatchLimit     = "batch-limit"
+	
+	// HeaderBatchCount tells, how many blobs of an MGET request a capped
+	// response holds. It is absent, if the response holds all of them.
+	HeaderBatchCount     = "batch-count"
+	
+	// HeaderNoCompress asks the server to store an upload uncompressed, see
+	// WithNoCompress.
+	HeaderNoCompress     = "no-compress"
+	
+	// HeaderAcceptCodec lists the codecs, whose payloads a client decodes itself.
+	HeaderAcceptCodec    = "accept-codec"
+	
+	// HeaderStatsVersion asks for a version of the STATS format, and tells the
+	// version of the response. Without it, the first version is used.
+	HeaderStatsVersion   = "stats-version"
+)
+
+// HeaderInt decodes a decimal header value. Other characters are skipped, an
+// empty value is 0.
+func HeaderInt(v []byte) (i int) {
+	for _,b := range v {
+		if b<'0' || '9'<b { continue }
+		i = (i*10) + int(b-'0')
+	}
+	return
+}
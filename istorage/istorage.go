@@ -24,14 +24,101 @@ SOFTWARE.
 package istorage
 
 import "github.com/valyala/bytebufferpool"
+import "context"
+import "errors"
+import "hash/crc32"
 import "time"
 
+var ErrChecksum = errors.New("checksum mismatch")
+
+// ErrReadOnly is returned for changes to a storage or a key store, that was
+// opened read-only.
+var ErrReadOnly = errors.New("opened read-only")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum computes the CRC-32C of an uncompressed blob.
+func Checksum(blob []byte) uint32 {
+	return crc32.Checksum(blob,castagnoli)
+}
+
+// SumFlag is set in the 32-bit size field of a stored record, if the record
+// carries a checksum. Records written before checksums existed lack it.
+const SumFlag = 1<<31
+
+// Meta describes a blob loaded by LoadBlob.
+type Meta struct{
+	Codec  uint8  // Codec of the payload, see CodecByID.
+	Size   int    // Uncompressed size, if the payload is compressed, 0 otherwise.
+	Sum    uint32 // CRC-32C of the uncompressed content, if HasSum.
+	HasSum bool
+}
+
+// Storage is implemented by every storage backend. The context passed to
+// StoreBlob, LoadBlob and Expire carries the trace of the originating request;
+// backends should give up early, once it is done.
 type Storage interface{
-	StoreBlob(blob []byte, t time.Time) ([]byte,bool)
-	LoadBlob(key []byte,target *bytebufferpool.ByteBuffer) (lz4l int,ok bool)
-	Expire(t time.Time)
+	StoreBlob(ctx context.Context, blob []byte, t time.Time) ([]byte,bool)
+	LoadBlob(ctx context.Context, key []byte,target *bytebufferpool.ByteBuffer) (meta Meta,ok bool)
+	Expire(ctx context.Context, t time.Time)
 	FreeStorage() int64
 }
 
+// Walker is implemented by storages, that can enumerate their blobs.
+// WalkBlobs calls fn for every stored blob, day by day in ascending order.
+// day is the start of the UTC day the blob is filed under. If fn returns
+// an error, the walk stops and WalkBlobs returns that error.
+type Walker interface{
+	WalkBlobs(ctx context.Context, fn func(key []byte, day time.Time) error) error
+}
+
+// Resizer is implemented by storages, whose capacity can be changed while
+// they are in use.
+type Resizer interface{
+	SetCapacity(capacity int64)
+}
 
+// DayDropper is implemented by storages, that can drop a single day, such as
+// after its blobs were moved elsewhere. Like with Expire, storing into a
+// dropped day fails afterwards, so that keys are never reused.
+type DayDropper interface{
+	DropDay(ctx context.Context, day time.Time) error
+}
+
+// DayShredder is implemented by storages, that seal each day with its own
+// key (see DayKeys). ShredDay destroys the key of a day, which makes its blobs
+// unreadable, even where their bytes linger on the disk. Storing into a
+// shredded day fails afterwards. Storages, that can, free the space as well.
+type DayShredder interface{
+	ShredDay(ctx context.Context, day time.Time) error
+}
+
+// UsageReporter is implemented by storages, that know how many bytes they occupy.
+type UsageReporter interface{
+	UsedStorage() int64
+}
+
+// Volatile is implemented by storages, whose blobs don't survive a restart,
+// such as the memory backend. Blobs must not be moved onto them.
+type Volatile interface{
+	Volatile() bool
+}
+
+// Storages, that hold files or other resources, implement io.Closer.
+// A closed storage must not be used anymore.
+
+// Unpack decodes a payload loaded by LoadBlob into buf, and verifies its
+// checksum, if meta has one. The result may alias payload.
+func Unpack(meta Meta, payload, buf []byte) ([]byte,error) {
+	blob := payload
+	if meta.Size>0 {
+		c := CodecByID(meta.Codec)
+		if c==nil { return nil,ErrUnknownCodec }
+		if cap(buf)<meta.Size { buf = make([]byte,meta.Size) }
+		blob = buf[:meta.Size]
+		if err := c.Decompress(blob,payload) ; err!=nil { return nil,err }
+	}
+	if meta.HasSum && Checksum(blob)!=meta.Sum { return nil,ErrChecksum }
+	return blob,nil
+}
 
@@ -0,0 +1,110 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package istorage
+
+import "io"
+import "fmt"
+import "sync"
+import "strings"
+import "time"
+
+// A Logger receives structured log events as alternating key-value pairs,
+// for example: Log("event","open","backend","dayfile","path",p).
+type Logger interface{
+	Log(keyvals ...interface{}) error
+}
+
+type nopLogger struct{}
+func (nopLogger) Log(keyvals ...interface{}) error { return nil }
+
+// NopLogger returns a Logger, that discards every event.
+func NopLogger() Logger { return nopLogger{} }
+
+// OrNop returns l, or a NopLogger if l is nil.
+func OrNop(l Logger) Logger {
+	if l==nil { return nopLogger{} }
+	return l
+}
+
+type contextLogger struct{
+	parent  Logger
+	keyvals []interface{}
+}
+func (c *contextLogger) Log(keyvals ...interface{}) error {
+	kv := make([]interface{},0,len(c.keyvals)+len(keyvals))
+	kv = append(kv,c.keyvals...)
+	kv = append(kv,keyvals...)
+	return c.parent.Log(kv...)
+}
+
+// With returns a Logger, that prepends keyvals to every event.
+func With(l Logger, keyvals ...interface{}) Logger {
+	l = OrNop(l)
+	if _,ok := l.(nopLogger) ; ok { return l }
+	return &contextLogger{l,keyvals}
+}
+
+type logfmtLogger struct{
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// NewLogfmtLogger returns a Logger, that writes one line of key=value pairs
+// per event to w, prefixed with a timestamp.
+func NewLogfmtLogger(w io.Writer) Logger {
+	return &logfmtLogger{w:w}
+}
+func logfmtValue(v interface{}) string {
+	var s string
+	switch t := v.(type) {
+	case nil: s = "nil"
+	case string: s = t
+	case error: s = t.Error()
+	case []byte: s = fmt.Sprintf("%x",t)
+	case time.Time: s = t.UTC().Format(time.RFC3339)
+	default: s = fmt.Sprint(t)
+	}
+	if s=="" || strings.ContainsAny(s," =\"\t\r\n") { return fmt.Sprintf("%q",s) }
+	return s
+}
+func (l *logfmtLogger) Log(keyvals ...interface{}) error {
+	var b strings.Builder
+	b.WriteString("ts=")
+	b.WriteString(time.Now().UTC().Format(time.RFC3339))
+	for i := 0 ; i<len(keyvals) ; i+=2 {
+		b.WriteByte(' ')
+		b.WriteString(logfmtValue(keyvals[i]))
+		b.WriteByte('=')
+		if i+1<len(keyvals) {
+			b.WriteString(logfmtValue(keyvals[i+1]))
+		} else {
+			b.WriteString("nil")
+		}
+	}
+	b.WriteByte('\n')
+	l.mutex.Lock(); defer l.mutex.Unlock()
+	_,err := io.WriteString(l.w,b.String())
+	return err
+}
+
@@ -21,45 +21,33 @@ SOFTWARE.
 */
 
 
-package filebased
+package istorage
 
-import "github.com/valyala/bytebufferpool"
-import "github.com/pierrec/lz4"
-import "encoding/binary"
-import "io"
-
-func compress(blob []byte) *bytebufferpool.ByteBuffer {
-	lblob := len(blob)
-	i := lz4.CompressBlockBound(lblob)
-	buf   := blobPool.Get()
-	buf.B  = expand(buf.B,i+8)
-	
-	j,e := lz4.CompressBlock(blob,buf.B[8:],0)
-	if e!=nil || j==0 {
-		buf.B = buf.B[:8+lblob]
-		copy(buf.B[8:],blob)
-		lblob = 0
-	} else {
-		buf.B = buf.B[:8+j]
-	}
-	binary.BigEndian.PutUint32(buf.B[ :4],uint32(lblob))
-	binary.BigEndian.PutUint32(buf.B[4:8],uint32(len(buf.B))-8)
-	return buf
-}
-func unpacked(rat io.ReaderAt,offset int64, lng int, targ *bytebufferpool.ByteBuffer) (lz4l int,ok bool) {
-	var buf [8]byte
-	n,err := rat.ReadAt(buf[:],offset)
-	if n!=16 && err!=nil { return }
-	
-	lz4l = int(binary.BigEndian.Uint32(buf[ :4]))
-	j := int(binary.BigEndian.Uint32(buf[4:8]))
-	if (j+8)>lng { return }
-	targ.B  = expand(targ.B,j)
-	n,err = rat.ReadAt(targ.B,offset+8)
-	if n!=j && err!=nil { return }
-	ok = true
-	return
-}
+import "fmt"
 
+// Mode controls, what a server does with a storage.
+type Mode uint8
+const (
+	ReadWrite Mode = iota // Reads and new blobs.
+	ReadOnly              // Reads only.
+	Draining              // Reads only, while the data ages out or is migrated.
+	Offline               // Neither reads nor writes.
+)
 
+var modeNames = [...]string{"read-write","read-only","draining","offline"}
 
+func (m Mode) String() string {
+	if int(m)<len(modeNames) { return modeNames[m] }
+	return fmt.Sprintf("mode(%d)",uint8(m))
+}
+func (m Mode) Writable() bool { return m==ReadWrite }
+func (m Mode) Readable() bool { return m!=Offline }
+
+// ParseMode parses the names returned by Mode.String. The empty string is ReadWrite.
+func ParseMode(s string) (Mode,error) {
+	if s=="" { return ReadWrite,nil }
+	for i,n := range modeNames {
+		if n==s { return Mode(i),nil }
+	}
+	return 0,fmt.Errorf("unknown mode %q",s)
+}
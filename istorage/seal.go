@@ -0,0 +1,216 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package istorage
+
+import "bufio"
+import "context"
+import "crypto/aes"
+import "crypto/cipher"
+import "crypto/rand"
+import "encoding/binary"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+
+var (
+	ErrSealed = errors.New("record is sealed, but no keyfile is configured")
+	ErrNoKey  = errors.New("record is sealed with an unknown key")
+	ErrShredded = errors.New("the key of the day was destroyed")
+	ErrUnseal = errors.New("sealed record is damaged or forged")
+	
+	ErrNoKeyfile = errors.New("no keyfile is configured")
+)
+
+// SealField is the 32-bit size field of a sealed record. Records written by
+// PutHead always carry a checksum, so their size field never equals it.
+const SealField = CodecFlag
+
+/*
+Envelope layout:
+	[4]  key ID
+	[12] nonce
+	[*]  AES-256-GCM ciphertext of the record, and its 16 byte tag
+The key ID is authenticated as additional data. As nonces are random, a key
+should be rotated long before it sealed 2^32 records. If DayKeyID is set in
+the key ID, the rest of it is the unix day of a key in DayKeys.
+*/
+const (
+	nonceLen = 12
+	envHead  = 4+nonceLen
+	
+	// SealOverhead is the number of bytes, that an envelope adds to a record.
+	SealOverhead = envHead+16
+	
+	DayKeyID = 1<<31
+)
+
+// A Sealer seals the records of a storage. A Keyring seals them with its
+// current key, DayKeys with the key of the day, a record is filed under.
+type Sealer interface{
+	// Seal appends the envelope of rec to dst.
+	Seal(dst, rec []byte, day time.Time) ([]byte,error)
+	
+	// Open opens an envelope in place and returns the record.
+	Open(env []byte) ([]byte,error)
+	
+	// Reseal seals an envelope in place with the current key, if it was sealed
+	// with an older one. The length of the envelope doesn't change. On error,
+	// env is left unchanged.
+	Reseal(env []byte) (bool,error)
+}
+
+// A Keyring holds the keys of a storage. New records are sealed with the
+// current key; the older keys are kept to open older records.
+type Keyring struct{
+	current uint32
+	keys    map[uint32]cipher.AEAD
+}
+
+func newAEAD(key []byte) (cipher.AEAD,error) {
+	b,err := aes.NewCipher(key)
+	if err!=nil { return nil,err }
+	return cipher.NewGCM(b)
+}
+
+/*
+ReadKeyfile reads a keyfile. Each line holds a key ID and a 256-bit key in hex:
+	# Comments and empty lines are ignored.
+	1 8f0c6d...
+	2 41aa07...
+The key on the last line is the current one. Key IDs must be below DayKeyID.
+*/
+func ReadKeyfile(path string) (current uint32,keys map[uint32][]byte,err error) {
+	f,err := os.Open(path)
+	if err!=nil { return }
+	defer f.Close()
+	keys = make(map[uint32][]byte)
+	sc := bufio.NewScanner(f)
+	for ln := 1 ; sc.Scan() ; ln++ {
+		line := strings.TrimSpace(sc.Text())
+		if line=="" || line[0]=='#' { continue }
+		fields := strings.Fields(line)
+		if len(fields)!=2 { return 0,nil,fmt.Errorf("%s:%d: expected a key ID and a key",path,ln) }
+		id,err := strconv.ParseUint(fields[0],10,32)
+		if err!=nil || id>=DayKeyID { return 0,nil,fmt.Errorf("%s:%d: bad key ID %q",path,ln,fields[0]) }
+		raw,err := hex.DecodeString(fields[1])
+		if err!=nil || len(raw)!=32 { return 0,nil,fmt.Errorf("%s:%d: the key must be 64 hex digits",path,ln) }
+		if keys[uint32(id)]!=nil { return 0,nil,fmt.Errorf("%s:%d: key ID %d is used twice",path,ln,id) }
+		keys[uint32(id)] = raw
+		current = uint32(id)
+	}
+	if err = sc.Err() ; err!=nil { return 0,nil,err }
+	if len(keys)==0 { return 0,nil,fmt.Errorf("%s: no keys",path) }
+	return
+}
+
+// LoadKeyring reads a keyfile, see ReadKeyfile. To rotate, append a line with
+// a new ID, restart, and run "blobctl reencrypt", before the old key is removed.
+func LoadKeyring(path string) (*Keyring,error) {
+	current,raw,err := ReadKeyfile(path)
+	if err!=nil { return nil,err }
+	k := &Keyring{current:current,keys:make(map[uint32]cipher.AEAD)}
+	for id,key := range raw {
+		if k.keys[id],err = newAEAD(key) ; err!=nil { return nil,err }
+	}
+	return k,nil
+}
+
+// Current returns the ID of the key, that seals new records.
+func (k *Keyring) Current() uint32 { return k.current }
+
+// Seal appends the envelope of rec to dst. The day is not used.
+func (k *Keyring) Seal(dst, rec []byte, day time.Time) ([]byte,error) {
+	return seal(dst,k.current,k.keys[k.current],rec)
+}
+func seal(dst []byte, id uint32, aead cipher.AEAD, rec []byte) ([]byte,error) {
+	dst = grow(dst,SealOverhead+len(rec))
+	l := len(dst)
+	dst = dst[:l+envHead]
+	binary.BigEndian.PutUint32(dst[l:],id)
+	nonce := dst[l+4:l+envHead]
+	if _,err := io.ReadFull(rand.Reader,nonce) ; err!=nil { return nil,err }
+	return aead.Seal(dst,nonce,rec,dst[l:l+4]),nil
+}
+
+// Open implements Sealer. k may be nil.
+func (k *Keyring) Open(env []byte) ([]byte,error) {
+	if k==nil { return nil,ErrSealed }
+	if len(env)<SealOverhead { return nil,ErrUnseal }
+	aead := k.keys[binary.BigEndian.Uint32(env)]
+	if aead==nil { return nil,ErrNoKey }
+	ct := env[envHead:]
+	rec,err := aead.Open(ct[:0],env[4:envHead],ct,env[:4])
+	if err!=nil { return nil,ErrUnseal }
+	return rec,nil
+}
+
+// Reseal implements Sealer. Envelopes sealed with a day key are left alone.
+func (k *Keyring) Reseal(env []byte) (bool,error) {
+	if len(env)>=4 {
+		if id := binary.BigEndian.Uint32(env) ; id==k.current || (id&DayKeyID)!=0 { return false,nil }
+	}
+	save := append([]byte(nil),env...)
+	rec,err := k.Open(env)
+	if err==nil { _,err = k.Seal(env[:0],rec,time.Time{}) }
+	if err!=nil {
+		copy(env,save)
+		return false,err
+	}
+	return true,nil
+}
+
+// IsSealed reports, whether a record, as written by PutHead or SealRecord, is sealed.
+func IsSealed(rec []byte) bool {
+	return len(rec)>=4 && binary.BigEndian.Uint32(rec)==SealField
+}
+
+// SealRecord appends SealField and the envelope of rec, a record written by
+// PutHead, to dst.
+func SealRecord(dst []byte, k Sealer, rec []byte, day time.Time) ([]byte,error) {
+	l := len(dst)
+	dst = grow(dst,4)[:l+4]
+	binary.BigEndian.PutUint32(dst[l:],SealField)
+	return k.Seal(dst,rec,day)
+}
+
+// OpenRecord opens a record written by SealRecord in place. Other records are
+// returned as they are, to be passed to ParseHead. k may be nil.
+func OpenRecord(k Sealer, rec []byte) ([]byte,error) {
+	if !IsSealed(rec) { return rec,nil }
+	if k==nil { return nil,ErrSealed }
+	return k.Open(rec[4:])
+}
+
+// Resealer is implemented by storages, that can seal their sealed records in
+// place with the current key, such as after a rotation. Reseal returns the
+// number of resealed records. Unsealed records are left alone.
+type Resealer interface{
+	Reseal(ctx context.Context) (int,error)
+}
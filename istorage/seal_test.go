@@ -0,0 +1,118 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package istorage
+
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+// keyfile writes a keyfile with the keys ids, the last one current, and
+// loads it. The key of an ID is always the same.
+func keyfile(t *testing.T, dir string, ids ...uint32) *Keyring {
+	var b bytes.Buffer
+	for _,id := range ids { fmt.Fprintf(&b,"%d %064x\n",id,id) }
+	path := filepath.Join(dir,"keyfile")
+	if err := ioutil.WriteFile(path,b.Bytes(),0600) ; err!=nil { t.Fatal(err) }
+	k,err := LoadKeyring(path)
+	if err!=nil { t.Fatal(err) }
+	return k
+}
+
+func tempDir(t *testing.T) string {
+	dir,err := ioutil.TempDir("","istorage")
+	if err!=nil { t.Fatal(err) }
+	return dir
+}
+
+// record returns a record, as written by PutHead, of payload.
+func record(payload string) []byte {
+	rec := make([]byte,HeadLen,HeadLen+len(payload))
+	PutHead(rec,Meta{Sum:Checksum([]byte(payload)),HasSum:true})
+	return append(rec,payload...)
+}
+
+func TestKeyringRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rec := record("hello")
+	sealed,err := SealRecord(nil,keyfile(t,dir,1),rec,time.Time{})
+	if err!=nil { t.Fatal(err) }
+	if !IsSealed(sealed) || len(sealed)!=4+SealOverhead+len(rec) { t.Fatalf("bad envelope of %d bytes",len(sealed)) }
+	
+	// After the rotation, the old key still opens the record.
+	k := keyfile(t,dir,1,2)
+	if k.Current()!=2 { t.Fatalf("current key %d, want 2",k.Current()) }
+	got,err := OpenRecord(k,append([]byte(nil),sealed...))
+	if err!=nil || !bytes.Equal(got,rec) { t.Fatalf("open after rotation: %q %v",got,err) }
+	
+	// Without it, the record can't be opened.
+	if _,err = OpenRecord(keyfile(t,dir,2),append([]byte(nil),sealed...)) ; err!=ErrNoKey { t.Fatalf("open without the key: %v",err) }
+	if _,err = OpenRecord(nil,append([]byte(nil),sealed...)) ; err!=ErrSealed { t.Fatalf("open without keyring: %v",err) }
+}
+
+func TestKeyringReseal(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rec := record("hello")
+	sealed,err := SealRecord(nil,keyfile(t,dir,1),rec,time.Time{})
+	if err!=nil { t.Fatal(err) }
+	k := keyfile(t,dir,1,2)
+	
+	env := append([]byte(nil),sealed...)
+	ok,err := k.Reseal(env[4:])
+	if !ok || err!=nil { t.Fatalf("reseal: %v %v",ok,err) }
+	if len(env)!=len(sealed) { t.Fatal("the envelope changed its length") }
+	if id := binary.BigEndian.Uint32(env[4:]) ; id!=2 { t.Fatalf("resealed with key %d, want 2",id) }
+	if ok,err = k.Reseal(env[4:]) ; ok || err!=nil { t.Fatalf("resealed twice: %v %v",ok,err) }
+	
+	// The old key is not needed anymore.
+	got,err := OpenRecord(keyfile(t,dir,2),append([]byte(nil),env...))
+	if err!=nil || !bytes.Equal(got,rec) { t.Fatalf("open after reseal: %q %v",got,err) }
+	
+	// A damaged envelope is left as it is.
+	bad := append([]byte(nil),sealed...)
+	bad[len(bad)-1] ^= 1
+	save := append([]byte(nil),bad...)
+	if ok,err = k.Reseal(bad[4:]) ; ok || err!=ErrUnseal { t.Fatalf("reseal of a damaged envelope: %v %v",ok,err) }
+	if !bytes.Equal(bad,save) { t.Fatal("a failed reseal changed the envelope") }
+}
+
+func TestOpenRecordUnsealed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rec := record("hello")
+	if IsSealed(rec) { t.Fatal("a plain record looks sealed") }
+	for _,k := range []Sealer{nil,keyfile(t,dir,1)} {
+		got,err := OpenRecord(k,rec)
+		if err!=nil || !bytes.Equal(got,rec) { t.Fatalf("open of a plain record: %q %v",got,err) }
+		meta,payload,ok := ParseHead(got)
+		if !ok || string(payload)!="hello" || meta.Sum!=Checksum([]byte("hello")) { t.Fatalf("parse: %v %q %v",meta,payload,ok) }
+	}
+}
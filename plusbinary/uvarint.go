@@ -24,6 +24,10 @@ SOFTWARE.
 package plusbinary
 
 import "io"
+import "encoding/binary"
+import "errors"
+
+var ErrFrameTooLarge = errors.New("plusbinary: frame too large")
 
 func WriteUvarint(w io.ByteWriter, x uint64) error {
 	for x >= 0x80 {
@@ -43,3 +47,46 @@ func WriteVarint(w io.ByteWriter, x int64) error {
 	return WriteUvarint(w,ux)
 }
 
+func ReadUvarint(r io.ByteReader) (uint64,error) {
+	return binary.ReadUvarint(r)
+}
+
+func ReadVarint(r io.ByteReader) (int64,error) {
+	ux,err := binary.ReadUvarint(r)
+	x := int64(ux >> 1)
+	if ux&1 != 0 {
+		x = ^x
+	}
+	return x,err
+}
+
+type FrameWriter interface{
+	io.Writer
+	io.ByteWriter
+}
+type FrameReader interface{
+	io.Reader
+	io.ByteReader
+}
+
+// WriteFrame writes b prefixed with its length as uvarint.
+func WriteFrame(w FrameWriter, b []byte) error {
+	e := WriteUvarint(w,uint64(len(b)))
+	if e!=nil { return e }
+	_,e = w.Write(b)
+	return e
+}
+
+// ReadFrame reads a frame written by WriteFrame, reusing buffer if it is
+// large enough. Frames longer than max bytes are rejected.
+func ReadFrame(r FrameReader, buffer []byte, max int) ([]byte,error) {
+	l,e := binary.ReadUvarint(r)
+	if e!=nil { return nil,e }
+	if l>uint64(max) { return nil,ErrFrameTooLarge }
+	if uint64(cap(buffer))<l { buffer = make([]byte,l) }
+	buffer = buffer[:l]
+	_,e = io.ReadFull(r,buffer)
+	if e!=nil { return nil,e }
+	return buffer,nil
+}
+
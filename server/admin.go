@@ -0,0 +1,278 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package server
+
+import "github.com/maxymania/blobserver/binascii"
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/maxymania/blobserver/plusbinary"
+import "github.com/maxymania/blobserver/trace"
+import "github.com/byte-mug/gocom/notrest"
+import "bytes"
+import "encoding/hex"
+import "errors"
+import "time"
+
+/*
+Inspection routes. Node and ID path elements are Le190 encoded, as in /blobs/.
+
+STAT /blobs/<node>/<id>
+	Like GET, without the body. The stored-size header holds the size of the
+	payload as stored.
+
+LIST /list/<node>[/<unix-time>]
+	response: { frame id, varint unix-time of the day }*
+	With a time, only the blobs of its day are listed.
+
+RELOAD /admin/reload
+	Calls Server.Reload. On failure, the body holds the error message.
+
+MODE /admin/mode/<node>
+	request:  the name of the new mode, see istorage.ParseMode.
+
+FORWARD /admin/forward
+	request:  { frame node, frame id, frame new-node, frame new-id, varint unix-time }*
+	Adds entries to Server.Forward and syncs it. The time is that of the day,
+	the blob is filed under.
+
+GC /admin/forward-gc
+	Removes the forwarding entries of the days, that expired since the server
+	started or before the last GC, see ForwardTable.GC. EXPIRE does this as
+	well.
+	response: uvarint number of removed entries
+
+PURGE /admin/purge/<node>/<unix-time>
+	Destroys the key of the day of the time, see istorage.DayShredder. Fails with
+	501, if the storage doesn't seal its days with keys of their own, and with
+	400, if the day is today or in the future.
+
+STATS /admin/stats
+	response: { frame node, varint free, uvarint flags [, uvarint mode, varint used, uvarint drained
+	            [, uvarint compressed, uvarint hinted, uvarint estimated, uvarint failed, uvarint saved ]] }*
+	flags:    1 = the storage can be listed, 2 = the compression counts are known.
+	used:     bytes in use, -1 if unknown.
+	drained:  permille of the data gone since draining began, if the mode is draining.
+	The compression counts are those of istorage.CompressCounts.
+	The stats-version header of the request selects the format: 1 (the default)
+	ends after flags, 2 after drained, 3 holds all fields. The response tells
+	the version used in the same header, if it is above 1.
+*/
+const (
+	statsListable = 1
+	statsCompress = 2
+	statsVersion  = 3
+)
+
+var errStopWalk  = errors.New("stop walk")
+var errEmptyNode = errors.New("empty node")
+var errNotPast   = errors.New("only past days can be purged")
+
+func (s *Server) statBlob(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	ctx,cancel := s.context(req,resp)
+	defer cancel()
+	span := trace.Start(ctx,"stat")
+	var err error
+	defer func() { span.Finish(s.Tracer,err) }()
+	
+	A,B := splitz(rest,'/')
+	K,_ := binascii.DecodeLe190(A,nil)
+	I,_ := binascii.DecodeLe190(B,nil)
+	buf := batchPool.Get()
+	defer batchPool.Put(buf)
+	meta,err := s.load(ctx,K,I,buf)
+	if err!=nil {
+		switch {
+		case ctx.Err()!=nil: resp.Status(500)
+		case err==errOffline: resp.Status(503)
+		default: resp.Status(404)
+		}
+		return
+	}
+	resp.SetIntHeader("stored-size",len(buf.B))
+	setMetaHeaders(resp,meta)
+	resp.Status(200)
+}
+
+func (s *Server) listBlobs(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	ctx,cancel := s.context(req,resp)
+	defer cancel()
+	span := trace.Start(ctx,"list")
+	var err error
+	defer func() { span.Finish(s.Tracer,err) }()
+	
+	A,B := splitz(rest,'/')
+	K,_ := binascii.DecodeLe190(A,nil)
+	stor,ok := s.stors().Get(string(K))
+	if !ok { resp.Status(404); return }
+	span.Node = hex.EncodeToString(K)
+	walker,ok := stor.(istorage.Walker)
+	if !ok { resp.Status(501); return }
+	var only time.Time
+	if len(B)>0 { only = time.Unix(binascii.Signed(binascii.IntFromLe190(B)),0).UTC().Truncate(24*time.Hour) }
+	
+	out := resp.Body()
+	err = walker.WalkBlobs(ctx,func(key []byte, day time.Time) error {
+		if !only.IsZero() {
+			if day.Before(only) { return nil }
+			if day.After(only) { return errStopWalk }
+		}
+		plusbinary.WriteFrame(out,key)
+		plusbinary.WriteVarint(out,day.Unix())
+		return nil
+	})
+	if err==errStopWalk { err = nil }
+	if err!=nil { resp.Status(500); return }
+	resp.Status(200)
+}
+
+func (s *Server) stats(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	_,cancel := s.context(req,resp)
+	defer cancel()
+	ver := istorage.HeaderInt(req.GetHeaderK(istorage.HeaderStatsVersion))
+	if ver>statsVersion { ver = statsVersion }
+	if ver>1 { resp.SetIntHeader(istorage.HeaderStatsVersion,ver) }
+	out := resp.Body()
+	for k,v := range s.stors().All() {
+		var flags uint64
+		if _,ok := v.(istorage.Walker) ; ok { flags |= statsListable }
+		var cc istorage.CompressCounts
+		if cr,ok := v.(istorage.CompressReporter) ; ok {
+			flags |= statsCompress
+			cc = cr.CompressStats()
+		}
+		used := int64(-1)
+		if ur,ok := v.(istorage.UsageReporter) ; ok { used = ur.UsedStorage() }
+		drained,_ := s.stors().DrainProgress(k)
+		plusbinary.WriteFrame(out,[]byte(k))
+		plusbinary.WriteVarint(out,v.FreeStorage())
+		plusbinary.WriteUvarint(out,flags)
+		if ver<2 { continue }
+		plusbinary.WriteUvarint(out,uint64(s.stors().Mode(k)))
+		plusbinary.WriteVarint(out,used)
+		plusbinary.WriteUvarint(out,uint64(drained*1000))
+		if ver<3 { continue }
+		for _,n := range [...]int64{cc.Compressed,cc.Hinted,cc.Estimated,cc.Failed,cc.Saved} {
+			plusbinary.WriteUvarint(out,uint64(n))
+		}
+	}
+	resp.Status(200)
+}
+
+func (s *Server) reload(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	ctx,cancel := s.context(req,resp)
+	defer cancel()
+	if s.Reload==nil { resp.Status(501); return }
+	if err := s.Reload(ctx) ; err!=nil {
+		resp.Body().SetString(err.Error())
+		resp.Status(500)
+		return
+	}
+	resp.Status(200)
+}
+
+func (s *Server) setMode(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	_,cancel := s.context(req,resp)
+	defer cancel()
+	K,_ := binascii.DecodeLe190(rest,nil)
+	mode,err := istorage.ParseMode(string(req.Body().B))
+	if err!=nil {
+		resp.Body().SetString(err.Error())
+		resp.Status(400)
+		return
+	}
+	if !s.stors().SetMode(string(K),mode) { resp.Status(404); return }
+	resp.Status(200)
+}
+
+func (s *Server) addForwards(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	_,cancel := s.context(req,resp)
+	defer cancel()
+	if s.Forward==nil { resp.Status(501); return }
+	status := 200
+	r := bytes.NewReader(req.Body().B)
+	for r.Len()>0 && status==200 {
+		var rec [4][]byte
+		var err error
+		for i := range rec {
+			if rec[i],err = plusbinary.ReadFrame(r,nil,maxBatchFrame) ; err!=nil { break }
+		}
+		var day int64
+		if err==nil { day,err = plusbinary.ReadVarint(r) }
+		if err==nil && (len(rec[0])==0 || len(rec[2])==0) { err = errEmptyNode }
+		if err!=nil {
+			resp.Body().SetString(err.Error())
+			status = 400
+		} else if err = s.Forward.Add(rec[0],rec[1],rec[2],rec[3],time.Unix(day,0)) ; err!=nil {
+			status = 500
+		}
+	}
+	// Entries added before a malformed one are kept.
+	if err := s.Forward.Sync() ; err!=nil { status = 500 }
+	resp.Status(status)
+}
+
+func (s *Server) purgeDay(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	ctx,cancel := s.context(req,resp)
+	defer cancel()
+	span := trace.Start(ctx,"purge")
+	var err error
+	defer func() { span.Finish(s.Tracer,err) }()
+	
+	A,B := splitz(rest,'/')
+	K,_ := binascii.DecodeLe190(A,nil)
+	stor,ok := s.stors().Get(string(K))
+	if !ok || len(B)==0 { resp.Status(404); return }
+	span.Node = hex.EncodeToString(K)
+	shredder,ok := stor.(istorage.DayShredder)
+	if !ok { resp.Status(501); return }
+	day := time.Unix(binascii.Signed(binascii.IntFromLe190(B)),0).UTC()
+	if !day.Before(time.Now().UTC().Truncate(24*time.Hour)) {
+		// Placement would keep choosing the storage for the day.
+		err = errNotPast
+		resp.Body().SetString(err.Error())
+		resp.Status(400)
+		return
+	}
+	err = shredder.ShredDay(ctx,day)
+	switch {
+	case err==istorage.ErrNoDayKeys: resp.Status(501)
+	case err!=nil:
+		resp.Body().SetString(err.Error())
+		resp.Status(500)
+	default: resp.Status(200)
+	}
+}
+
+func (s *Server) gcForwards(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	ctx,cancel := s.context(req,resp)
+	defer cancel()
+	if s.Forward==nil { resp.Status(501); return }
+	n,err := s.gcForwardTable(ctx)
+	if err!=nil {
+		resp.Body().SetString(err.Error())
+		resp.Status(500)
+		return
+	}
+	plusbinary.WriteUvarint(resp.Body(),uint64(n))
+	resp.Status(200)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package server
+
+import "github.com/maxymania/blobserver/binascii"
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/byte-mug/gocom/notrest"
+import "github.com/valyala/bytebufferpool"
+import "context"
+import "testing"
+import "time"
+
+// shredStorage records the days, that were shredded.
+type shredStorage struct{
+	shredded []time.Time
+}
+
+func (s *shredStorage) StoreBlob(ctx context.Context, blob []byte, t time.Time) ([]byte,bool) { return nil,false }
+func (s *shredStorage) LoadBlob(ctx context.Context, key []byte,target *bytebufferpool.ByteBuffer) (meta istorage.Meta,ok bool) { return }
+func (s *shredStorage) Expire(ctx context.Context, t time.Time) {}
+func (s *shredStorage) FreeStorage() int64 { return 1<<30 }
+func (s *shredStorage) ShredDay(ctx context.Context, day time.Time) error {
+	s.shredded = append(s.shredded,day)
+	return nil
+}
+
+func TestPurgeDay(t *testing.T) {
+	st := new(shredStorage)
+	s := &Server{StorMap:NewStorMap(map[string]istorage.Storage{"n1":st})}
+	today := time.Now().UTC().Truncate(24*time.Hour)
+	for _,c := range []struct{
+		day  time.Time
+		code int
+	}{
+		{today.Add(-time.Second),200},
+		{today,400},
+		{today.Add(30*time.Hour),400},
+	} {
+		rest := binascii.EncodeLe190([]byte("n1"),nil)
+		rest  = append(rest,'/')
+		rest  = binascii.IntToLe190(binascii.Unsigned(c.day.Unix()),rest)
+		resp := notrest.AckquireResponse()
+		s.purgeDay(notrest.AckquireRequest(),resp,rest)
+		if resp.Code()!=c.code { t.Errorf("PURGE of %v: status %d, want %d",c.day,resp.Code(),c.code) }
+	}
+	if len(st.shredded)!=1 { t.Fatalf("%d days shredded, want 1",len(st.shredded)) }
+}
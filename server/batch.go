@@ -0,0 +1,156 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package server
+
+import "github.com/maxymania/blobserver/plusbinary"
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/maxymania/blobserver/trace"
+import "github.com/byte-mug/gocom/notrest"
+import "github.com/valyala/bytebufferpool"
+import "encoding/binary"
+import "bytes"
+import "io"
+import "time"
+
+/*
+Batch wire format. All lengths are uvarints (see plusbinary.WriteFrame).
+
+POST /batch/
+	request:  { varint unix-time, frame blob }*
+	response: { frame node, frame id }*  - an empty id marks a rejected blob.
+
+MGET /batch/
+	request:  { frame node, frame id }*
+	response: { uvarint flags, [uvarint decoded-size, [uvarint codec], [crc32c(4)], frame payload] }*
+	flags:    1 = found, 2 = crc32c present, 4 = codec present. The bracketed
+	          part follows only if found. Without codec, a non-zero decoded-size
+	          means LZ4, see istorage.CodecByID.
+	Payloads are decompressed, unless the accept-codec header allows their
+	codec, see negotiate.
+	The notrest response is buffered, so the batch-limit header (see
+	istorage.HeaderBatchLimit) bounds its size. The server then answers only
+	a prefix of the items and tells their number in batch-count.
+*/
+const (
+	batchFound  = 1
+	batchHasSum = 2
+	batchCodec  = 4
+	
+	maxBatchItems = 1<<14
+	maxBatchFrame = 1<<30
+)
+
+var batchPool bytebufferpool.Pool
+
+func (s *Server) postBatch(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	ctx,cancel := s.context(req,resp)
+	defer cancel()
+	span := trace.Start(ctx,"post-batch")
+	var err error
+	defer func() { span.Finish(s.Tracer,err) }()
+	
+	r := bytes.NewReader(req.Body().B)
+	out := resp.Body()
+	for n := 0 ; r.Len()>0 ; n++ {
+		if n>=maxBatchItems { resp.Status(413); return }
+		var ts int64
+		var blob []byte
+		ts,err = plusbinary.ReadVarint(r)
+		if err!=nil { resp.Status(400); return }
+		// The frame aliases the request body; no copy is needed.
+		blob,err = nextFrame(r,req.Body().B)
+		if err!=nil { resp.Status(400); return }
+		
+		skey,id,e := s.store(ctx,blob,time.Unix(ts,0))
+		if e!=nil {
+			if ctx.Err()!=nil { err = ctx.Err(); resp.Status(500); return }
+			skey,id = "",nil
+		}
+		plusbinary.WriteFrame(out,[]byte(skey))
+		plusbinary.WriteFrame(out,id)
+	}
+	err = nil
+	resp.Status(200)
+}
+
+// nextFrame reads a frame from r, which must be a reader over body, and
+// returns it as a sub-slice of body.
+func nextFrame(r *bytes.Reader, body []byte) ([]byte,error) {
+	l,err := binary.ReadUvarint(r)
+	if err!=nil { return nil,err }
+	pos := len(body)-r.Len()
+	if l>uint64(r.Len()) { return nil,io.ErrUnexpectedEOF }
+	r.Seek(int64(l),io.SeekCurrent)
+	return body[pos:pos+int(l)],nil
+}
+
+func (s *Server) getBatch(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	ctx,cancel := s.context(req,resp)
+	defer cancel()
+	span := trace.Start(ctx,"get-batch")
+	var err error
+	defer func() { span.Finish(s.Tracer,err) }()
+	
+	var node,id []byte
+	var tmp [binary.MaxVarintLen64]byte
+	r := bytes.NewReader(req.Body().B)
+	out := resp.Body()
+	buf := batchPool.Get()
+	defer batchPool.Put(buf)
+	limit := istorage.HeaderInt(req.GetHeaderK(istorage.HeaderBatchLimit))
+	for n := 0 ; r.Len()>0 ; n++ {
+		if n>=maxBatchItems { resp.Status(413); return }
+		if limit>0 && n>0 && out.Len()>=limit {
+			resp.SetIntHeader(istorage.HeaderBatchCount,n)
+			break
+		}
+		node,err = plusbinary.ReadFrame(r,node,maxBatchFrame)
+		if err!=nil { resp.Status(400); return }
+		id,err = plusbinary.ReadFrame(r,id,maxBatchFrame)
+		if err!=nil { resp.Status(400); return }
+		
+		buf.Reset()
+		meta,e := s.load(ctx,node,id,buf)
+		if e==nil { meta,e = negotiate(req,meta,buf) }
+		if e!=nil {
+			if ctx.Err()!=nil { err = ctx.Err(); resp.Status(500); return }
+			out.WriteByte(0)
+			continue
+		}
+		flags := uint64(batchFound)
+		if meta.HasSum { flags |= batchHasSum }
+		if meta.Size>0 && meta.Codec!=istorage.CodecLZ4 { flags |= batchCodec }
+		plusbinary.WriteUvarint(out,flags)
+		plusbinary.WriteUvarint(out,uint64(meta.Size))
+		if (flags&batchCodec)!=0 { plusbinary.WriteUvarint(out,uint64(meta.Codec)) }
+		if meta.HasSum {
+			binary.BigEndian.PutUint32(tmp[:4],meta.Sum)
+			out.Write(tmp[:4])
+		}
+		plusbinary.WriteFrame(out,buf.B)
+	}
+	err = nil
+	resp.Status(200)
+}
+
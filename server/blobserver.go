@@ -25,10 +25,23 @@ package server
 
 import "github.com/maxymania/blobserver/binascii"
 import "github.com/maxymania/blobserver/istorage"
+import "github.com/maxymania/blobserver/trace"
 import "github.com/byte-mug/gocom/notrest/route"
 import "github.com/byte-mug/gocom/notrest"
+import "github.com/valyala/bytebufferpool"
+import "context"
+import "encoding/hex"
+import "encoding/binary"
+import "errors"
+import "sync"
+import "sync/atomic"
 import "time"
 
+var errStoreFailed = errors.New("store failed")
+var errLoadFailed  = errors.New("load failed")
+var errNoStorage   = errors.New("no such storage")
+var errOffline     = errors.New("storage offline")
+
 func splitz(str []byte, sep byte) ([]byte,[]byte) {
 	for i,b := range str {
 		if b==sep { return str[:i],str[i+1:] }
@@ -37,63 +50,249 @@ func splitz(str []byte, sep byte) ([]byte,[]byte) {
 }
 
 type Server struct{
-	StorMap map[string]istorage.Storage
+	expiredAt int64 // Unix time, before which all days expired. Accessed atomically, first for alignment.
+	
+	// StorMap holds the storages. If nil, an empty one is created on first use.
+	StorMap *StorMap
+	
+	// Tracer receives one span per request and one per backend call.
+	// It may be nil.
+	Tracer  trace.Tracer
+	
+	// Placement chooses the storage for new blobs. If nil, MostFree is used.
+	Placement Placement
+	
+	// Forward resolves blobs, that were moved to another storage. It may be nil.
+	Forward *ForwardTable
+	
+	// Redirect makes GET answer 307 with the node and id headers of the new
+	// location of a forwarded blob, instead of serving it.
+	Redirect bool
+	
+	// Reload is called by "RELOAD /admin/reload". It may be nil.
+	Reload  func(ctx context.Context) error
+	
+	idem    idemCache
+	bg      sync.WaitGroup // Background work of requests, such as expiries.
+	smOnce  sync.Once
+}
+
+// stors returns s.StorMap, creating an empty one, if it is nil.
+func (s *Server) stors() *StorMap {
+	s.smOnce.Do(func() {
+		if s.StorMap==nil { s.StorMap = NewStorMap(nil) }
+	})
+	return s.StorMap
+}
+
+// context derives the context of a request from its trace-id, timeout-ms and
+// no-compress headers. A request without trace ID gets a fresh one. If the
+// connection is watched (see WatchConn), the context ends with it.
+func (s *Server) context(req *notrest.Request, resp *notrest.Response) (context.Context,context.CancelFunc) {
+	ctx := context.Background()
+	if base,ok := connBase.Load(req) ; ok { ctx = base.(context.Context) }
+	if id := req.GetHeaderK(trace.HeaderTraceID) ; len(id)>0 {
+		ctx = trace.WithID(ctx,string(id))
+	} else {
+		ctx = trace.Ensure(ctx)
+	}
+	resp.SetHeader([]byte(trace.HeaderTraceID),[]byte(trace.ID(ctx)))
+	if len(req.GetHeaderK(istorage.HeaderNoCompress))>0 { ctx = istorage.WithNoCompress(ctx) }
+	if ms := istorage.HeaderInt(req.GetHeaderK(trace.HeaderTimeout)) ; ms>0 {
+		return context.WithTimeout(ctx,time.Duration(ms)*time.Millisecond)
+	}
+	return context.WithCancel(ctx)
 }
 
 func (s *Server) WireUp(router *route.Router) {
 	router.POST("/blobs/*" ,s.postBlob)
 	router.GET ("/blobs/*" ,s.getBlob )
 	router.Method("EXPIRE","/expire/*",s.expire)
+	router.POST("/batch/*" ,s.postBatch)
+	router.Method("MGET","/batch/*",s.getBatch)
+	router.Method("STAT","/blobs/*",s.statBlob)
+	router.Method("LIST","/list/*",s.listBlobs)
+	router.Method("STATS","/admin/stats",s.stats)
+	router.Method("RELOAD","/admin/reload",s.reload)
+	router.Method("MODE","/admin/mode/*",s.setMode)
+	router.Method("FORWARD","/admin/forward",s.addForwards)
+	router.Method("GC","/admin/forward-gc",s.gcForwards)
+	router.Method("PURGE","/admin/purge/*",s.purgeDay)
 }
 
-func (s *Server) postBlob(req *notrest.Request, resp *notrest.Response, rest []byte) {
-	t := time.Unix(binascii.Signed(binascii.IntFromLe190(rest)),0)
-	var scap int64
-	var sobj istorage.Storage
-	var skey string
-	for k,v := range s.StorMap {
-		ca := v.FreeStorage()
-		if ca<scap { continue }
-		scap = ca
-		sobj = v
-		skey = k
+// store places blob on the storage chosen by the placement.
+func (s *Server) store(ctx context.Context, blob []byte, t time.Time) (skey string,id []byte,err error) {
+	place := s.Placement
+	if place==nil { place = MostFree }
+	skey,sobj := place(s.stors().Writable(),len(blob))
+	if sobj==nil { return "",nil,errNoStorage }
+	bspan := trace.Start(ctx,"store")
+	bspan.Node = hex.EncodeToString([]byte(skey))
+	id,ok := sobj.StoreBlob(ctx,blob,t)
+	if !ok {
+		err = ctx.Err()
+		if err==nil { err = errStoreFailed }
 	}
-	if sobj==nil {
-		resp.Status(500)
-		return
+	bspan.Finish(s.Tracer,err)
+	return
+}
+
+// load loads the blob id from the storage node into target.
+func (s *Server) load(ctx context.Context, node,id []byte, target *bytebufferpool.ByteBuffer) (meta istorage.Meta,err error) {
+	node,id,_ = s.resolve(node,id)
+	storage,ok := s.stors().Get(string(node))
+	if !ok {
+		if _,known := s.stors().All()[string(node)] ; known { return meta,errOffline }
+		return meta,errNoStorage
 	}
-	id,ok := sobj.StoreBlob(req.Body().B,t)
+	bspan := trace.Start(ctx,"load")
+	bspan.Node = hex.EncodeToString(node)
+	meta,ok = storage.LoadBlob(ctx,id,target)
 	if !ok {
+		err = ctx.Err()
+		if err==nil { err = errLoadFailed }
+	}
+	bspan.Finish(s.Tracer,err)
+	return
+}
+
+func (s *Server) postBlob(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	ctx,cancel := s.context(req,resp)
+	defer cancel()
+	span := trace.Start(ctx,"post")
+	var err error
+	defer func() { span.Finish(s.Tracer,err) }()
+	
+	ikey := req.GetHeaderK(istorage.HeaderIdempotencyKey)
+	var first *idemEntry
+	for len(ikey)>0 {
+		e,ok := s.idem.begin(ikey)
+		if ok { first = e; break }
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			resp.Status(500)
+			return
+		}
+		if e.ok {
+			resp.SetHeader([]byte("node"),e.node)
+			resp.SetHeader([]byte("id"),e.id)
+			resp.Status(204)
+			return
+		}
+		// The first request failed. Take over.
+	}
+	
+	t := time.Unix(binascii.Signed(binascii.IntFromLe190(rest)),0)
+	skey,id,err := s.store(ctx,req.Body().B,t)
+	if err!=nil {
+		s.idem.finish(ikey,first,nil,nil,false)
 		resp.Status(500)
 		return
 	}
-	resp.SetHeader([]byte("node"),binascii.EncodeLe190([]byte(skey),nil))
-	resp.SetHeader([]byte("id"),binascii.EncodeLe190(id,nil))
+	enode := binascii.EncodeLe190([]byte(skey),nil)
+	eid   := binascii.EncodeLe190(id,nil)
+	s.idem.finish(ikey,first,enode,eid,true)
+	resp.SetHeader([]byte("node"),enode)
+	resp.SetHeader([]byte("id"),eid)
 	resp.Status(204)
 }
 func (s *Server) getBlob(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	ctx,cancel := s.context(req,resp)
+	defer cancel()
+	span := trace.Start(ctx,"get")
+	var err error
+	defer func() { span.Finish(s.Tracer,err) }()
+	
 	A,B := splitz(rest,'/')
 	K,_ := binascii.DecodeLe190(A,nil)
-	storage,ok := s.StorMap[string(K)]
-	if !ok {
-		resp.Status(500)
-		return
+	I,_ := binascii.DecodeLe190(B,nil)
+	if s.Redirect {
+		if nK,nI,moved := s.resolve(K,I) ; moved {
+			resp.SetHeader([]byte("node"),binascii.EncodeLe190(nK,nil))
+			resp.SetHeader([]byte("id"),binascii.EncodeLe190(nI,nil))
+			resp.Status(307)
+			return
+		}
 	}
-	K,_ = binascii.DecodeLe190(B,K[:0])
-	lz4l,ok := storage.LoadBlob(K,resp.Body())
-	if !ok {
-		resp.Status(500)
+	meta,err := s.load(ctx,K,I,resp.Body())
+	if err==nil { meta,err = negotiate(req,meta,resp.Body()) }
+	if err!=nil {
+		if err==errOffline { resp.Status(503) } else { resp.Status(500) }
 		return
 	}
-	resp.SetIntHeader("lz4-size",lz4l)
+	if meta.Size==0 && gzipEncode(req,resp.Body()) { resp.SetHeader([]byte("content-encoding"),[]byte("gzip")) }
+	setMetaHeaders(resp,meta)
 	resp.Status(200)
 }
+
+// setMetaHeaders describes the payload in the codec, decoded-size and
+// content-crc32c headers. Clients, that predate codecs, only know lz4-size.
+func setMetaHeaders(resp *notrest.Response, meta istorage.Meta) {
+	if c := istorage.CodecByID(meta.Codec) ; meta.Size>0 && c!=nil {
+		resp.SetHeader([]byte("codec"),[]byte(c.Name))
+		resp.SetIntHeader("decoded-size",meta.Size)
+		if meta.Codec==istorage.CodecLZ4 { resp.SetIntHeader("lz4-size",meta.Size) }
+	}
+	if meta.HasSum {
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:],meta.Sum)
+		resp.SetHeader([]byte("content-crc32c"),[]byte(hex.EncodeToString(sum[:])))
+	}
+}
 func (s *Server) expire(req *notrest.Request, resp *notrest.Response, rest []byte) {
+	ctx,cancel := s.context(req,resp)
+	defer cancel()
 	t := time.Unix(binascii.Signed(binascii.IntFromLe190(rest)),0)
 	resp.Status(200)
-	for _,storage := range s.StorMap {
-		go storage.Expire(t)
+	
+	// Expiry runs in the background, beyond the lifetime of the request.
+	bg := trace.Detach(ctx)
+	var wg sync.WaitGroup
+	for k,storage := range s.stors().All() {
+		if !s.stors().Mode(k).Readable() { continue }
+		s.bg.Add(1)
+		wg.Add(1)
+		go func(k string, storage istorage.Storage) {
+			defer wg.Done()
+			s.expireOne(bg,k,storage,t)
+		}(k,storage)
 	}
+	
+	// Like the storages, drop the days up to and including that of t.
+	ex := t.UTC().Truncate(24*time.Hour).Add(24*time.Hour).Unix()
+	for {
+		old := atomic.LoadInt64(&s.expiredAt)
+		if old>=ex || atomic.CompareAndSwapInt64(&s.expiredAt,old,ex) { break }
+	}
+	if s.Forward==nil { return }
+	s.bg.Add(1)
+	go func() {
+		defer s.bg.Done()
+		wg.Wait()
+		s.gcForwardTable(bg)
+	}()
+}
+
+// gcForwardTable removes the forwarding entries of the days, that expired
+// since the server started, or before the last GC.
+func (s *Server) gcForwardTable(ctx context.Context) (n int,err error) {
+	span := trace.Start(ctx,"forward-gc")
+	defer func() { span.Finish(s.Tracer,err) }()
+	return s.Forward.GC(time.Unix(atomic.LoadInt64(&s.expiredAt),0))
+}
+
+// Wait waits for the background work, that requests started, such as
+// expiries. Call it after the listener stopped, before closing the storages.
+func (s *Server) Wait() { s.bg.Wait() }
+
+func (s *Server) expireOne(ctx context.Context, k string, storage istorage.Storage, t time.Time) {
+	defer s.bg.Done()
+	span := trace.Start(ctx,"expire")
+	span.Node = hex.EncodeToString([]byte(k))
+	storage.Expire(ctx,t)
+	span.Finish(s.Tracer,nil)
 }
 
 
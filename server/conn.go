@@ -0,0 +1,123 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package server
+
+import "github.com/byte-mug/gocom/notrest"
+import "context"
+import "net"
+import "sync"
+import "time"
+
+// connBase holds the context of the connection of each request in flight.
+var connBase sync.Map // *notrest.Request -> context.Context
+
+/*
+WatchConn wraps c and the handler, that serves it, so that the context of each
+request (see Server) is cancelled, when the client closes the connection
+before the response is written. While a request is handled, the connection is
+read in the background; a byte of a pipelined request is kept for the next
+Read.
+
+	wc,h := server.WatchConn(c,router)
+	notrest.ServeConn(wc,h)
+*/
+func WatchConn(c net.Conn, h notrest.Handler) (net.Conn,notrest.Handler) {
+	w := &watchConn{Conn:c}
+	return w,&watchHandler{w,h}
+}
+
+type watchConn struct{
+	net.Conn
+	mutex   sync.Mutex
+	stopped bool
+	done    chan struct{}
+	peek    []byte
+	err     error
+}
+
+func (w *watchConn) Read(b []byte) (int,error) {
+	if len(w.peek)>0 {
+		n := copy(b,w.peek)
+		w.peek = w.peek[n:]
+		return n,nil
+	}
+	if w.err!=nil { return 0,w.err }
+	return w.Conn.Read(b)
+}
+
+// watch reads the connection until stop. cancel is called, if it closes.
+func (w *watchConn) watch(cancel context.CancelFunc) {
+	w.stopped = false
+	w.done = make(chan struct{})
+	if len(w.peek)>0 || w.err!=nil { close(w.done); return }
+	go func() {
+		defer close(w.done)
+		var one [1]byte
+		for {
+			n,err := w.Conn.Read(one[:])
+			w.mutex.Lock()
+			if n>0 { w.peek = append(w.peek,one[0]) }
+			if ne,ok := err.(net.Error) ; ok && ne.Timeout() && n==0 {
+				// The idle deadline of the connection, or stop.
+				stopped := w.stopped
+				if !stopped { w.Conn.SetReadDeadline(time.Time{}) }
+				w.mutex.Unlock()
+				if stopped { return }
+				continue
+			}
+			if err!=nil {
+				w.err = err
+				cancel()
+			}
+			w.mutex.Unlock()
+			return
+		}
+	}()
+}
+
+// stop ends the background read and waits for it.
+func (w *watchConn) stop() {
+	w.mutex.Lock()
+	w.stopped = true
+	w.Conn.SetReadDeadline(time.Unix(1,0))
+	w.mutex.Unlock()
+	<-w.done
+	w.Conn.SetReadDeadline(time.Time{})
+}
+
+type watchHandler struct{
+	conn *watchConn
+	h    notrest.Handler
+}
+
+func (w *watchHandler) Handle(req *notrest.Request, resp *notrest.Response) {
+	ctx,cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connBase.Store(req,ctx)
+	defer connBase.Delete(req)
+	w.conn.watch(cancel)
+	defer w.conn.stop()
+	w.h.Handle(req,resp)
+}
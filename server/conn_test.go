@@ -0,0 +1,70 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package server
+
+import "github.com/byte-mug/gocom/notrest"
+import "net"
+import "testing"
+import "time"
+
+type handlerFunc func(req *notrest.Request, resp *notrest.Response)
+
+func (f handlerFunc) Handle(req *notrest.Request, resp *notrest.Response) { f(req,resp) }
+
+func TestWatchConnCancel(t *testing.T) {
+	srv,cli := net.Pipe()
+	defer srv.Close()
+	s := new(Server)
+	_,h := WatchConn(srv,handlerFunc(func(req *notrest.Request, resp *notrest.Response) {
+		ctx,cancel := s.context(req,resp)
+		defer cancel()
+		cli.Close()
+		select {
+		case <-ctx.Done():
+		case <-time.After(5*time.Second): t.Error("request not cancelled after the client closed")
+		}
+	}))
+	h.Handle(notrest.AckquireRequest(),notrest.AckquireResponse())
+}
+
+func TestWatchConnPipelined(t *testing.T) {
+	srv,cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	s := new(Server)
+	wc,h := WatchConn(srv,handlerFunc(func(req *notrest.Request, resp *notrest.Response) {
+		ctx,cancel := s.context(req,resp)
+		defer cancel()
+		cli.Write([]byte("x")) // Returns, once the watcher read it.
+		if ctx.Err()!=nil { t.Error("request cancelled by a pipelined request") }
+	}))
+	h.Handle(notrest.AckquireRequest(),notrest.AckquireResponse())
+	go cli.Write([]byte("y"))
+	b := make([]byte,2)
+	for _,want := range "xy" {
+		n,err := wc.Read(b)
+		if err!=nil || n!=1 || rune(b[0])!=want { t.Fatalf("read %q, %v; want %q",b[:n],err,want) }
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package server
+
+import "github.com/maxymania/blobserver/plusbinary"
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sync"
+import "time"
+
+// Forwarding chains longer than this are not followed.
+const maxForwardHops = 8
+
+type fwdEntry struct{
+	node,id []byte
+	day     int64 // Unix time of the day, the blob is filed under.
+}
+
+/*
+ForwardTable maps the node/id pairs of relocated blobs to their new location.
+
+The table is kept in memory and, if opened from a file, logged to it. The
+file is a sequence of records:
+	{ frame node, frame id, frame new-node, frame new-id, varint unix-time }
+A torn record at the end is cut off on open. GC rewrites the file, and keeps
+the time, before which it removed the entries, in path+".gc" as 8 bytes.
+Later GCs go on from there, even without a new EXPIRE after a restart.
+*/
+type ForwardTable struct{
+	mutex sync.RWMutex
+	m     map[string]fwdEntry
+	path  string
+	file  *os.File
+	w     *bufio.Writer
+	gc    int64 // Unix time, before which the entries were removed.
+}
+
+func fwdKey(node,id []byte) string {
+	var tmp [binary.MaxVarintLen64]byte
+	i := binary.PutUvarint(tmp[:],uint64(len(node)))
+	k := make([]byte,0,i+len(node)+len(id))
+	k = append(append(append(k,tmp[:i]...),node...),id...)
+	return string(k)
+}
+func splitFwdKey(k string) (node,id []byte) {
+	l,i := binary.Uvarint([]byte(k))
+	return []byte(k[i:i+int(l)]),[]byte(k[i+int(l):])
+}
+
+// NewForwardTable creates a table, that is not persisted.
+func NewForwardTable() *ForwardTable {
+	return &ForwardTable{m:make(map[string]fwdEntry)}
+}
+
+// OpenForwardTable loads the table from path, creating the file if needed.
+func OpenForwardTable(path string) (*ForwardTable,error) {
+	data,err := ioutil.ReadFile(path)
+	if err!=nil && !os.IsNotExist(err) { return nil,err }
+	f := NewForwardTable()
+	f.path = path
+	gc,err := ioutil.ReadFile(path+".gc")
+	if err!=nil && !os.IsNotExist(err) { return nil,err }
+	if len(gc)==8 { f.gc = int64(binary.BigEndian.Uint64(gc)) }
+	r := bytes.NewReader(data)
+	good := 0
+	for r.Len()>0 {
+		var rec [4][]byte
+		for i := range rec {
+			rec[i],err = plusbinary.ReadFrame(r,nil,maxBatchFrame)
+			if err!=nil { break }
+		}
+		if err!=nil { break }
+		day,err := plusbinary.ReadVarint(r)
+		if err!=nil { break }
+		f.m[fwdKey(rec[0],rec[1])] = fwdEntry{rec[2],rec[3],day}
+		good = len(data)-r.Len()
+	}
+	f.file,err = os.OpenFile(path,os.O_CREATE|os.O_WRONLY,0600)
+	if err!=nil { return nil,err }
+	if good<len(data) {
+		if err = f.file.Truncate(int64(good)) ; err!=nil { f.file.Close(); return nil,err }
+	}
+	if _,err = f.file.Seek(int64(good),0) ; err!=nil { f.file.Close(); return nil,err }
+	f.w = bufio.NewWriter(f.file)
+	return f,nil
+}
+
+// Lookup returns the new location of node/id, if it was relocated.
+func (f *ForwardTable) Lookup(node,id []byte) (nnode,nid []byte,ok bool) {
+	f.mutex.RLock(); defer f.mutex.RUnlock()
+	e,ok := f.m[fwdKey(node,id)]
+	return e.node,e.id,ok
+}
+
+// Add records, that the blob node/id of the given day now is nnode/nid.
+// Entries are written through to the file on Sync.
+func (f *ForwardTable) Add(node,id,nnode,nid []byte, day time.Time) error {
+	f.mutex.Lock(); defer f.mutex.Unlock()
+	e := fwdEntry{append([]byte(nil),nnode...),append([]byte(nil),nid...),day.Unix()}
+	f.m[fwdKey(node,id)] = e
+	if f.w==nil { return nil }
+	return writeFwd(f.w,node,id,e)
+}
+
+func writeFwd(w *bufio.Writer, node,id []byte, e fwdEntry) error {
+	plusbinary.WriteFrame(w,node)
+	plusbinary.WriteFrame(w,id)
+	plusbinary.WriteFrame(w,e.node)
+	plusbinary.WriteFrame(w,e.id)
+	return plusbinary.WriteVarint(w,e.day)
+}
+
+func (f *ForwardTable) Len() int {
+	f.mutex.RLock(); defer f.mutex.RUnlock()
+	return len(f.m)
+}
+
+// Sync flushes the added entries to stable storage.
+func (f *ForwardTable) Sync() error {
+	f.mutex.Lock(); defer f.mutex.Unlock()
+	if f.w==nil { return nil }
+	if err := f.w.Flush() ; err!=nil { return err }
+	return f.file.Sync()
+}
+
+/*
+GC removes the entries of blobs filed under days before t, or before the t of
+an earlier GC, if that is later. Once these days have expired on the
+storages, nobody can hold a valid reference to them anymore. The Server calls
+it after every EXPIRE request.
+
+The file is rewritten without the removed entries, before they are dropped
+from memory, so that a failed rewrite leaves the table as it was.
+*/
+func (f *ForwardTable) GC(t time.Time) (removed int,err error) {
+	f.mutex.Lock(); defer f.mutex.Unlock()
+	before := t.Unix()
+	if before<f.gc { before = f.gc }
+	for _,e := range f.m {
+		if e.day<before { removed++ }
+	}
+	if removed>0 && f.w!=nil {
+		if err = f.rewrite(before) ; err!=nil { return 0,err }
+	}
+	for k,e := range f.m {
+		if e.day<before { delete(f.m,k) }
+	}
+	if before>f.gc && f.path!="" {
+		if err = saveGC(f.path+".gc",before) ; err!=nil { return }
+	}
+	f.gc = before
+	return
+}
+
+// saveGC replaces the file fn with the Unix time before.
+func saveGC(fn string, before int64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],uint64(before))
+	tmp := fn+".tmp"
+	f,err := os.Create(tmp)
+	if err!=nil { return err }
+	_,err = f.Write(b[:])
+	if err==nil { err = f.Sync() }
+	if e := f.Close() ; err==nil { err = e }
+	if err==nil { err = os.Rename(tmp,fn) }
+	if err!=nil { os.Remove(tmp); return err }
+	if d,e := os.Open(filepath.Dir(fn)) ; e==nil { d.Sync(); d.Close() }
+	return nil
+}
+
+// rewrite replaces the file with the entries of days not before the given
+// Unix time. The caller holds f.mutex.
+func (f *ForwardTable) rewrite(before int64) (err error) {
+	tmp := f.path+".tmp"
+	nf,err := os.Create(tmp)
+	if err!=nil { return }
+	w := bufio.NewWriter(nf)
+	for k,e := range f.m {
+		if e.day<before { continue }
+		node,id := splitFwdKey(k)
+		if err = writeFwd(w,node,id,e) ; err!=nil { break }
+	}
+	if err==nil { err = w.Flush() }
+	if err==nil { err = nf.Sync() }
+	if err==nil { err = os.Rename(tmp,f.path) }
+	if err!=nil {
+		nf.Close()
+		os.Remove(tmp)
+		return
+	}
+	if d,e := os.Open(filepath.Dir(f.path)) ; e==nil { d.Sync(); d.Close() }
+	f.file.Close()
+	f.file,f.w = nf,bufio.NewWriter(nf)
+	return
+}
+
+func (f *ForwardTable) Close() error {
+	err := f.Sync()
+	f.mutex.Lock(); defer f.mutex.Unlock()
+	if f.file!=nil {
+		if e := f.file.Close() ; err==nil { err = e }
+		f.file,f.w = nil,nil
+	}
+	return err
+}
+
+// resolve follows the forwarding entries of node/id.
+func (s *Server) resolve(node,id []byte) (nnode,nid []byte,moved bool) {
+	nnode,nid = node,id
+	if s.Forward==nil { return }
+	for i := 0 ; i<maxForwardHops ; i++ {
+		n,d,ok := s.Forward.Lookup(nnode,nid)
+		if !ok { break }
+		nnode,nid,moved = n,d,true
+	}
+	return
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package server
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func fwdDir(t *testing.T) string {
+	dir,err := ioutil.TempDir("","forward")
+	if err!=nil { t.Fatal(err) }
+	return dir
+}
+
+func TestForwardTornTail(t *testing.T) {
+	dir := fwdDir(t)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir,"forward")
+	f,err := OpenForwardTable(fn)
+	if err!=nil { t.Fatal(err) }
+	day := time.Now().UTC().Truncate(24*time.Hour)
+	for _,id := range []string{"a","b","c"} {
+		if err = f.Add([]byte("n1"),[]byte(id),[]byte("n2"),[]byte(id+id),day) ; err!=nil { t.Fatal(err) }
+	}
+	if err = f.Close() ; err!=nil { t.Fatal(err) }
+	good,err := ioutil.ReadFile(fn)
+	if err!=nil { t.Fatal(err) }
+	// A record torn in the middle of its frames.
+	if err = ioutil.WriteFile(fn,append(good,good[:7]...),0600) ; err!=nil { t.Fatal(err) }
+	
+	f,err = OpenForwardTable(fn)
+	if err!=nil { t.Fatal(err) }
+	if n := f.Len() ; n!=3 { t.Fatalf("%d entries after reopen, want 3",n) }
+	if fi,err := os.Stat(fn) ; err!=nil || fi.Size()!=int64(len(good)) { t.Fatalf("torn tail not cut off: %v %v",fi.Size(),err) }
+	if err = f.Add([]byte("n1"),[]byte("d"),[]byte("n2"),[]byte("dd"),day) ; err!=nil { t.Fatal(err) }
+	f.Close()
+	f,err = OpenForwardTable(fn)
+	if err!=nil { t.Fatal(err) }
+	defer f.Close()
+	if n := f.Len() ; n!=4 { t.Fatalf("%d entries after appending to the cut file, want 4",n) }
+	if nn,nid,ok := f.Lookup([]byte("n1"),[]byte("d")) ; !ok || string(nn)!="n2" || string(nid)!="dd" { t.Fatalf("lookup: %q %q %v",nn,nid,ok) }
+}
+
+func TestForwardGC(t *testing.T) {
+	dir := fwdDir(t)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir,"forward")
+	f,err := OpenForwardTable(fn)
+	if err!=nil { t.Fatal(err) }
+	d2 := time.Now().UTC().Truncate(24*time.Hour)
+	d1 := d2.Add(-24*time.Hour)
+	d0 := d1.Add(-24*time.Hour)
+	for i,d := range []time.Time{d0,d1,d2} {
+		if err = f.Add([]byte("n1"),[]byte{byte(i)},[]byte("n2"),[]byte{byte(i)},d) ; err!=nil { t.Fatal(err) }
+	}
+	if err = f.Sync() ; err!=nil { t.Fatal(err) }
+	n,err := f.GC(d1)
+	if err!=nil || n!=1 { t.Fatalf("GC removed %d, %v; want 1",n,err) }
+	if _,_,ok := f.Lookup([]byte("n1"),[]byte{0}) ; ok { t.Fatal("entry of an expired day survived GC") }
+	// Added after the rewrite, to the new file.
+	if err = f.Add([]byte("n1"),[]byte{3},[]byte("n2"),[]byte{3},d2) ; err!=nil { t.Fatal(err) }
+	if err = f.Close() ; err!=nil { t.Fatal(err) }
+	
+	f,err = OpenForwardTable(fn)
+	if err!=nil { t.Fatal(err) }
+	defer f.Close()
+	if n := f.Len() ; n!=3 { t.Fatalf("%d entries after reopen, want 3",n) }
+	if _,_,ok := f.Lookup([]byte("n1"),[]byte{0}) ; ok { t.Fatal("the rewritten file holds a removed entry") }
+	// The cutoff of the last GC is remembered across the reopen.
+	if err = f.Add([]byte("n1"),[]byte{4},[]byte("n2"),[]byte{4},d0) ; err!=nil { t.Fatal(err) }
+	if n,err = f.GC(time.Unix(0,0)) ; err!=nil || n!=1 { t.Fatalf("GC after reopen removed %d, %v; want 1",n,err) }
+}
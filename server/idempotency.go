@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package server
+
+import "sync"
+import "time"
+
+const (
+	idemTTL = 10*time.Minute
+	idemMax = 1<<16
+)
+
+type idemEntry struct{
+	node,id []byte
+	at      time.Time
+	ok      bool
+	done    chan struct{} // Closed, once the first request finished.
+}
+
+// idemCache remembers the result of recent POSTs by their idempotency key,
+// so that a retried POST does not store the blob twice. A key is reserved
+// before the blob is stored; concurrent POSTs with the same key wait for
+// the result of the first one.
+type idemCache struct{
+	mutex sync.Mutex
+	m     map[string]*idemEntry
+}
+
+func (e *idemEntry) finished() bool {
+	select {
+	case <-e.done: return true
+	default: return false
+	}
+}
+
+// begin reserves key. If first is true, the caller must store the blob and
+// call finish. Otherwise e belongs to an earlier request; wait for e.done.
+// If the cache is full, begin returns nil,true and nothing is reserved.
+func (c *idemCache) begin(key []byte) (e *idemEntry,first bool) {
+	c.mutex.Lock(); defer c.mutex.Unlock()
+	if c.m==nil { c.m = make(map[string]*idemEntry) }
+	now := time.Now()
+	if e,ok := c.m[string(key)] ; ok {
+		if !e.finished() || now.Sub(e.at)<=idemTTL { return e,false }
+		delete(c.m,string(key))
+	}
+	if len(c.m)>=idemMax {
+		for k,e := range c.m {
+			if e.finished() && now.Sub(e.at)>idemTTL { delete(c.m,k) }
+		}
+		if len(c.m)>=idemMax { return nil,true }
+	}
+	e = &idemEntry{done:make(chan struct{})}
+	c.m[string(key)] = e
+	return e,true
+}
+
+// finish publishes the result of the request, that reserved e. If ok is
+// false, the reservation is dropped, so that a waiting request can retry.
+func (c *idemCache) finish(key []byte, e *idemEntry, node,id []byte, ok bool) {
+	if e==nil { return }
+	c.mutex.Lock()
+	e.node,e.id,e.at,e.ok = node,id,time.Now(),ok
+	if !ok && c.m[string(key)]==e { delete(c.m,string(key)) }
+	c.mutex.Unlock()
+	close(e.done)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package server
+
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/byte-mug/gocom/notrest"
+import "github.com/valyala/bytebufferpool"
+import "bytes"
+import "compress/gzip"
+
+/*
+Content negotiation of GET and MGET.
+
+The accept-codec request header lists the codecs (see istorage.Codecs), that
+the client decodes itself, separated by commas. Payloads in other codecs are
+decompressed by the server, so a client without the header receives plain
+blobs. The checksum headers always refer to the plain blob.
+
+GET additionally honors "accept-encoding: gzip": A plain blob is then sent
+gzip compressed, with "content-encoding: gzip", if it is worth it.
+*/
+
+// hasToken reports, whether the comma separated list h contains tok.
+func hasToken(h []byte, tok string) bool {
+	for len(h)>0 {
+		var e []byte
+		e,h = splitz(h,',')
+		if i := bytes.IndexByte(e,';') ; i>=0 { e = e[:i] } // Drop parameters, like ";q=1".
+		if string(bytes.TrimSpace(e))==tok { return true }
+	}
+	return false
+}
+
+// acceptsCodec reports, whether the client can decode payloads of meta.
+func acceptsCodec(req *notrest.Request, meta istorage.Meta) bool {
+	if meta.Size==0 { return true }
+	c := istorage.CodecByID(meta.Codec)
+	return c!=nil && hasToken(req.GetHeaderK(istorage.HeaderAcceptCodec),c.Name)
+}
+
+// negotiate converts the payload in body into a form, that the client of req
+// accepts. It returns the meta of the result.
+func negotiate(req *notrest.Request, meta istorage.Meta, body *bytebufferpool.ByteBuffer) (istorage.Meta,error) {
+	if acceptsCodec(req,meta) { return meta,nil }
+	tmp := batchPool.Get()
+	defer batchPool.Put(tmp)
+	blob,err := istorage.Unpack(meta,body.B,tmp.B[:0])
+	if err!=nil { return meta,err }
+	tmp.B = blob[:0] // Keep the larger buffer in the pool.
+	body.Set(blob)
+	meta.Codec,meta.Size = istorage.CodecNone,0
+	return meta,nil
+}
+
+// gzipEncode compresses the plain blob in body, if the client accepts gzip
+// and the blob is Compressible. It reports, whether it did.
+func gzipEncode(req *notrest.Request, body *bytebufferpool.ByteBuffer) bool {
+	if !hasToken(req.GetHeaderK("accept-encoding"),"gzip") || !istorage.Compressible(body.B) { return false }
+	tmp := batchPool.Get()
+	defer batchPool.Put(tmp)
+	w,_ := gzip.NewWriterLevel(tmp,gzip.BestSpeed)
+	w.Write(body.B)
+	if w.Close()!=nil || tmp.Len()>=body.Len() { return false }
+	body.Set(tmp.B)
+	return true
+}
@@ -0,0 +1,70 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package server
+
+import "github.com/maxymania/blobserver/istorage"
+import "math/rand"
+
+// Placement chooses the storage, that receives a new blob of the given size.
+// It returns nil, if no storage qualifies.
+type Placement func(stor map[string]istorage.Storage, size int) (string,istorage.Storage)
+
+// MostFree places every blob on the storage with the most free space.
+func MostFree(stor map[string]istorage.Storage, size int) (skey string,sobj istorage.Storage) {
+	var scap int64
+	for k,v := range stor {
+		ca := v.FreeStorage()
+		if ca<scap { continue }
+		scap = ca
+		sobj = v
+		skey = k
+	}
+	return
+}
+
+// WeightedFree picks a storage at random, weighted by its free space, so that
+// writes are spread over all disks, while they fill up evenly.
+func WeightedFree(stor map[string]istorage.Storage, size int) (string,istorage.Storage) {
+	var total int64
+	free := make(map[string]int64,len(stor))
+	for k,v := range stor {
+		ca := v.FreeStorage()
+		if ca<=int64(size) { continue }
+		free[k] = ca
+		total += ca
+	}
+	if total<=0 { return MostFree(stor,size) }
+	n := rand.Int63n(total)
+	for k,ca := range free {
+		if n<ca { return k,stor[k] }
+		n -= ca
+	}
+	return MostFree(stor,size)
+}
+
+// Placements maps the names of the built-in placements to them.
+var Placements = map[string]Placement{
+	"most_free"    : MostFree,
+	"weighted_free": WeightedFree,
+}
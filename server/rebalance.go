@@ -0,0 +1,210 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package server
+
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/valyala/bytebufferpool"
+import "bytes"
+import "context"
+import "errors"
+import "fmt"
+import "time"
+
+var errNoForward = errors.New("rebalance: server has no forward table")
+
+/*
+Rebalancer moves blobs from the fullest writable storage to the emptiest one,
+until their fill levels (used/(used+free)) differ by less than Threshold.
+
+Backends can't delete single blobs, so a whole day is moved at a time: the
+source is set read-only, every blob of the day is copied and verified, its
+new location is recorded in the Server's ForwardTable, and the day is dropped
+from the source. Only storages implementing istorage.Walker and
+istorage.DayDropper are used as source, and no istorage.Volatile storage as
+destination. The current day is never moved, nor a day, whose move would tip
+the balance to the other side.
+*/
+type Rebalancer struct{
+	Server    *Server
+	Threshold float64       // Minimum difference of fill levels, 0.1 if 0.
+	Rate      int64         // Bytes per second to copy, unlimited if 0.
+	Grace     time.Duration // Wait for writes in flight, after the source became read-only.
+	Log       istorage.Logger
+}
+
+type fillLevel struct{
+	key   string
+	st    istorage.Storage
+	used  int64
+	total int64
+	level float64
+}
+
+// Run calls Step every interval, until ctx is done.
+func (r *Rebalancer) Run(ctx context.Context, interval time.Duration) {
+	log := istorage.OrNop(r.Log)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done(): return
+		case <-t.C:
+		}
+		for {
+			moved,err := r.Step(ctx)
+			if err!=nil && ctx.Err()==nil { log.Log("event","rebalance_failed","err",err) }
+			if err!=nil || !moved { break }
+		}
+	}
+}
+
+func (r *Rebalancer) pick() (src,dst *fillLevel) {
+	for k,st := range r.Server.stors().Writable() {
+		ur,ok := st.(istorage.UsageReporter)
+		if !ok { continue }
+		used := ur.UsedStorage()
+		total := used+st.FreeStorage()
+		if total<=0 { continue }
+		f := &fillLevel{k,st,used,total,float64(used)/float64(total)}
+		if v,ok := st.(istorage.Volatile) ; !ok || !v.Volatile() {
+			if dst==nil || f.level<dst.level { dst = f }
+		}
+		if _,ok := st.(istorage.Walker) ; !ok { continue }
+		if _,ok := st.(istorage.DayDropper) ; !ok { continue }
+		if src==nil || f.level>src.level { src = f }
+	}
+	return
+}
+
+// Step moves one day, if the storages are out of balance. It returns true,
+// if something was moved.
+func (r *Rebalancer) Step(ctx context.Context) (moved bool,err error) {
+	if r.Server.Forward==nil { return false,errNoForward }
+	thr := r.Threshold
+	if thr<=0 { thr = 0.1 }
+	src,dst := r.pick()
+	if src==nil || dst==nil || src.key==dst.key || src.level-dst.level<thr { return false,nil }
+	
+	today := time.Now().UTC().Truncate(24*time.Hour)
+	days := make(map[time.Time]int64)
+	var blobs int64
+	err = src.st.(istorage.Walker).WalkBlobs(ctx,func(key []byte, d time.Time) error {
+		blobs++
+		if d.Before(today) { days[d]++ }
+		return nil
+	})
+	if err!=nil { return false,err }
+	
+	// Take the newest day, whose estimated size doesn't overshoot the balance,
+	// otherwise the next Step would move it back.
+	var day time.Time
+	for d,n := range days {
+		if !d.After(day) { continue }
+		size := float64(src.used)*float64(n)/float64(blobs)
+		s := (float64(src.used)-size)/float64(src.total)
+		t := (float64(dst.used)+size)/float64(dst.total)
+		if t-s < src.level-dst.level { day = d }
+	}
+	if day.IsZero() { return false,nil }
+	
+	err = r.moveDay(ctx,src,dst,day)
+	return err==nil,err
+}
+
+func (r *Rebalancer) moveDay(ctx context.Context, src,dst *fillLevel, day time.Time) (err error) {
+	log := istorage.OrNop(r.Log)
+	sm := r.Server.stors()
+	if sm.CompareAndSetMode(src.key,istorage.ReadWrite,istorage.ReadOnly) {
+		// An operator may have changed the mode meanwhile; that change stays.
+		defer sm.CompareAndSetMode(src.key,istorage.ReadOnly,istorage.ReadWrite)
+		if r.Grace>0 {
+			select {
+			case <-ctx.Done(): return ctx.Err()
+			case <-time.After(r.Grace):
+			}
+		}
+	}
+	
+	start := time.Now()
+	th := throttle{rate:r.Rate,start:start}
+	buf,vbuf := bytebufferpool.Get(),bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+	defer bytebufferpool.Put(vbuf)
+	var ubuf,vubuf []byte
+	done := make(map[string]bool)
+	var blobs,size int64
+	
+	copyBlob := func(key []byte, d time.Time) error {
+		if !d.Equal(day) || done[string(key)] { return nil }
+		buf.Reset()
+		meta,ok := src.st.LoadBlob(ctx,key,buf)
+		if !ok { return fmt.Errorf("rebalance: %q: can't load blob",src.key) }
+		blob,err := istorage.Unpack(meta,buf.B,ubuf)
+		if err!=nil { return fmt.Errorf("rebalance: %q: %v",src.key,err) }
+		if meta.Size>0 { ubuf = blob[:0] }
+		nkey,ok := dst.st.StoreBlob(ctx,blob,day)
+		if !ok { return fmt.Errorf("rebalance: %q: can't store blob",dst.key) }
+		vbuf.Reset()
+		meta,ok = dst.st.LoadBlob(ctx,nkey,vbuf)
+		if !ok { return fmt.Errorf("rebalance: %q: can't reload blob",dst.key) }
+		check,err := istorage.Unpack(meta,vbuf.B,vubuf)
+		if err!=nil { return fmt.Errorf("rebalance: %q: %v",dst.key,err) }
+		if meta.Size>0 { vubuf = check[:0] }
+		if !bytes.Equal(blob,check) { return fmt.Errorf("rebalance: %q: copy differs",dst.key) }
+		if err = r.Server.Forward.Add([]byte(src.key),key,[]byte(dst.key),nkey,day) ; err!=nil { return err }
+		done[string(key)] = true
+		blobs++
+		size += int64(len(blob))
+		return th.wait(ctx,len(buf.B))
+	}
+	walker := src.st.(istorage.Walker)
+	// The second pass picks up blobs, that were written late.
+	for pass := 0 ; pass<2 ; pass++ {
+		if err = walker.WalkBlobs(ctx,copyBlob) ; err!=nil { break }
+	}
+	if e := r.Server.Forward.Sync() ; err==nil { err = e }
+	if err!=nil { return }
+	
+	if err = src.st.(istorage.DayDropper).DropDay(ctx,day) ; err!=nil { return }
+	log.Log("event","rebalanced","from",src.key,"to",dst.key,"day",day.Format("2006-01-02"),"blobs",blobs,"bytes",size,"took",time.Since(start))
+	return nil
+}
+
+// throttle limits the average throughput to rate bytes per second.
+type throttle struct{
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t.rate<=0 { return nil }
+	t.bytes += int64(n)
+	d := time.Duration(t.bytes*int64(time.Second)/t.rate) - time.Since(t.start)
+	if d<=0 { return nil }
+	select {
+	case <-ctx.Done(): return ctx.Err()
+	case <-time.After(d): return nil
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package server
+
+import "github.com/maxymania/blobserver/istorage"
+import "sync"
+import "sync/atomic"
+
+type storSnap struct{
+	all      map[string]istorage.Storage
+	writable map[string]istorage.Storage
+	modes    map[string]istorage.Mode
+	drained  map[string]int64 // Used bytes, when draining began.
+}
+
+/*
+StorMap holds the storages of a server and their modes. Readers get
+immutable snapshots, writers replace them as a whole, so that requests never
+block on a reload.
+*/
+type StorMap struct{
+	mutex sync.Mutex // Serializes writers.
+	snap  atomic.Value // *storSnap
+}
+
+func NewStorMap(m map[string]istorage.Storage) *StorMap {
+	s := new(StorMap)
+	s.swap(m,nil,nil)
+	return s
+}
+
+func (s *StorMap) load() *storSnap {
+	sn,_ := s.snap.Load().(*storSnap)
+	if sn==nil { return &storSnap{} }
+	return sn
+}
+
+// swap installs a new snapshot. The caller holds s.mutex or owns s.
+func (s *StorMap) swap(all map[string]istorage.Storage, modes map[string]istorage.Mode, drained map[string]int64) {
+	sn := &storSnap{all:all,writable:make(map[string]istorage.Storage,len(all)),modes:modes,drained:drained}
+	for k,v := range all {
+		if modes[k].Writable() { sn.writable[k] = v }
+	}
+	s.snap.Store(sn)
+}
+
+// All returns all storages, regardless of their mode. The map must not be modified.
+func (s *StorMap) All() map[string]istorage.Storage { return s.load().all }
+
+// Writable returns the storages, that accept new blobs. The map must not be modified.
+func (s *StorMap) Writable() map[string]istorage.Storage { return s.load().writable }
+
+// Get returns the storage key, unless it is unknown or offline.
+func (s *StorMap) Get(key string) (istorage.Storage,bool) {
+	sn := s.load()
+	st,ok := sn.all[key]
+	if !ok || !sn.modes[key].Readable() { return nil,false }
+	return st,true
+}
+
+// Mode returns the mode of storage key; unknown storages are offline.
+func (s *StorMap) Mode(key string) istorage.Mode {
+	sn := s.load()
+	if _,ok := sn.all[key] ; !ok { return istorage.Offline }
+	return sn.modes[key]
+}
+
+// DrainProgress reports, which fraction of the data of a draining storage
+// is gone. ok is false, if the storage isn't draining or can't tell.
+func (s *StorMap) DrainProgress(key string) (progress float64,ok bool) {
+	sn := s.load()
+	start,ok := sn.drained[key]
+	if !ok || sn.modes[key]!=istorage.Draining { return 0,false }
+	ur,ok := sn.all[key].(istorage.UsageReporter)
+	if !ok { return 0,false }
+	if start<=0 { return 1,true }
+	progress = 1-float64(ur.UsedStorage())/float64(start)
+	if progress<0 { progress = 0 }
+	return progress,true
+}
+
+// Update calls fn with copies of the current maps and installs the result.
+// Modes of absent storages are dropped.
+func (s *StorMap) Update(fn func(all map[string]istorage.Storage, modes map[string]istorage.Mode)) {
+	s.mutex.Lock(); defer s.mutex.Unlock()
+	old := s.load()
+	all   := make(map[string]istorage.Storage,len(old.all))
+	modes := make(map[string]istorage.Mode,len(old.modes))
+	for k,v := range old.all { all[k] = v }
+	for k,v := range old.modes { modes[k] = v }
+	fn(all,modes)
+	drained := make(map[string]int64)
+	for k,m := range modes {
+		if _,ok := all[k] ; !ok {
+			delete(modes,k)
+			continue
+		}
+		if m!=istorage.Draining { continue }
+		if u,ok := old.drained[k] ; ok && old.modes[k]==istorage.Draining {
+			drained[k] = u
+		} else if ur,ok := all[k].(istorage.UsageReporter) ; ok {
+			drained[k] = ur.UsedStorage()
+		}
+	}
+	s.swap(all,modes,drained)
+}
+
+func (s *StorMap) Add(key string, st istorage.Storage, mode istorage.Mode) {
+	s.Update(func(all map[string]istorage.Storage, modes map[string]istorage.Mode) {
+		all[key] = st
+		modes[key] = mode
+	})
+}
+func (s *StorMap) Remove(key string) {
+	s.Update(func(all map[string]istorage.Storage, modes map[string]istorage.Mode) { delete(all,key) })
+}
+
+// SetMode changes the mode of storage key. It returns false, if key is unknown.
+func (s *StorMap) SetMode(key string, mode istorage.Mode) (ok bool) {
+	s.Update(func(all map[string]istorage.Storage, modes map[string]istorage.Mode) {
+		if _,ok = all[key] ; ok { modes[key] = mode }
+	})
+	return
+}
+
+// CompareAndSetMode changes the mode of storage key to mode, if it is old.
+// It returns false, if key is unknown or has another mode.
+func (s *StorMap) CompareAndSetMode(key string, old, mode istorage.Mode) (ok bool) {
+	s.Update(func(all map[string]istorage.Storage, modes map[string]istorage.Mode) {
+		_,ok = all[key]
+		ok = ok && modes[key]==old
+		if ok { modes[key] = mode }
+	})
+	return
+}
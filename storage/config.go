@@ -25,17 +25,24 @@ package storage
 
 import "github.com/maxymania/blobserver/istorage"
 import "github.com/lytics/confl"
+import "github.com/tideland/golib/identifier"
 import "io/ioutil"
 import "path/filepath"
 import "fmt"
+import "os"
+import "encoding/hex"
+import "sort"
+import "io"
+import "strings"
 
 
 type Size struct{
 	K,M,G,T,P uint16
+	Bytes     int64
 }
 func (s *Size) Int64() int64 {
 	if s==nil { return 0 }
-	i := int64(0)
+	i := s.Bytes
 	i += int64(s.K)<<10
 	i += int64(s.M)<<20
 	i += int64(s.G)<<30
@@ -46,36 +53,276 @@ func (s *Size) Int64() int64 {
 
 type StorageConfig struct {
 	Method    string   `confl:"method"`
-	Capacity  *Size    `confl:"capacity"`
+	
+	// In the file, the capacity is either a string like "500GiB" or "2TB",
+	// or a table like { G: 500 }. It is decoded into Capacity on load.
+	RawCapacity interface{} `confl:"capacity"`
+	Capacity  *Size    `confl:"-"`
 	
 	Options   []string `confl:"options"`
 	
+	// Mode is one of "read-write" (the default), "read-only", "draining"
+	// and "offline". See istorage.Mode.
+	Mode      string   `confl:"mode"`
+	
+	// Codec names the compression of new blobs, see istorage.Codecs.
+	// The default is "lz4". Blobs are readable regardless of the codec.
+	Codec     string   `confl:"codec"`
+	
+	// Keyfile enables encryption at rest, see istorage.LoadKeyring. A relative
+	// path is resolved against the configuration directory. The keys are
+	// loaded into Keys on validation.
+	Keyfile   string   `confl:"keyfile"`
+	Keys      *istorage.Keyring `confl:"-"`
+	
+	// DayKeys seals each day with a key of its own, that is destroyed, when
+	// the day expires. It requires a keyfile, see istorage.DayKeys.
+	DayKeys   bool     `confl:"day_keys"`
+	
+	// ReadOnly makes the loader open the storage without creating, writing or
+	// replaying anything; it fails, where it would have to. Writes to such a
+	// storage fail. Tools set it for their sources, it is not read from files.
+	ReadOnly  bool     `confl:"-"`
+	
 	// File-Based special
 	MaxOpenFiles int   `confl:"max_open"`
 }
 
-type BackendLoader func(path string, cfg *StorageConfig) (string,istorage.Storage,error)
+// GetCodec returns the configured codec, or istorage.DefaultCodec.
+func (v *StorageConfig) GetCodec() *istorage.Codec {
+	if c,ok := istorage.Codecs[v.Codec] ; ok { return c }
+	return istorage.DefaultCodec
+}
+
+// Sealer returns the Sealer of the storage at path: nil, if it is not
+// encrypted, the DayKeys of the storage, if DayKeys is set or the storage has
+// a key store already, or else Keys.
+func (v *StorageConfig) Sealer(path string) (istorage.Sealer,*istorage.DayKeys,error) {
+	if v.Keys==nil { return nil,nil,nil }
+	fn := filepath.Join(path,"daykeys")
+	if !v.DayKeys || v.ReadOnly {
+		if _,err := os.Stat(fn) ; err!=nil { return v.Keys,nil,nil }
+	}
+	open := istorage.OpenDayKeys
+	if v.ReadOnly { open = istorage.ReadDayKeys }
+	dk,err := open(fn,v.Keys)
+	if err!=nil { return nil,nil,err }
+	return dk,dk,nil
+}
+
+// UUID returns the UUID of the storage at path, see GetOrCreateUUID. With
+// ReadOnly, a storage without one is an error.
+func (v *StorageConfig) UUID(path string, logger istorage.Logger) (identifier.UUID,error) {
+	if !v.ReadOnly { return GetOrCreateUUID(path,logger) }
+	uuid,ok := ReadUUID(path)
+	if !ok { return uuid,fmt.Errorf("%s: no readable id.conf",path) }
+	return uuid,nil
+}
+
+// BackendSpec describes the configuration, that a backend understands.
+type BackendSpec struct{
+	Options  []string // Recognized strings in StorageConfig.Options.
+	Capacity bool     // A capacity is required.
+	Disk     bool     // The capacity is taken from the filesystem of the path.
+	MaxOpen  bool     // max_open is used.
+	Seal     bool     // Records can be encrypted, a keyfile is accepted.
+}
+
+// Specs holds the BackendSpec of each backend. Backends without one are not
+// validated beyond their method.
+var  Specs = make(map[string]*BackendSpec)
+
+// ConfigError lists all problems found in storage configurations.
+type ConfigError struct{
+	Problems []string
+}
+func (c *ConfigError) Error() string {
+	return "invalid storage configuration:\n\t"+strings.Join(c.Problems,"\n\t")
+}
+
+type BackendLoader func(path string, cfg *StorageConfig, logger istorage.Logger) (string,istorage.Storage,error)
 
 var  Backends = make(map[string]BackendLoader)
 
-func LoadStorage(file string) (map[string]istorage.Storage,error) {
-	cfg := make(map[string]*StorageConfig)
-	store,err := ioutil.ReadFile(filepath.Join(file,"storage.conf"))
-	if err!=nil { return nil,err }
-	err = confl.Unmarshal(store, cfg)
+// LoadStorage opens the storages listed in the storage.conf file of the
+// directory file. Relative storage paths are resolved against that directory.
+func LoadStorage(file string, logger istorage.Logger) (map[string]istorage.Storage,error) {
+	return LoadStorages(logger,file)
+}
+
+// An Entry is one storage of a configuration.
+type Entry struct{
+	Path   string // Absolute, or relative to the working directory.
+	Dir    string // The configuration directory.
+	Config *StorageConfig
+}
+
+// LoadStorages is like LoadStorage, for several configuration directories.
+// Each root may be a glob pattern, such as "/mnt/disk*/blobs". A storage UUID,
+// that shows up in more than one directory, is an error.
+//
+// All configurations are read and validated, before any storage is opened.
+// If a storage fails to open, the ones opened already are closed again.
+func LoadStorages(logger istorage.Logger, roots ...string) (map[string]istorage.Storage,error) {
+	logger = istorage.OrNop(logger)
+	entries,err := ReadConfigs(logger,roots...)
 	if err!=nil { return nil,err }
 	
 	nm := make(map[string]istorage.Storage)
-	for _,v := range cfg {
-		_,ok := Backends[v.Method]
-		if !ok { return nil,fmt.Errorf("No such method: %q",v.Method) }
+	where := make(map[string]string)
+	var opened []istorage.Storage
+	fail := func(err error) (map[string]istorage.Storage,error) {
+		for _,st := range opened {
+			if c,ok := st.(io.Closer) ; ok { c.Close() }
+		}
+		return nil,err
 	}
-	for k,v := range cfg {
-		key,iss,err := Backends[v.Method](k,v)
-		if err!=nil { return nil,err }
+	for _,e := range entries {
+		key,iss,err := OpenEntry(e,logger)
+		if err!=nil { return fail(err) }
+		opened = append(opened,iss)
+		if prev,ok := where[key] ; ok {
+			// Only storages, that had no UUID before, get here.
+			logger.Log("event","duplicate_uuid","node",hex.EncodeToString([]byte(key)),"path",e.Path,"first",prev)
+			return fail(fmt.Errorf("storage %s in %s has the same UUID as %s",e.Path,e.Dir,prev))
+		}
 		nm[key] = iss
+		where[key] = e.Path
 	}
 	return nm,nil
 }
 
+// ReadConfigs reads and validates the configurations of all roots, without
+// opening any storage. Validation problems are returned as *ConfigError.
+func ReadConfigs(logger istorage.Logger, roots ...string) ([]Entry,error) {
+	logger = istorage.OrNop(logger)
+	var entries []Entry
+	cerr := new(ConfigError)
+	for _,root := range roots {
+		dirs,err := filepath.Glob(root)
+		if err!=nil {
+			logger.Log("event","config_error","root",root,"err",err)
+			return nil,err
+		}
+		if len(dirs)==0 {
+			logger.Log("event","config_error","root",root,"err","no match")
+			return nil,fmt.Errorf("%s: no such storage root",root)
+		}
+		for _,dir := range dirs {
+			es,err := readRoot(dir,cerr)
+			if err!=nil {
+				logger.Log("event","config_error","file",dir,"err",err)
+				return nil,err
+			}
+			entries = append(entries,es...)
+		}
+	}
+	checkUUIDs(entries,cerr)
+	if len(cerr.Problems)>0 {
+		for _,p := range cerr.Problems { logger.Log("event","config_error","problem",p) }
+		return nil,cerr
+	}
+	return entries,nil
+}
+
+// checkUUIDs adds a problem to cerr for every storage, that has the UUID of
+// an earlier one, such as a copied directory, or one listed twice.
+func checkUUIDs(entries []Entry, cerr *ConfigError) {
+	where := make(map[identifier.UUID]string)
+	for _,e := range entries {
+		uuid,ok := ReadUUID(e.Path)
+		if !ok { continue } // A fresh one is created on open.
+		if prev,dup := where[uuid] ; dup {
+			cerr.Problems = append(cerr.Problems,fmt.Sprintf("%s: storage %s has the same UUID as %s",e.Dir,e.Path,prev))
+			continue
+		}
+		where[uuid] = e.Path
+	}
+}
+
+// OpenEntry opens the storage of e and returns its UUID key.
+func OpenEntry(e Entry, logger istorage.Logger) (string,istorage.Storage,error) {
+	bl := istorage.With(logger,"backend",e.Config.Method,"path",e.Path)
+	key,iss,err := Backends[e.Config.Method](e.Path,e.Config,bl)
+	if err!=nil {
+		bl.Log("event","open_failed","err",err)
+		return "",nil,err
+	}
+	bl.Log("event","loaded","node",hex.EncodeToString([]byte(key)),"free",iss.FreeStorage())
+	return key,iss,nil
+}
+
+// readRoot reads the storage.conf of the directory file and adds the
+// problems of its entries to cerr.
+func readRoot(file string, cerr *ConfigError) ([]Entry,error) {
+	cfg := make(map[string]*StorageConfig)
+	fn := filepath.Join(file,"storage.conf")
+	store,err := ioutil.ReadFile(fn)
+	if err!=nil { return nil,err }
+	err = confl.Unmarshal(store, cfg)
+	if err!=nil { return nil,err }
+	
+	keys := make([]string,0,len(cfg))
+	for k := range cfg { keys = append(keys,k) }
+	sort.Strings(keys)
+	entries := make([]Entry,0,len(keys))
+	for _,k := range keys {
+		path := k
+		if !filepath.IsAbs(path) { path = filepath.Join(file,path) }
+		if kf := cfg[k].Keyfile ; kf!="" && !filepath.IsAbs(kf) { cfg[k].Keyfile = filepath.Join(file,kf) }
+		validate(cfg[k],path,func(key, format string, args ...interface{}) {
+			cerr.Problems = append(cerr.Problems,fmt.Sprintf("%s: %q.%s: ",fn,k,key)+fmt.Sprintf(format,args...))
+		})
+		entries = append(entries,Entry{path,file,cfg[k]})
+	}
+	return entries,nil
+}
+
+func validate(v *StorageConfig, path string, problem func(key, format string, args ...interface{})) {
+	if _,ok := Backends[v.Method] ; !ok {
+		problem("method","no such method: %q",v.Method)
+		return
+	}
+	if _,err := istorage.ParseMode(v.Mode) ; err!=nil { problem("mode","%v",err) }
+	if _,ok := istorage.Codecs[v.Codec] ; v.Codec!="" && !ok {
+		problem("codec","unknown codec %q, expected one of %s",v.Codec,strings.Join(istorage.CodecNames(),", "))
+	}
+	size,err := sizeOf(v.RawCapacity)
+	if err!=nil {
+		problem("capacity","%v",err)
+	} else if size!=nil {
+		v.Capacity = size
+	}
+	spec := Specs[v.Method]
+	if v.Keyfile!="" {
+		if spec==nil || !spec.Seal {
+			problem("keyfile","method %q doesn't support encryption",v.Method)
+		} else if keys,err := istorage.LoadKeyring(v.Keyfile) ; err!=nil {
+			problem("keyfile","%v",err)
+		} else {
+			v.Keys = keys
+		}
+	} else if v.DayKeys {
+		problem("day_keys","requires a keyfile")
+	}
+	if spec==nil { return }
+	
+	for _,o := range v.Options {
+		known := false
+		for _,so := range spec.Options { known = known || o==so }
+		if !known { problem("options","unknown option %q for method %q",o,v.Method) }
+	}
+	if spec.MaxOpen && v.MaxOpenFiles<=0 { problem("max_open","must be positive, is %d",v.MaxOpenFiles) }
+	if spec.Capacity && err==nil {
+		c := v.Capacity.Int64()
+		if c<=0 { problem("capacity","missing or zero; method %q needs a capacity",v.Method) }
+		if spec.Disk && c>0 {
+			if fs,err := filesystemSize(path) ; err!=nil {
+				problem("capacity","can't determine the size of the filesystem: %v",err)
+			} else if fs>0 && c>fs {
+				problem("capacity","%d bytes exceed the filesystem size of %d bytes",c,fs)
+			}
+		}
+	}
+}
 
@@ -0,0 +1,495 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Package conformance checks, whether a storage backend honors the
+istorage.Storage contract. Backends differ in what they support (clldb expires
+only with day keys, memory does not persist), so every check, that depends on
+an optional feature, is controlled by Options.
+*/
+package conformance
+
+import "github.com/maxymania/blobserver/storage"
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/valyala/bytebufferpool"
+import "bytes"
+import "context"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "math/rand"
+import "os"
+import "path/filepath"
+import "sync"
+import "testing"
+import "time"
+
+// Options describe the optional features of a backend.
+type Options struct{
+	Expires  bool // Expire removes the blobs of expired days.
+	Barrier  bool // StoreBlob refuses days, that have already been expired.
+	Capacity bool // FreeStorage is derived from cfg.Capacity.
+	Reopen   bool // Blobs and UUID survive loading the same directory again.
+	Seal     bool // Records are sealed with a keyfile, or with day keys.
+}
+
+// Profiles tell, what each built-in backend is expected to support.
+var Profiles = map[string]Options{
+	"dayfile": {Expires:true ,Barrier:true ,Capacity:true ,Reopen:true ,Seal:true },
+	"basedb" : {Expires:true ,Barrier:true ,Capacity:true ,Reopen:true ,Seal:true },
+	"clldb"  : {Expires:false,Barrier:false,Capacity:false,Reopen:true ,Seal:true },
+	"memory" : {Expires:true ,Barrier:true ,Capacity:true ,Reopen:false,Seal:false},
+}
+
+// Result is the outcome of a single check. Err is nil on success.
+type Result struct{
+	Name string
+	Err  error
+}
+
+type suite struct{
+	method string
+	loader storage.BackendLoader
+	mkdir  func() (string,error)
+	opts   Options
+	cfg    *storage.StorageConfig
+	keydir string // Holds the keyfiles, if cfg.Keys is set.
+}
+
+const capacity = 1<<30
+
+// Run runs every check against loader. mkdir must return a fresh, empty
+// directory on every call. If opts.Seal is set, the checks run again with a
+// keyfile, and with day keys; their names start with "keyfile/" and
+// "daykeys/" then.
+func Run(method string, loader storage.BackendLoader, mkdir func() (string,error), opts Options) []Result {
+	s := &suite{method:method,loader:loader,mkdir:mkdir,opts:opts}
+	s.cfg = &storage.StorageConfig{Method:method,Capacity:&storage.Size{G:capacity>>30},MaxOpenFiles:16}
+	res := s.run("")
+	if !opts.Seal { return res }
+	keydir,err := mkdir()
+	var keys *istorage.Keyring
+	if err==nil { keys,err = keyfile(keydir,"keyfile",1) }
+	if err!=nil { return append(res,Result{"keyfile",err}) }
+	for _,dayKeys := range []bool{false,true} {
+		ks := *s
+		cfg := *s.cfg
+		cfg.Keys,cfg.DayKeys = keys,dayKeys
+		ks.cfg,ks.keydir = &cfg,keydir
+		prefix := "keyfile/"
+		if dayKeys { prefix = "daykeys/" }
+		res = append(res,ks.run(prefix)...)
+	}
+	return res
+}
+
+func (s *suite) run(prefix string) []Result {
+	checks := []struct{
+		name string
+		fn   func() error
+	}{
+		{"roundtrip/empty"         ,func() error { return s.roundtrip(nil) }},
+		{"roundtrip/small"         ,func() error { return s.roundtrip([]byte("hello, blobserver")) }},
+		{"roundtrip/incompressible",func() error { return s.roundtrip(random(4096)) }},
+		{"roundtrip/multichunk"    ,func() error { return s.roundtrip(compressible(300<<10)) }},
+		{"roundtrip/multichunk-raw",func() error { return s.roundtrip(random(200<<10)) }},
+		{"expiry"                  ,s.expiry},
+		{"concurrency"             ,s.concurrency},
+		{"capacity"                ,s.capacity},
+		{"reopen"                  ,s.reopen},
+		{"reopen/read-only"        ,s.readOnly},
+	}
+	if s.cfg.Keys!=nil {
+		checks = append(checks,[]struct{
+			name string
+			fn   func() error
+		}{
+			{"sealed/at-rest" ,s.atRest},
+			{"sealed/rotation",s.rotation},
+			{"sealed/shred"   ,s.shred},
+		}...)
+	}
+	res := make([]Result,0,len(checks))
+	for _,c := range checks {
+		res = append(res,Result{prefix+c.name,protect(c.fn)})
+	}
+	return res
+}
+
+// Test runs every check against the registered backend method, with its
+// entry of Profiles, as subtests of t. Backends call it from their tests.
+func Test(t *testing.T, method string) {
+	loader,ok := storage.Backends[method]
+	if !ok { t.Fatalf("backend %q is not registered",method) }
+	root,err := ioutil.TempDir("","conformance")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(root)
+	mkdir := func() (string,error) { return ioutil.TempDir(root,"st") }
+	for _,r := range Run(method,loader,mkdir,Profiles[method]) {
+		r := r
+		t.Run(r.Name,func(t *testing.T) {
+			if r.Err!=nil { t.Error(r.Err) }
+		})
+	}
+}
+
+// Failed returns the failed results.
+func Failed(res []Result) (failed []Result) {
+	for _,r := range res {
+		if r.Err!=nil { failed = append(failed,r) }
+	}
+	return
+}
+
+func protect(fn func() error) (err error) {
+	defer func() {
+		if r := recover() ; r!=nil { err = fmt.Errorf("panic: %v",r) }
+	}()
+	return fn()
+}
+
+func random(n int) []byte {
+	b := make([]byte,n)
+	rand.Read(b)
+	return b
+}
+func compressible(n int) []byte {
+	b := make([]byte,n)
+	for i := range b { b[i] = "abcdefgh"[(i/7)%8] }
+	return b
+}
+
+// release closes st, if it holds resources.
+func release(st istorage.Storage) {
+	if c,ok := st.(io.Closer) ; ok { c.Close() }
+}
+
+func (s *suite) open() (istorage.Storage,string,error) {
+	dir,err := s.mkdir()
+	if err!=nil { return nil,"",err }
+	_,st,err := s.loader(dir,s.cfg,nil)
+	return st,dir,err
+}
+
+// load loads and decodes a blob, verifying its checksum, if there is one.
+func load(st istorage.Storage, key []byte) ([]byte,error) {
+	buf := new(bytebufferpool.ByteBuffer)
+	meta,ok := st.LoadBlob(context.Background(),key,buf)
+	if !ok { return nil,fmt.Errorf("LoadBlob(%x) failed",key) }
+	blob,err := istorage.Unpack(meta,buf.B,nil)
+	if err!=nil { return nil,fmt.Errorf("LoadBlob(%x): %v",key,err) }
+	return blob,nil
+}
+
+func store(st istorage.Storage, blob []byte, t time.Time) ([]byte,error) {
+	key,ok := st.StoreBlob(context.Background(),blob,t)
+	if !ok { return nil,fmt.Errorf("StoreBlob(%d bytes, %v) failed",len(blob),t) }
+	return key,nil
+}
+
+func verify(st istorage.Storage, key, want []byte) error {
+	got,err := load(st,key)
+	if err!=nil { return err }
+	if !bytes.Equal(got,want) { return fmt.Errorf("LoadBlob(%x): got %d bytes, want %d bytes",key,len(got),len(want)) }
+	return nil
+}
+
+func (s *suite) roundtrip(blob []byte) error {
+	st,_,err := s.open()
+	if err!=nil { return err }
+	defer release(st)
+	key,err := store(st,blob,time.Now())
+	if err!=nil { return err }
+	return verify(st,key,blob)
+}
+
+func (s *suite) expiry() error {
+	st,_,err := s.open()
+	if err!=nil { return err }
+	defer release(st)
+	day := time.Now().UTC().Truncate(24*time.Hour).Add(-10*24*time.Hour).Add(12*time.Hour)
+	blobs := [3][]byte{random(100),random(100),random(100)}
+	var keys [3][]byte
+	for i := range blobs {
+		keys[i],err = store(st,blobs[i],day.Add(time.Duration(i-1)*24*time.Hour))
+		if err!=nil { return err }
+	}
+	st.Expire(context.Background(),day)
+	for i := range blobs {
+		_,e := load(st,keys[i])
+		// Without their keys, the blobs are gone on any backend.
+		gone := (s.opts.Expires || s.cfg.DayKeys) && i<2
+		if gone && e==nil { return fmt.Errorf("blob of day %d survived expiry",i-1) }
+		if !gone && e!=nil { return fmt.Errorf("blob of day %d: %v",i-1,e) }
+	}
+	if w,ok := st.(istorage.Walker) ; ok && (s.opts.Expires || s.cfg.DayKeys) {
+		// The expired blobs are dropped, not just unreadable.
+		err = w.WalkBlobs(context.Background(),func(key []byte, d time.Time) error {
+			if bytes.Equal(key,keys[0]) || bytes.Equal(key,keys[1]) { return fmt.Errorf("WalkBlobs lists the expired blob %x of %v",key,d) }
+			return nil
+		})
+		if err!=nil { return err }
+	}
+	if err = verify(st,keys[2],blobs[2]) ; err!=nil { return err }
+	if s.opts.Barrier {
+		// The whole day of the expiry time is expired, not just its past.
+		for _,t := range []time.Time{day.Add(-24*time.Hour),day.Add(6*time.Hour)} {
+			if _,ok := st.StoreBlob(context.Background(),blobs[0],t) ; ok {
+				return fmt.Errorf("StoreBlob accepted the expired time %v",t)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *suite) concurrency() error {
+	st,_,err := s.open()
+	if err!=nil { return err }
+	defer release(st)
+	const workers,rounds = 8,32
+	errs := make(chan error,workers)
+	var wg sync.WaitGroup
+	for w := 0 ; w<workers ; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0 ; r<rounds ; r++ {
+				blob := random(64+w*r)
+				key,err := store(st,blob,time.Now())
+				if err==nil { err = verify(st,key,blob) }
+				if err!=nil { errs <- err; return }
+			}
+		}(w)
+	}
+	// Expire long gone days meanwhile; it must not race with the stores.
+	stop := make(chan struct{})
+	expired := make(chan struct{})
+	go func() {
+		defer close(expired)
+		for i := 0 ; ; i++ {
+			select {
+			case <-stop: return
+			default:
+			}
+			st.Expire(context.Background(),time.Now().Add(-time.Duration(100-i%50)*24*time.Hour))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-expired
+	close(errs)
+	return <-errs
+}
+
+func (s *suite) capacity() error {
+	if !s.opts.Capacity { return nil }
+	st,_,err := s.open()
+	if err!=nil { return err }
+	defer release(st)
+	before := st.FreeStorage()
+	if before>capacity { return fmt.Errorf("FreeStorage() = %d exceeds the capacity %d",before,capacity) }
+	if _,err = store(st,random(1<<20),time.Now()) ; err!=nil { return err }
+	after := st.FreeStorage()
+	if after>=before { return fmt.Errorf("FreeStorage() did not shrink after a store: %d -> %d",before,after) }
+	return nil
+}
+
+func (s *suite) reopen() error {
+	if !s.opts.Reopen { return nil }
+	dir,err := s.mkdir()
+	if err!=nil { return err }
+	id1,st,err := s.loader(dir,s.cfg,nil)
+	if err!=nil { return err }
+	blob := compressible(100<<10)
+	key,err := store(st,blob,time.Now())
+	release(st)
+	if err!=nil { return err }
+	id2,st,err := s.loader(dir,s.cfg,nil)
+	if err!=nil { return err }
+	defer release(st)
+	if id1!=id2 { return fmt.Errorf("UUID changed on reopen") }
+	return verify(st,key,blob)
+}
+
+// snapshot returns the names, sizes and contents of the files in dir.
+func snapshot(dir string) (map[string]string,error) {
+	fis,err := ioutil.ReadDir(dir)
+	if err!=nil { return nil,err }
+	m := make(map[string]string)
+	for _,fi := range fis {
+		b,err := ioutil.ReadFile(filepath.Join(dir,fi.Name()))
+		if err!=nil { return nil,err }
+		m[fi.Name()] = string(b)
+	}
+	return m,nil
+}
+
+// readOnly checks, that a storage opened with ReadOnly serves and lists its
+// blobs, refuses stores and leaves its files alone.
+func (s *suite) readOnly() error {
+	if !s.opts.Reopen { return nil }
+	ro := *s.cfg
+	ro.ReadOnly = true
+	dir,err := s.mkdir()
+	if err!=nil { return err }
+	if _,st,err := s.loader(dir,&ro,nil) ; err==nil {
+		release(st)
+		return fmt.Errorf("an empty directory was opened read-only")
+	}
+	if fis,_ := ioutil.ReadDir(dir) ; len(fis)>0 { return fmt.Errorf("opening an empty directory read-only created %s",fis[0].Name()) }
+	_,st,err := s.loader(dir,s.cfg,nil)
+	if err!=nil { return err }
+	day := time.Now().UTC().Truncate(24*time.Hour).Add(-24*time.Hour)
+	blobs := map[string][]byte{}
+	for i := 0 ; i<4 ; i++ {
+		blob := random(1000+i)
+		key,err := store(st,blob,day.Add(time.Duration(i%2)*24*time.Hour))
+		if err!=nil { release(st); return err }
+		blobs[string(key)] = blob
+	}
+	release(st)
+	before,err := snapshot(dir)
+	if err!=nil { return err }
+	_,st,err = s.loader(dir,&ro,nil)
+	if err!=nil { return err }
+	for key,blob := range blobs {
+		if err = verify(st,[]byte(key),blob) ; err!=nil { release(st); return err }
+	}
+	if w,ok := st.(istorage.Walker) ; ok {
+		n := 0
+		err = w.WalkBlobs(context.Background(),func(key []byte, d time.Time) error {
+			if _,ok := blobs[string(key)] ; ok { n++ }
+			return nil
+		})
+		if err==nil && n!=len(blobs) { err = fmt.Errorf("WalkBlobs found %d of %d blobs",n,len(blobs)) }
+		if err!=nil { release(st); return err }
+	}
+	if _,ok := st.StoreBlob(context.Background(),random(10),day) ; ok {
+		release(st)
+		return fmt.Errorf("StoreBlob succeeded on a read-only storage")
+	}
+	release(st)
+	after,err := snapshot(dir)
+	if err!=nil { return err }
+	if len(after)!=len(before) { return fmt.Errorf("the read-only storage changed its files: %d before, %d after",len(before),len(after)) }
+	for name,b := range before {
+		if after[name]!=b { return fmt.Errorf("the read-only storage changed %s",name) }
+	}
+	return nil
+}
+
+// keyfile writes the keyfile name into dir, with the keys ids, the last one
+// current, and loads it. The key of an ID is always the same.
+func keyfile(dir, name string, ids ...uint32) (*istorage.Keyring,error) {
+	var b bytes.Buffer
+	for _,id := range ids { fmt.Fprintf(&b,"%d %064x\n",id,id) }
+	path := filepath.Join(dir,name)
+	if err := ioutil.WriteFile(path,b.Bytes(),0600) ; err!=nil { return nil,err }
+	return istorage.LoadKeyring(path)
+}
+
+// atRest checks, that a stored blob appears in none of the files.
+func (s *suite) atRest() error {
+	st,dir,err := s.open()
+	if err!=nil { return err }
+	blob := random(4096)
+	_,err = store(st,blob,time.Now())
+	release(st)
+	if err!=nil { return err }
+	files,err := snapshot(dir)
+	if err!=nil { return err }
+	for name,b := range files {
+		if bytes.Contains([]byte(b),blob[:32]) { return fmt.Errorf("%s holds the blob in the clear",name) }
+	}
+	return nil
+}
+
+// rotation checks, that the blobs can be read after the keyfile was rotated,
+// and, after Reseal, without the old key.
+func (s *suite) rotation() error {
+	if !s.opts.Reopen { return nil }
+	dir,err := s.mkdir()
+	if err!=nil { return err }
+	_,st,err := s.loader(dir,s.cfg,nil)
+	if err!=nil { return err }
+	blob := random(1000)
+	key,err := store(st,blob,time.Now())
+	release(st)
+	if err!=nil { return err }
+	
+	cfg := *s.cfg
+	if cfg.Keys,err = keyfile(s.keydir,"rotated",1,2) ; err!=nil { return err }
+	_,st,err = s.loader(dir,&cfg,nil)
+	if err!=nil { return err }
+	if err = verify(st,key,blob) ; err!=nil { release(st); return fmt.Errorf("after the rotation: %v",err) }
+	r,ok := st.(istorage.Resealer)
+	if !ok { release(st); return nil }
+	n,err := r.Reseal(context.Background())
+	release(st)
+	if err!=nil { return err }
+	// Day keys are renewed on open; the records sealed with them stay.
+	want := 1
+	if cfg.DayKeys { want = 0 }
+	if n!=want { return fmt.Errorf("Reseal resealed %d records, want %d",n,want) }
+	
+	if cfg.Keys,err = keyfile(s.keydir,"new",2) ; err!=nil { return err }
+	_,st,err = s.loader(dir,&cfg,nil)
+	if err!=nil { return fmt.Errorf("without the old key: %v",err) }
+	defer release(st)
+	if err = verify(st,key,blob) ; err!=nil { return fmt.Errorf("without the old key: %v",err) }
+	return nil
+}
+
+// shred checks, that a shredded day can neither be read nor written, also
+// after a reopen, while the other days are left alone.
+func (s *suite) shred() error {
+	if !s.cfg.DayKeys { return nil }
+	dir,err := s.mkdir()
+	if err!=nil { return err }
+	_,st,err := s.loader(dir,s.cfg,nil)
+	if err!=nil { return err }
+	day := time.Now().UTC().Truncate(24*time.Hour).Add(-36*time.Hour)
+	blob := random(1000)
+	gone,err := store(st,blob,day)
+	var kept []byte
+	if err==nil { kept,err = store(st,blob,day.Add(24*time.Hour)) }
+	if err!=nil { release(st); return err }
+	sh,ok := st.(istorage.DayShredder)
+	if !ok { release(st); return fmt.Errorf("day keys are set, but the storage is no DayShredder") }
+	if err = sh.ShredDay(context.Background(),day) ; err!=nil { release(st); return err }
+	for round := 0 ; ; round++ {
+		if _,err = load(st,gone) ; err==nil {
+			err = fmt.Errorf("a blob of the shredded day can be read")
+		} else {
+			err = verify(st,kept,blob)
+		}
+		if err==nil {
+			if _,ok := st.StoreBlob(context.Background(),blob,day) ; ok { err = fmt.Errorf("StoreBlob accepted the shredded day") }
+		}
+		release(st)
+		if err!=nil && round>0 { err = fmt.Errorf("after reopen: %v",err) }
+		if err!=nil || round>0 || !s.opts.Reopen { return err }
+		if _,st,err = s.loader(dir,s.cfg,nil) ; err!=nil { return err }
+	}
+}
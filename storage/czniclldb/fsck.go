@@ -0,0 +1,245 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package czniclldb
+
+import "github.com/cznic/lldb"
+import "github.com/maxymania/blobserver/storage"
+import "github.com/maxymania/blobserver/istorage"
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "time"
+
+func init() {
+	storage.Checkers["clldb"] = clldbCheck
+}
+
+// readNoter notes the offsets, that are read, so that the blocks reached
+// through the BTree can be told from the orphans.
+type readNoter struct{
+	lldb.Filer
+	offs map[int64]bool
+}
+func (r *readNoter) ReadAt(b []byte, off int64) (int,error) {
+	r.offs[off] = true
+	return r.Filer.ReadAt(b,off)
+}
+
+// A block is a used block of the allocator. The block format is documented
+// in lldb's falloc.go.
+type block struct{
+	h     int64
+	atoms int64
+	reloc int64 // Target of a relocated block, 0 otherwise.
+}
+func blockOff(h int64) int64 { return (h+6)*16 }
+
+// usedBlocks scans the file for used blocks.
+func usedBlocks(r io.ReaderAt, size int64) ([]block,error) {
+	var b [16]byte
+	var used []block
+	last := (size-0x70)/16 // The free list table comes first.
+	for h := int64(1) ; h<=last ; {
+		if _,err := r.ReadAt(b[:],blockOff(h)) ; err!=nil { return nil,err }
+		bl := block{h:h}
+		free := false
+		switch tag := b[0] ; {
+		case tag<=0xfb: // Short
+			bl.atoms = int64(tag+1)/16+1
+		case tag==0xfc: // Long
+			n := int64(b[1])<<8|int64(b[2])
+			if n<=0xfb { n += 0x10000 }
+			bl.atoms = (n+3)/16+1
+		case tag==0xfd: // Relocated
+			bl.atoms,bl.reloc = 1,int64(binary.BigEndian.Uint64(b[:8])&(1<<56-1))
+		case tag==0xfe:
+			bl.atoms,free = 1,true
+		default:
+			bl.atoms,free = int64(binary.BigEndian.Uint64(b[:8])&(1<<56-1)),true
+		}
+		if bl.atoms<=0 { return nil,fmt.Errorf("block %d: invalid size",h) }
+		if !free { used = append(used,bl) }
+		h += bl.atoms
+	}
+	return used,nil
+}
+
+/*
+clldbCheck verifies the allocator, walks the blobs of every day and scans for
+blocks, that neither the BTree nor any blob reaches, such as the chunks of a
+blob, whose store was cut short. With repair, these orphans are freed.
+*/
+func clldbCheck(path string, repair bool, logger istorage.Logger) (*storage.CheckReport,error) {
+	mode := os.O_RDONLY
+	if repair { mode = os.O_RDWR }
+	f,err := os.OpenFile(filepath.Join(path,"clldb.dat"),mode,0)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	rep := new(storage.CheckReport)
+	if _,err := os.Stat(filepath.Join(path,resealLog)) ; err==nil && !repair {
+		rep.Notef("%s: an interrupted reseal, that is finished on the next open or repair",resealLog)
+	} else if err==nil {
+		n,err := storage.ReplayRedoLog(filepath.Join(path,resealLog),func(off int64, data []byte) error {
+			_,err := f.WriteAt(data,off)
+			return err
+		},f.Sync)
+		if err!=nil { return nil,err }
+		rep.Notef("%s: finished an interrupted reseal of %d chunks",resealLog,n)
+	}
+	if fi,err := f.Stat() ; err!=nil {
+		return nil,err
+	} else if fi.Size()==0 {
+		rep.Notef("empty database")
+		return rep,nil
+	}
+	
+	sf := lldb.NewSimpleFileFiler(f)
+	all,err := lldb.NewAllocator(sf,&lldb.Options{})
+	if err!=nil { return nil,err }
+	var stats lldb.AllocStats
+	err = all.Verify(lldb.NewMemFiler(),func(e error) bool {
+		rep.Problemf("allocator: %v",e)
+		return true
+	},&stats)
+	if err!=nil { return rep,nil } // Walking the chains of a broken allocator is futile.
+	
+	// Walk with a fresh allocator, whose cache doesn't hide any reads.
+	rf := &readNoter{Filer:sf,offs:make(map[int64]bool)}
+	if all,err = lldb.NewAllocator(rf,&lldb.Options{}) ; err!=nil { return nil,err }
+	tree,err := lldb.OpenBTree(all,bytes.Compare,1)
+	if err!=nil {
+		rep.Problemf("btree: %v",err)
+		return rep,nil
+	}
+	en,err := tree.SeekFirst()
+	var k,v []byte
+	var heads []int64
+	var days  []string
+	for err==nil {
+		k,v,err = en.Next()
+		if err!=nil { break }
+		if _,e := time.Parse(dayTime,string(k)) ; e!=nil {
+			rep.Problemf("btree: invalid day key %q",k)
+			continue
+		}
+		if len(v)!=9 {
+			rep.Problemf("btree: day %s: invalid head record of %d bytes",k,len(v))
+			continue
+		}
+		heads = append(heads,int64(binary.BigEndian.Uint64(v)))
+		days  = append(days,string(k))
+	}
+	if err!=io.EOF { rep.Problemf("btree: %v",err) }
+	
+	seen := make(map[int64]bool)
+	chunks,chunkBytes := int64(0),int64(0)
+	var payload,ubuf []byte
+	for i,cur := range heads {
+		day := days[i]
+		for cur!=0 {
+			first := cur
+			h := header{Next:cur,Flags:hasMore}
+			payload = payload[:0]
+			for (h.Flags&hasMore)!=0 {
+				if seen[h.Next] {
+					rep.Problemf("day %s: blob %d: chunk %d is linked twice",day,first,h.Next)
+					goto nextDay
+				}
+				seen[h.Next] = true
+				obj,err := all.Get(nil,h.Next)
+				if err!=nil || len(obj)<9 {
+					rep.Problemf("day %s: blob %d: broken chunk %d: %v",day,first,h.Next,err)
+					goto nextDay
+				}
+				chunks++
+				chunkBytes += int64(len(obj))
+				h.Next  = int64(binary.BigEndian.Uint64(obj))
+				h.Flags = obj[8]
+				payload = append(payload,obj[9:]...)
+			}
+			if istorage.IsSealed(payload) {
+				rep.Sealed++ // The content can't be checked without the keys.
+			} else if meta,data,ok := istorage.ParseHead(payload) ; !ok {
+				rep.Problemf("day %s: blob %d: short head record",day,first)
+			} else if blob,err := istorage.Unpack(meta,data,ubuf) ; err!=nil {
+				rep.Problemf("day %s: blob %d: %v",day,first,err)
+			} else {
+				if meta.Size>0 { ubuf = blob }
+				rep.Blobs++
+				rep.Bytes += int64(len(blob))
+			}
+			if (h.Flags&hasNext)==0 { break }
+			cur = h.Next
+		}
+		nextDay:
+	}
+	
+	rep.Notef("%d days, %d blob chunks (%d bytes) of %d allocated handles",len(heads),chunks,chunkBytes,stats.Handles)
+	rep.Notef("%d free atoms of %d",stats.FreeAtoms,stats.TotalAtoms)
+	if len(rep.Problems)>0 {
+		// Blobs behind a broken chunk would pass for orphans.
+		rep.Notef("orphans were not looked for, as the blob chains are damaged")
+	} else if err = orphans(rep,all,rf,repair) ; err!=nil {
+		return rep,err
+	}
+	logger.Log("event","fsck","days",len(heads),"blobs",rep.Blobs,"orphaned",rep.Orphaned,"repaired",rep.Repaired,"problems",len(rep.Problems))
+	return rep,nil
+}
+
+// orphans counts the used blocks, that rf did not see read, and frees them,
+// if repair is set.
+func orphans(rep *storage.CheckReport, all *lldb.Allocator, rf *readNoter, repair bool) error {
+	size,err := rf.Size()
+	if err!=nil { return err }
+	used,err := usedBlocks(rf.Filer,size)
+	if err!=nil { return err }
+	atoms := make(map[int64]int64,len(used))
+	for _,b := range used { atoms[b.h] = b.atoms }
+	var lost []block
+	targets := make(map[int64]bool)
+	for _,b := range used {
+		if b.reloc!=0 { targets[b.reloc] = true }
+		if !rf.offs[blockOff(b.h)] { lost = append(lost,b) }
+	}
+	n := 0
+	for _,b := range lost {
+		if targets[b.h] { continue } // Goes with its relocated block.
+		bytes := b.atoms*16
+		if b.reloc!=0 { bytes += atoms[b.reloc]*16 }
+		n++
+		rep.Orphaned += bytes
+		if !repair { continue }
+		if err = all.Free(b.h) ; err!=nil {
+			rep.Problemf("freeing orphan %d: %v",b.h,err)
+			continue
+		}
+		rep.Repaired += bytes
+	}
+	if n>0 { rep.Notef("%d orphaned blocks, %d bytes",n,rep.Orphaned) }
+	if repair && rep.Repaired>0 { return rf.Sync() }
+	return nil
+}
@@ -28,13 +28,15 @@ import "bytes"
 import "github.com/valyala/bytebufferpool"
 import "encoding/binary"
 import "sync"
+import "context"
 import "time"
-import "github.com/pierrec/lz4"
 import "path/filepath"
 import "fmt"
 import "github.com/maxymania/blobserver/storage"
 import "github.com/maxymania/blobserver/istorage"
+import "github.com/maxymania/blobserver/trace"
 import "os"
+import "io"
 
 func split(bb []byte) (rb [][]byte) {
 	rb = make([][]byte,0,1+(len(bb)/0x10000))
@@ -53,22 +55,23 @@ func expand(buf []byte,i int) []byte {
 
 var blobPool bytebufferpool.Pool
 
-func compress(blob []byte) *bytebufferpool.ByteBuffer {
-	lblob := len(blob)
-	i := lz4.CompressBlockBound(lblob)
-	buf   := blobPool.Get()
-	buf.B  = expand(buf.B,i+4)
-	
-	j,e := lz4.CompressBlock(blob,buf.B[4:],0)
-	if e!=nil || j==0 {
-		buf.B = buf.B[:4+lblob]
-		copy(buf.B[4:],blob)
-		lblob = 0
-	} else {
-		buf.B = buf.B[:4+j]
+// compress returns the record head (see istorage.PutHead) and the payload,
+// sealed by k, if it is not nil.
+func compress(ctx context.Context, blob []byte, c *istorage.Compressor, k istorage.Sealer, day time.Time) (*bytebufferpool.ByteBuffer,error) {
+	buf := blobPool.Get()
+	b,meta := c.Compress(ctx,expand(buf.B,istorage.HeadLen),blob)
+	istorage.PutHead(b,meta)
+	buf.B = b
+	if k==nil { return buf,nil }
+	defer blobPool.Put(buf)
+	out := blobPool.Get()
+	e,err := istorage.SealRecord(out.B[:0],k,b,day)
+	if err!=nil {
+		blobPool.Put(out)
+		return nil,err
 	}
-	binary.BigEndian.PutUint32(buf.B[ :4],uint32(lblob))
-	return buf
+	out.B = e
+	return out,nil
 }
 
 
@@ -83,11 +86,17 @@ type header struct{
 }
 
 type llstorage struct{
+	path string
 	buf  bytes.Buffer
 	filr lldb.Filer
 	all  *lldb.Allocator
 	tree *lldb.BTree
 	mutx sync.RWMutex
+	log  istorage.Logger
+	comp *istorage.Compressor
+	seal istorage.Sealer
+	days *istorage.DayKeys
+	ro   bool // See storage.StorageConfig.ReadOnly.
 }
 func (s *llstorage) store(categ, bb []byte) (int64,error) {
 	s.mutx.Lock(); defer s.mutx.Unlock()
@@ -116,45 +125,314 @@ func (s *llstorage) store(categ, bb []byte) (int64,error) {
 	
 	binary.BigEndian.PutUint64(myBuf[:8],uint64(h.Next))
 	myBuf[8] = h.Flags
-	s.tree.Set(categ,myBuf[:])
+	err = s.tree.Set(categ,myBuf[:])
+	if err!=nil { return 0,err }
 	
 	return h.Next,nil // Return the head of the list.
 }
 const dayTime = "20060102"
 
-func (s *llstorage) StoreBlob(blob []byte, t time.Time) ([]byte, bool) {
+func (s *llstorage) StoreBlob(ctx context.Context, blob []byte, t time.Time) ([]byte, bool) {
 	var key [8]byte
+	if err := ctx.Err() ; err!=nil {
+		s.log.Log("event","store_failed","trace",trace.ID(ctx),"err",err)
+		return nil,false
+	}
 	tk := t.UTC().AppendFormat(key[:0],dayTime)
-	buf := compress(blob)
+	buf,err := compress(ctx,blob,s.comp,s.seal,t)
+	if err!=nil {
+		s.log.Log("event","store_failed","trace",trace.ID(ctx),"day",string(tk),"size",len(blob),"err",err)
+		return nil,false
+	}
 	defer blobPool.Put(buf)
 	k,err := s.store(tk,buf.B)
-	if err!=nil { return nil,false }
+	if err!=nil {
+		s.log.Log("event","store_failed","trace",trace.ID(ctx),"day",string(tk),"size",len(blob),"err",err)
+		return nil,false
+	}
 	b := make([]byte,8)
 	binary.BigEndian.PutUint64(b,uint64(k))
 	return b,true
 }
-func (s *llstorage) LoadBlob(key []byte, target *bytebufferpool.ByteBuffer) (lz4l int, ok bool) {
-	if len(key)!=8 { return }
+func (s *llstorage) LoadBlob(ctx context.Context, key []byte, target *bytebufferpool.ByteBuffer) (meta istorage.Meta, ok bool) {
+	tid := trace.ID(ctx)
+	if len(key)!=8 {
+		s.log.Log("event","load_failed","trace",tid,"key",key,"err","invalid key length")
+		return
+	}
 	handle := int64(binary.BigEndian.Uint64(key))
+	// Allocator.Get updates the allocator's cache, so a read lock won't do.
+	s.mutx.Lock(); defer s.mutx.Unlock()
 	obj,err := s.all.Get(nil,handle)
-	if err!=nil || len(obj)<13 { return } // 9+4 = 13
+	if err!=nil {
+		s.log.Log("event","load_failed","trace",tid,"handle",handle,"err",err)
+		return
+	}
+	if len(obj)<13 { // 9+4 = 13
+		s.log.Log("event","load_failed","trace",tid,"handle",handle,"err","short head record")
+		return
+	}
 	h := header{}
 	h.Next = int64(binary.BigEndian.Uint64(obj))
 	h.Flags = obj[8]
 	
-	lz4l = int(binary.BigEndian.Uint32(obj[9:]))
-	target.Write(obj[13:])
+	// The record is gathered first, as a sealed one must be opened as a whole.
+	start := len(target.B)
+	target.Write(obj[9:])
 	for (h.Flags & (hasNext|hasMore))==(hasNext|hasMore) {
+		if err = ctx.Err() ; err!=nil {
+			s.log.Log("event","load_failed","trace",tid,"handle",handle,"err",err)
+			return
+		}
 		obj,err = s.all.Get(nil,h.Next)
-		if err!=nil || len(obj)<9 { return }
+		if err!=nil {
+			s.log.Log("event","load_failed","trace",tid,"handle",handle,"chunk",h.Next,"err",err)
+			return
+		}
+		if len(obj)<9 {
+			s.log.Log("event","load_failed","trace",tid,"handle",handle,"chunk",h.Next,"err","short chunk record")
+			return
+		}
 		h.Next = int64(binary.BigEndian.Uint64(obj))
 		h.Flags = obj[8]
 		target.Write(obj[9:])
 	}
-	ok = true
+	rec,err := istorage.OpenRecord(s.seal,target.B[start:])
+	if err!=nil {
+		s.log.Log("event","load_failed","trace",tid,"handle",handle,"err",err)
+		return
+	}
+	meta,data,ok := istorage.ParseHead(rec)
+	if !ok {
+		s.log.Log("event","load_failed","trace",tid,"handle",handle,"err","short head record")
+		return
+	}
+	target.B = target.B[:start+copy(target.B[start:],data)]
+	return
+}
+// Expire frees the days up to and including that of t, if the storage has
+// day keys: their blobs can't be read anymore, and their lists aren't created
+// anew. Without day keys, expiry is not implemented; nothing is reclaimed.
+func (s *llstorage) Expire(ctx context.Context, t time.Time) {
+	if s.ro || s.days==nil {
+		s.log.Log("event","expire","trace",trace.ID(ctx),"before",t.UTC().Format(dayTime),"reclaimed",0,"supported",false)
+		return
+	}
+	tid := trace.ID(ctx)
+	tk := t.UTC().Format(dayTime)
+	shredded,err := s.days.Expire(t)
+	if err!=nil {
+		s.log.Log("event","expire_failed","trace",tid,"before",tk,"err",err)
+		return
+	}
+	days,err := s.daysUpTo(tk)
+	var reclaimed int64
+	for _,categ := range days {
+		if err!=nil { break }
+		var freed int64
+		freed,err = s.freeDay(categ)
+		reclaimed += freed
+	}
+	if err!=nil {
+		s.log.Log("event","expire_failed","trace",tid,"before",tk,"reclaimed",reclaimed,"err",err)
+		return
+	}
+	s.log.Log("event","expire","trace",tid,"before",tk,"days",len(days),"reclaimed",reclaimed,"shredded",shredded)
+}
+// daysUpTo returns the days of the BTree up to and including tk.
+func (s *llstorage) daysUpTo(tk string) (days [][]byte,err error) {
+	s.mutx.Lock(); defer s.mutx.Unlock()
+	en,err := s.tree.SeekFirst()
+	for err==nil {
+		var k []byte
+		if k,_,err = en.Next() ; err!=nil { break }
+		if string(k)>tk { break }
+		if _,e := time.Parse(dayTime,string(k)) ; e==nil { days = append(days,append([]byte(nil),k...)) }
+	}
+	if err==io.EOF { err = nil }
+	return
+}
+// ShredDay destroys the key of day, and frees the chunks of its blobs. As
+// the day can't be sealed anymore, its list isn't created anew.
+func (s *llstorage) ShredDay(ctx context.Context, day time.Time) error {
+	if s.days==nil { return istorage.ErrNoDayKeys }
+	if err := s.days.Shred(day) ; err!=nil { return err }
+	tk := day.UTC().Format(dayTime)
+	freed,err := s.freeDay([]byte(tk))
+	if err!=nil {
+		s.log.Log("event","shred_day","trace",trace.ID(ctx),"day",tk,"reclaimed",freed,"err",err)
+		return err
+	}
+	s.log.Log("event","shred_day","trace",trace.ID(ctx),"day",tk,"reclaimed",freed)
+	return nil
+}
+// freeDay removes the blob list of categ from the BTree and frees its chunks.
+// The list goes first, so that a crash leaves orphans, which fsck frees.
+func (s *llstorage) freeDay(categ []byte) (freed int64,err error) {
+	s.mutx.Lock(); defer s.mutx.Unlock()
+	v,err := s.tree.Get(nil,categ)
+	if err!=nil || len(v)!=9 { return 0,err }
+	h := header{Next:int64(binary.BigEndian.Uint64(v)),Flags:v[8]}
+	if err = s.tree.Delete(categ) ; err!=nil { return }
+	for (h.Flags&hasNext)!=0 && h.Next!=0 {
+		obj,err := s.all.Get(nil,h.Next)
+		if err!=nil { return freed,err }
+		if len(obj)<9 { return freed,fmt.Errorf("short record at handle %d",h.Next) }
+		if err = s.all.Free(h.Next) ; err!=nil { return freed,err }
+		freed  += int64(len(obj))
+		h.Next  = int64(binary.BigEndian.Uint64(obj))
+		h.Flags = obj[8]
+	}
+	return
+}
+
+// WalkBlobs walks the blob lists of all days. Within a day, the most recently
+// stored blob comes first.
+func (s *llstorage) WalkBlobs(ctx context.Context, fn func(key []byte, day time.Time) error) error {
+	type dayHead struct{
+		day  time.Time
+		head int64
+	}
+	var heads []dayHead
+	s.mutx.Lock()
+	en,err := s.tree.SeekFirst()
+	for err==nil {
+		var k,v []byte
+		k,v,err = en.Next()
+		if err!=nil { break }
+		t,e := time.Parse(dayTime,string(k))
+		if e!=nil || len(v)!=9 { continue }
+		heads = append(heads,dayHead{t,int64(binary.BigEndian.Uint64(v))})
+	}
+	s.mutx.Unlock()
+	if err!=io.EOF { return err }
+	
+	for _,dh := range heads {
+		cur := dh.head
+		for cur!=0 {
+			if err = ctx.Err() ; err!=nil { return err }
+			key := make([]byte,8)
+			binary.BigEndian.PutUint64(key,uint64(cur))
+			// Skip over the chunks of the blob. The last one links to the
+			// previous blob of the day, if any.
+			h := header{Next:cur,Flags:hasMore}
+			for (h.Flags&hasMore)!=0 {
+				h,err = s.header(h.Next)
+				if err!=nil { return err }
+			}
+			if err = fn(key,dh.day) ; err!=nil { return err }
+			if (h.Flags&hasNext)==0 { break }
+			cur = h.Next
+		}
+	}
+	return nil
+}
+func (s *llstorage) header(handle int64) (h header,err error) {
+	s.mutx.Lock(); defer s.mutx.Unlock()
+	obj,err := s.all.Get(nil,handle)
+	if err!=nil { return }
+	if len(obj)<9 { return h,fmt.Errorf("short record at handle %d",handle) }
+	h.Next  = int64(binary.BigEndian.Uint64(obj))
+	h.Flags = obj[8]
 	return
 }
-func (s *llstorage) Expire(t time.Time) {}
+// The redo log of a reseal; see storage.RedoLog.
+const resealLog = "clldb.reseal"
+
+// Resealed chunks are written through the redo log in batches of this size.
+const resealBatch = 4<<20
+
+// Reseal rewrites the chunks of the sealed blobs, that were sealed with an
+// older key. The chunks keep their handles and lengths, so that their blocks
+// are rewritten in place. The new chunks are logged first, so that a crash
+// leaves no torn blob behind; the loader replays the log.
+func (s *llstorage) Reseal(ctx context.Context) (int,error) {
+	if s.seal==nil { return 0,istorage.ErrNoKeyfile }
+	if s.ro { return 0,istorage.ErrReadOnly }
+	rl,err := storage.CreateRedoLog(filepath.Join(s.path,resealLog))
+	if err!=nil { return 0,err }
+	defer rl.Close()
+	handles := make(map[int64]int64) // Offset of the content of a block -> its handle.
+	commit := func() error {
+		s.mutx.Lock(); defer s.mutx.Unlock()
+		err := rl.Commit(func(off int64, data []byte) error {
+			return s.all.Realloc(handles[off],data)
+		},s.filr.Sync)
+		if err==nil { handles = make(map[int64]int64) }
+		return err
+	}
+	n := 0
+	err = s.WalkBlobs(ctx,func(key []byte, day time.Time) error {
+		handle := int64(binary.BigEndian.Uint64(key))
+		ok,err := s.reseal(handle,rl,handles)
+		if err!=nil { return fmt.Errorf("blob %d: %v",handle,err) }
+		if !ok { return nil }
+		n++
+		// Only whole blobs are committed.
+		if rl.Pending()<resealBatch { return nil }
+		return commit()
+	})
+	if err==nil { err = commit() }
+	if err!=nil {
+		s.log.Log("event","reseal_failed","records",n,"err",err)
+		return n,err
+	}
+	s.log.Log("event","reseal","records",n)
+	return n,nil
+}
+
+// reseal adds the resealed chunks of the blob at handle to rl, with the file
+// offset of the content of their blocks, as the allocator rewrites them.
+func (s *llstorage) reseal(handle int64, rl *storage.RedoLog, handles map[int64]int64) (bool,error) {
+	s.mutx.Lock(); defer s.mutx.Unlock()
+	var offs []int64
+	var chunks [][]byte
+	var rec []byte
+	h := header{Next:handle,Flags:hasMore}
+	for (h.Flags&hasMore)!=0 {
+		obj,err := s.all.Get(nil,h.Next)
+		if err!=nil { return false,err }
+		if len(obj)<9 { return false,fmt.Errorf("short record at handle %d",h.Next) }
+		off,err := s.contentOff(h.Next)
+		if err!=nil { return false,err }
+		handles[off] = h.Next
+		offs    = append(offs,off)
+		chunks  = append(chunks,obj)
+		rec     = append(rec,obj[9:]...)
+		h.Next  = int64(binary.BigEndian.Uint64(obj))
+		h.Flags = obj[8]
+	}
+	if !istorage.IsSealed(rec) { return false,nil }
+	ok,err := s.seal.Reseal(rec[4:])
+	if err!=nil || !ok { return false,err }
+	for i,obj := range chunks {
+		rec = rec[copy(obj[9:],rec):]
+		if err = rl.Add(offs[i],obj) ; err!=nil { return false,err }
+	}
+	return true,nil
+}
+
+// contentOff returns the file offset of the content of the block at handle.
+// The allocator never compresses (see lldb.Options), so the content is the
+// chunk itself. Chunks keep their size, so their blocks are never relocated.
+func (s *llstorage) contentOff(handle int64) (int64,error) {
+	var tag [1]byte
+	off := blockOff(handle)
+	if _,err := s.filr.ReadAt(tag[:],off) ; err!=nil { return 0,err }
+	switch {
+	case tag[0]<=0xfb: return off+1,nil // Short used block.
+	case tag[0]==0xfc: return off+3,nil // Long used block.
+	}
+	return 0,fmt.Errorf("block of handle %d has tag %#x",handle,tag[0])
+}
+func (s *llstorage) UsedStorage() int64 {
+	return s.size()
+}
+func (s *llstorage) CompressStats() istorage.CompressCounts { return s.comp.Counts() }
+func (s *llstorage) Close() error {
+	s.mutx.Lock(); defer s.mutx.Unlock()
+	return s.filr.Close()
+}
 func (s *llstorage) FreeStorage() int64 {
 	return 0
 }
@@ -165,26 +443,50 @@ func (s *llstorage) size() (size int64) {
 
 func init() {
 	storage.Backends["clldb"] = clldbLoader
+	storage.Specs["clldb"] = &storage.BackendSpec{Seal:true} // No options; the capacity is not enforced.
 }
 
-func clldbLoader(path string, cfg *storage.StorageConfig) (string,istorage.Storage,error) {
-	uuid,err := storage.GetOrCreateUUID(path)
+func clldbLoader(path string, cfg *storage.StorageConfig, logger istorage.Logger) (string,istorage.Storage,error) {
+	uuid,err := cfg.UUID(path,logger)
 	if err!=nil { return "",nil,err }
-	f,err := os.OpenFile(filepath.Join(path,"clldb.dat"),os.O_CREATE|os.O_RDWR,0600)
+	logger = istorage.With(logger,"uuid",uuid.String())
+	flag := os.O_CREATE|os.O_RDWR
+	if cfg.ReadOnly { flag = os.O_RDONLY }
+	f,err := os.OpenFile(filepath.Join(path,"clldb.dat"),flag,0600)
 	if err!=nil { return "",nil,err }
+	if cfg.ReadOnly {
+		if _,err = os.Stat(filepath.Join(path,resealLog)) ; err==nil {
+			f.Close()
+			return "",nil,fmt.Errorf("%s: an interrupted reseal must be finished, open the storage writable",resealLog)
+		}
+	}
+	// Finish an interrupted reseal, before the allocator reads the file.
+	n,err := storage.ReplayRedoLog(filepath.Join(path,resealLog),func(off int64, data []byte) error {
+		_,err := f.WriteAt(data,off)
+		return err
+	},f.Sync)
+	if err!=nil { f.Close(); return "",nil,err }
+	if n>0 { logger.Log("event","reseal_replayed","chunks",n) }
 	fileLength,err := f.Seek(0,2)
 	if err!=nil { return "",nil,err }
 	sf := lldb.NewSimpleFileFiler(f)
-	fmt.Println(fileLength)
 	all,err := lldb.NewAllocator(sf,&lldb.Options{})
-	fmt.Println(sf.Size())
 	if err!=nil { return "",nil,err }
 	
 	
 	s := new(llstorage)
+	s.path = path
+	s.ro   = cfg.ReadOnly
 	s.filr = sf
 	s.all  = all
-	if fileLength==0 {
+	s.log  = logger
+	s.comp = istorage.NewCompressor(cfg.GetCodec())
+	s.seal,s.days,err = cfg.Sealer(path)
+	if err!=nil { return "",nil,err }
+	if fileLength==0 && cfg.ReadOnly {
+		return "",nil,fmt.Errorf("%s: empty database",path)
+	} else if fileLength==0 {
+		logger.Log("event","init","action","create_btree")
 		bt,h,err := lldb.CreateBTree(s.all,bytes.Compare)
 		if err!=nil { return "",nil,err }
 		if h!=1 { return "",nil,fmt.Errorf("Invalid Handle %v !=1",h) }
@@ -194,9 +496,9 @@ func clldbLoader(path string, cfg *storage.StorageConfig) (string,istorage.Stora
 		if err!=nil { return "",nil,err }
 		s.tree = bt
 	}
-	fmt.Println(sf.Size())
 	
 	//d.maxSpace   = cfg.Capacity.Int64()
 	
+	logger.Log("event","open","file_size",fileLength,"size",s.size(),"codec",s.comp.Codec.Name,"sealed",s.seal!=nil,"day_keys",s.days!=nil)
 	return string(uuid[:]),s,nil
 }
@@ -24,13 +24,19 @@ SOFTWARE.
 package filebased
 
 import "github.com/valyala/bytebufferpool"
+import "context"
 import "time"
 import "encoding/binary"
+import "fmt"
 import "io/ioutil"
 import "os"
 import "path/filepath"
+import "strings"
+import "sync"
+import "sync/atomic"
 import "github.com/maxymania/blobserver/storage"
 import "github.com/maxymania/blobserver/istorage"
+import "github.com/maxymania/blobserver/trace"
 
 func isDayfile(name string) bool {
 	if len(name)!=8 { return false }
@@ -40,74 +46,265 @@ func isDayfile(name string) bool {
 	return true
 }
 
+// A dropped day leaves a marker file behind, until it expires.
+const droppedSuffix = ".dropped"
+
+// A dayfile with this suffix is the redo log of an interrupted reseal.
+const resealSuffix = ".reseal"
+
 const dayFile_Fmt = "20060102"
 const dayFile_Seconds = 60*60*24
 type dayFile struct{
+	ex int64 // Days before this Unix time are expired. Accessed atomically, first for alignment.
 	ao *aoFolder
-	ex time.Time
 	wf aoWriteFunc
+	comp *istorage.Compressor
+	seal istorage.Sealer
+	days *istorage.DayKeys
 	// --------------------------------------
 	spaceTrack   *sizeTrack
 	maxSpace     int64
 	folder       string
+	log          istorage.Logger
+	dmutex       sync.RWMutex
+	dropped      map[string]bool
+	ro           bool // See storage.StorageConfig.ReadOnly.
+}
+
+func (d *dayFile) expired() time.Time {
+	return time.Unix(atomic.LoadInt64(&d.ex),0).UTC()
+}
+func (d *dayFile) isDropped(df string) bool {
+	d.dmutex.RLock(); defer d.dmutex.RUnlock()
+	return d.dropped[df]
 }
 
-func (d *dayFile) StoreBlob(blob []byte, t time.Time) ([]byte,bool) {
+func (d *dayFile) StoreBlob(ctx context.Context, blob []byte, t time.Time) ([]byte,bool) {
 	var buf [32]byte // (10+10+5) = 25, 32 for alignment
+	if err := ctx.Err() ; err!=nil {
+		d.log.Log("event","store_failed","trace",trace.ID(ctx),"err",err)
+		return nil,false
+	}
 	t = t.UTC().Truncate(time.Hour*24)
-	if d.ex.After(t) { return nil,false } // Don't reopen old dayfiles
+	if d.expired().After(t) { // Don't reopen old dayfiles
+		d.log.Log("event","store_failed","trace",trace.ID(ctx),"day",t.Format(dayFile_Fmt),"err","day already expired")
+		return nil,false
+	}
 	
 	un := t.Unix()/dayFile_Seconds
 	df := t.Format(dayFile_Fmt)
-	offset,lng,ok := d.ao.getFile(df).writeBlob(blob,d.wf)
-	if !ok { return nil,false }
+	if d.isDropped(df) {
+		d.log.Log("event","store_failed","trace",trace.ID(ctx),"day",df,"err","day dropped")
+		return nil,false
+	}
+	offset,lng,err := d.ao.getFile(df).writeBlob(ctx,blob,d.comp,d.seal,t,d.wf)
+	if err!=nil {
+		d.log.Log("event","store_failed","trace",trace.ID(ctx),"day",df,"size",len(blob),"err",err)
+		return nil,false
+	}
 	d.spaceTrack.addFile(df,int64(lng))
-	i := binary.PutVarint(buf[ :],un)
-	i += binary.PutVarint(buf[i:],offset)
-	i += binary.PutVarint(buf[i:],int64(lng))
-	return append(make([]byte,0,i),buf[:i]...),true
+	return dayKey(buf[:0],un,offset,int64(lng)),true
 }
-func (d *dayFile) LoadBlob(key []byte,target *bytebufferpool.ByteBuffer) (lz4l int,ok bool) {
+func dayKey(buf []byte, un, offset, lng int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	i := binary.PutVarint(tmp[:],un)
+	buf = append(buf,tmp[:i]...)
+	i  = binary.PutVarint(tmp[:],offset)
+	buf = append(buf,tmp[:i]...)
+	i  = binary.PutVarint(tmp[:],lng)
+	buf = append(buf,tmp[:i]...)
+	return append(make([]byte,0,len(buf)),buf...)
+}
+func (d *dayFile) LoadBlob(ctx context.Context, key []byte,target *bytebufferpool.ByteBuffer) (meta istorage.Meta,ok bool) {
+	if err := ctx.Err() ; err!=nil {
+		d.log.Log("event","load_failed","trace",trace.ID(ctx),"err",err)
+		return
+	}
 	daynum,i := binary.Varint(key) ; key = key[i:]
 	offset,i := binary.Varint(key) ; key = key[i:]
 	lng   ,_ := binary.Varint(key)
 	t := time.Unix(daynum*dayFile_Seconds,0).UTC()
-	if d.ex.After(t) { return }
+	if d.expired().After(t) { return }
 	df := t.Format(dayFile_Fmt)
-	return d.ao.getFile(df).readBlob(offset,int(lng),target)
+	if d.isDropped(df) { return } // Don't recreate the file.
+	meta,err := d.ao.getFile(df).readBlob(offset,int(lng),target,d.seal)
+	if err!=nil {
+		d.log.Log("event","load_failed","trace",trace.ID(ctx),"day",df,"offset",offset,"length",lng,"err",err)
+		return
+	}
+	return meta,true
 }
-func (d *dayFile) Expire(t time.Time) {
-	if !t.After(d.ex) { return }
-	df := t.Format(dayFile_Fmt)
-	fis,_ := ioutil.ReadDir(d.folder)
+func (d *dayFile) Expire(ctx context.Context, t time.Time) {
+	if d.ro || !t.After(d.expired()) { return }
+	df := t.UTC().Format(dayFile_Fmt)
+	tid := trace.ID(ctx)
+	fis,err := ioutil.ReadDir(d.folder)
+	if err!=nil {
+		d.log.Log("event","expire_failed","trace",tid,"before",df,"err",err)
+		return
+	}
+	files,reclaimed,shredded := 0,int64(0),0
+	if d.days!=nil {
+		// The keys go first; the files may linger on the disk after removal.
+		if shredded,err = d.days.Expire(t) ; err!=nil {
+			d.log.Log("event","expire_failed","trace",tid,"before",df,"err",err)
+		}
+	}
 	for _,fi := range fis {
+		if err = ctx.Err() ; err!=nil {
+			d.log.Log("event","expire_failed","trace",tid,"before",df,"files",files,"reclaimed",reclaimed,"err",err)
+			return
+		}
 		name := fi.Name()
+		if strings.HasSuffix(name,droppedSuffix) && isDayfile(strings.TrimSuffix(name,droppedSuffix)) {
+			day := strings.TrimSuffix(name,droppedSuffix)
+			if df<day { continue }
+			if err = os.Remove(filepath.Join(d.folder,name)) ; err==nil {
+				d.dmutex.Lock()
+				delete(d.dropped,day)
+				d.dmutex.Unlock()
+			}
+			continue
+		}
 		if !isDayfile(name) { continue }
 		if df<name { continue }
 		d.ao.getFile(name).disable()
-		os.Remove(filepath.Join(d.folder,name))
+		err = os.Remove(filepath.Join(d.folder,name))
+		if err!=nil {
+			d.log.Log("event","expire_failed","trace",tid,"day",name,"err",err)
+			continue
+		}
 		d.spaceTrack.setFile(name,0)
+		files++
+		reclaimed += fi.Size()
+	}
+	// From now on, refuse to reopen the expired days.
+	ex := t.UTC().Truncate(time.Hour*24).Add(time.Hour*24).Unix()
+	for {
+		old := atomic.LoadInt64(&d.ex)
+		if ex<=old || atomic.CompareAndSwapInt64(&d.ex,old,ex) { break }
+	}
+	d.log.Log("event","expire","trace",tid,"before",df,"files",files,"reclaimed",reclaimed,"shredded",shredded)
+}
+// ShredDay destroys the key of day, and drops the day.
+func (d *dayFile) ShredDay(ctx context.Context, day time.Time) error {
+	if d.days==nil { return istorage.ErrNoDayKeys }
+	return d.DropDay(ctx,day)
+}
+// DropDay removes the dayfile of day and leaves a marker, that keeps the
+// day from being written again. With day keys, the key of day is destroyed.
+func (d *dayFile) DropDay(ctx context.Context, day time.Time) error {
+	if d.ro { return istorage.ErrReadOnly }
+	df := day.UTC().Format(dayFile_Fmt)
+	if d.days!=nil {
+		if err := d.days.Shred(day) ; err!=nil { return err }
 	}
+	f,err := os.OpenFile(filepath.Join(d.folder,df+droppedSuffix),os.O_CREATE|os.O_WRONLY,0600)
+	if err!=nil { return err }
+	err = f.Sync()
+	f.Close()
+	if err!=nil { return err }
+	d.dmutex.Lock()
+	d.dropped[df] = true
+	d.dmutex.Unlock()
+	
+	d.ao.getFile(df).disable()
+	var size int64
+	if fi,err := os.Stat(filepath.Join(d.folder,df)) ; err==nil { size = fi.Size() }
+	err = os.Remove(filepath.Join(d.folder,df))
+	if err!=nil && !os.IsNotExist(err) { return err }
+	d.spaceTrack.setFile(df,0)
+	d.log.Log("event","drop_day","trace",trace.ID(ctx),"day",df,"reclaimed",size)
+	return nil
+}
+func (d *dayFile) WalkBlobs(ctx context.Context, fn func(key []byte, day time.Time) error) error {
+	var buf [32]byte
+	fis,err := ioutil.ReadDir(d.folder) // Sorted by name, thus by day.
+	if err!=nil { return err }
+	for _,fi := range fis {
+		name := fi.Name()
+		if !isDayfile(name) { continue }
+		t,err := time.Parse(dayFile_Fmt,name)
+		if err!=nil || d.expired().After(t) { continue }
+		un := t.Unix()/dayFile_Seconds
+		err = d.ao.getFile(name).walk(func(offset int64, lng int) error {
+			if err := ctx.Err() ; err!=nil { return err }
+			return fn(dayKey(buf[:0],un,offset,int64(lng)),t)
+		})
+		if err!=nil { return err }
+	}
+	return nil
+}
+// Reseal rewrites the sealed records, that were sealed with an older key.
+// They keep their offset and length, so their keys stay valid.
+func (d *dayFile) Reseal(ctx context.Context) (int,error) {
+	if d.seal==nil { return 0,istorage.ErrNoKeyfile }
+	if d.ro { return 0,istorage.ErrReadOnly }
+	fis,err := ioutil.ReadDir(d.folder)
+	if err!=nil { return 0,err }
+	total := 0
+	for _,fi := range fis {
+		name := fi.Name()
+		if !isDayfile(name) || d.isDropped(name) { continue }
+		if t,err := time.Parse(dayFile_Fmt,name) ; err!=nil || d.expired().After(t) { continue }
+		n,err := d.ao.getFile(name).reseal(ctx,d.seal,filepath.Join(d.folder,name+resealSuffix))
+		total += n
+		if err!=nil {
+			d.log.Log("event","reseal_failed","day",name,"records",total,"err",err)
+			return total,fmt.Errorf("%s: %v",name,err)
+		}
+	}
+	d.log.Log("event","reseal","records",total)
+	return total,nil
 }
 func (d *dayFile) FreeStorage() int64 {
-	return d.maxSpace-d.spaceTrack.count
+	d.spaceTrack.mutex.Lock(); defer d.spaceTrack.mutex.Unlock()
+	return atomic.LoadInt64(&d.maxSpace)-d.spaceTrack.count
+}
+func (d *dayFile) UsedStorage() int64 {
+	d.spaceTrack.mutex.Lock(); defer d.spaceTrack.mutex.Unlock()
+	return d.spaceTrack.count
+}
+func (d *dayFile) CompressStats() istorage.CompressCounts { return d.comp.Counts() }
+func (d *dayFile) SetCapacity(capacity int64) {
+	atomic.StoreInt64(&d.maxSpace,capacity)
+}
+func (d *dayFile) Close() error {
+	d.ao.closeAll()
+	return nil
 }
 //
-func dayfileLoader(path string, cfg *storage.StorageConfig) (string,istorage.Storage,error) {
-	uuid,err := storage.GetOrCreateUUID(path)
+func dayfileLoader(path string, cfg *storage.StorageConfig, logger istorage.Logger) (string,istorage.Storage,error) {
+	uuid,err := cfg.UUID(path,logger)
 	if err!=nil { return "",nil,err }
 	d           := &dayFile{}
+	d.log        = istorage.With(logger,"uuid",uuid.String())
 	d.ao         = aoFolderNew(path,cfg.MaxOpenFiles)
+	d.ao.ro      = cfg.ReadOnly
+	d.ro         = cfg.ReadOnly
 	d.wf         = getAoWriteFunc(cfg)
+	d.comp       = istorage.NewCompressor(cfg.GetCodec())
+	d.seal,d.days,err = cfg.Sealer(path)
+	if err!=nil { return "",nil,err }
 	d.spaceTrack = sizeTrackNew()
 	d.maxSpace   = cfg.Capacity.Int64()
 	d.folder     = path
-	fis,_ := ioutil.ReadDir(path)
+	d.dropped    = make(map[string]bool)
+	fis,err := ioutil.ReadDir(path)
+	if err!=nil { return "",nil,err }
 	for _,fi := range fis {
 		name := fi.Name()
+		if day := strings.TrimSuffix(name,resealSuffix) ; day!=name && isDayfile(day) {
+			if cfg.ReadOnly { return "",nil,fmt.Errorf("%s: an interrupted reseal must be finished, open the storage writable",name) }
+			n,err := replayReseal(path,day)
+			if err!=nil { return "",nil,fmt.Errorf("%s: %v",name,err) }
+			d.log.Log("event","reseal_replayed","day",day,"records",n)
+		}
+		if day := strings.TrimSuffix(name,droppedSuffix) ; day!=name && isDayfile(day) { d.dropped[day] = true }
 		if !isDayfile(name) { continue }
 		d.spaceTrack.setFile(name,fi.Size())
 	}
+	d.log.Log("event","open","dayfiles",len(d.spaceTrack.files),"used",d.spaceTrack.count,"capacity",d.maxSpace,"codec",d.comp.Codec.Name,"sealed",d.seal!=nil,"day_keys",d.days!=nil)
 	return string(uuid[:]),d,nil
 }
 
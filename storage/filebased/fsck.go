@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package filebased
+
+import "github.com/maxymania/blobserver/storage"
+import "github.com/maxymania/blobserver/istorage"
+import "io/ioutil"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+
+func init() {
+	storage.Checkers["dayfile"] = dayfileCheck
+}
+
+func dayfileCheck(path string, repair bool, logger istorage.Logger) (*storage.CheckReport,error) {
+	rep := new(storage.CheckReport)
+	fis,err := ioutil.ReadDir(path)
+	if err!=nil { return nil,err }
+	for _,fi := range fis {
+		name := fi.Name()
+		day := strings.TrimSuffix(name,resealSuffix)
+		if day==name || !isDayfile(day) { continue }
+		if !repair {
+			rep.Notef("%s: an interrupted reseal, that is finished on the next open or repair",name)
+			continue
+		}
+		n,err := replayReseal(path,day)
+		if err!=nil { return rep,fmt.Errorf("%s: %v",name,err) }
+		rep.Notef("%s: finished an interrupted reseal of %d records",name,n)
+	}
+	files := 0
+	for _,fi := range fis {
+		name := fi.Name()
+		if !isDayfile(name) { continue }
+		if err = checkDayfile(path,name,repair,rep) ; err!=nil { return rep,err }
+		files++
+	}
+	logger.Log("event","fsck","dayfiles",files,"blobs",rep.Blobs,"problems",len(rep.Problems))
+	return rep,nil
+}
+
+// checkDayfile reads every record of a dayfile. Records are addressed by
+// their offset, so a damaged record can't be dropped; only a torn tail can
+// be cut off.
+func checkDayfile(path, name string, repair bool, rep *storage.CheckReport) error {
+	mode := os.O_RDONLY
+	if repair { mode = os.O_RDWR }
+	f,err := os.OpenFile(filepath.Join(path,name),mode,0)
+	if err!=nil { return err }
+	defer f.Close()
+	fi,err := f.Stat()
+	if err!=nil { return err }
+	size := fi.Size()
+	
+	buf := blobPool.Get()
+	defer blobPool.Put(buf)
+	var ubuf []byte
+	pos := int64(0)
+	for pos<size {
+		lng,err := recordLen(f,pos)
+		if err!=nil || pos+int64(lng)>size { break }
+		meta,err := unpacked(f,pos,lng,buf,nil)
+		if err==istorage.ErrSealed {
+			rep.Sealed++
+			pos += int64(lng)
+			continue
+		}
+		if err==nil && meta.Codec==istorage.CodecLZ4 && meta.Size>len(buf.B)*255+16 { err = errCorruptRecord } // Beyond what LZ4 can expand to.
+		var blob []byte
+		if err==nil { blob,err = istorage.Unpack(meta,buf.B,ubuf) }
+		if err!=nil {
+			rep.Problemf("%s: record at offset %d: %v",name,pos,err)
+		} else {
+			if meta.Size>0 { ubuf = blob }
+			rep.Blobs++
+			rep.Bytes += int64(len(blob))
+		}
+		pos += int64(lng)
+	}
+	if pos<size {
+		tail := size-pos
+		rep.Orphaned += tail
+		rep.Problemf("%s: %d bytes of torn data at offset %d",name,tail,pos)
+		if repair {
+			if err = f.Truncate(pos) ; err!=nil { return err }
+			rep.Repaired += tail
+		}
+	}
+	return nil
+}
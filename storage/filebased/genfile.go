@@ -25,11 +25,17 @@ package filebased
 
 import "github.com/valyala/bytebufferpool"
 import "github.com/byte-mug/golibs/reslink"
+import "context"
+import "encoding/binary"
+import "fmt"
 import "os"
 import "sync"
+import "time"
 import "sync/atomic"
 import "path/filepath"
+import "errors"
 import "github.com/maxymania/blobserver/storage"
+import "github.com/maxymania/blobserver/istorage"
 
 func expand(buf []byte,i int) []byte {
 	if cap(buf)<i { return make([]byte,i) }
@@ -38,12 +44,17 @@ func expand(buf []byte,i int) []byte {
 
 var blobPool bytebufferpool.Pool
 
+var errCorruptRecord = errors.New("corrupt record")
+
 type genericFile struct{
 	*os.File
 	FileName string
+	ReadOnly bool
 }
 func (g *genericFile) Open() error {
-	f,e := os.OpenFile(g.FileName,os.O_RDWR|os.O_CREATE,0600)
+	flag := os.O_RDWR|os.O_CREATE
+	if g.ReadOnly { flag = os.O_RDONLY }
+	f,e := os.OpenFile(g.FileName,flag,0600)
 	if e!=nil { return e }
 	g.File = f
 	return nil
@@ -58,6 +69,7 @@ type aoFolder struct{
 	prefix string
 	files  map[string]*aoFile
 	mutex  sync.Mutex
+	ro     bool // Open the files read-only.
 }
 func aoFolderNew(p string,max int) *aoFolder {
 	a := new(aoFolder)
@@ -71,10 +83,16 @@ func (a *aoFolder) getFile(name string) *aoFile {
 	f,ok := a.files[name]
 	if ok { return f }
 	f = aoFileNew(a.total,filepath.Join(a.prefix,name))
+	f.file.ReadOnly = a.ro
 	a.files[name] = f
 	return f
 }
 
+func (a *aoFolder) closeAll() {
+	a.mutex.Lock(); defer a.mutex.Unlock()
+	for _,f := range a.files { f.disable() }
+}
+
 type aoFile struct{
 	file  *genericFile
 	elem  *reslink.ResourceElement
@@ -83,7 +101,7 @@ type aoFile struct{
 	count *int64
 }
 func aoFileNew(total *reslink.ResourceList,f string) *aoFile {
-	file := &genericFile{nil,f}
+	file := &genericFile{File:nil,FileName:f}
 	a := new(aoFile)
 	a.file  = file
 	a.elem  = reslink.NewResourceElement(file)
@@ -93,7 +111,7 @@ func aoFileNew(total *reslink.ResourceList,f string) *aoFile {
 	return a
 }
 
-type aoWriteFunc func(a *aoFile, b *bytebufferpool.ByteBuffer) (int64,int,bool)
+type aoWriteFunc func(a *aoFile, b *bytebufferpool.ByteBuffer) (int64,int,error)
 
 func getAoWriteFunc(cfg *storage.StorageConfig) (a aoWriteFunc){
 	a = aofAppendDirect
@@ -106,41 +124,108 @@ func getAoWriteFunc(cfg *storage.StorageConfig) (a aoWriteFunc){
 }
 
 
-func (a *aoFile) writeBlob(blob []byte,f aoWriteFunc) (int64,int,bool) {
-	buf := compress(blob)
+func (a *aoFile) writeBlob(ctx context.Context, blob []byte,c *istorage.Compressor,k istorage.Sealer,day time.Time,f aoWriteFunc) (int64,int,error) {
+	buf,err := compress(ctx,blob,c,k,day)
+	if err!=nil { return 0,0,err }
 	return f(a,buf)
 }
 func (a *aoFile) disable() { a.total.Disable(a.elem) }
-func (a *aoFile) readBlob(offset int64, lng int,targ *bytebufferpool.ByteBuffer) (lz4l int,ok bool) {
+
+// walk calls fn with the offset and length of every record in the file.
+func (a *aoFile) walk(fn func(offset int64, lng int) error) error {
 	a.elem.Incr(); defer a.elem.Decr()
-	if err := a.total.Open(a.elem) ; err!=nil { return }
-	return unpacked(a.file,offset,lng,targ)
+	if err := a.total.Open(a.elem) ; err!=nil { return err }
+	fi,err := a.file.Stat()
+	if err!=nil { return err }
+	size := fi.Size()
+	for pos := int64(0) ; pos<size ; {
+		lng,err := recordLen(a.file,pos)
+		if err!=nil { return err }
+		if pos+int64(lng)>size { return errCorruptRecord }
+		if err = fn(pos,lng) ; err!=nil { return err }
+		pos += int64(lng)
+	}
+	return nil
+}
+func (a *aoFile) readBlob(offset int64, lng int,targ *bytebufferpool.ByteBuffer,k istorage.Sealer) (meta istorage.Meta,err error) {
+	a.elem.Incr(); defer a.elem.Decr()
+	if err = a.total.Open(a.elem) ; err!=nil { return }
+	return unpacked(a.file,offset,lng,targ,k)
+}
+// Resealed records are written through a redo log in batches of this size.
+const resealBatch = 4<<20
+
+// reseal seals the sealed records of the file with the current key of k, in
+// place. The new records are written through the redo log at logPath, so that
+// a crash doesn't leave a torn record behind; see replayReseal.
+func (a *aoFile) reseal(ctx context.Context, k istorage.Sealer, logPath string) (n int,err error) {
+	buf := blobPool.Get()
+	defer blobPool.Put(buf)
+	rl,err := storage.CreateRedoLog(logPath)
+	if err!=nil { return }
+	defer rl.Close()
+	commit := func() error {
+		return rl.Commit(func(off int64, data []byte) error {
+			_,err := a.file.WriteAt(data,off)
+			return err
+		},a.file.Sync)
+	}
+	err = a.walk(func(offset int64, lng int) error {
+		if err := ctx.Err() ; err!=nil { return err }
+		var h [8]byte
+		if _,err := a.file.ReadAt(h[:],offset) ; err!=nil { return err }
+		if binary.BigEndian.Uint32(h[:4])!=istorage.SealField { return nil }
+		buf.B = expand(buf.B,lng-8)
+		if _,err := a.file.ReadAt(buf.B,offset+8) ; err!=nil { return err }
+		ok,err := k.Reseal(buf.B)
+		if err!=nil { return fmt.Errorf("record at offset %d: %v",offset,err) }
+		if !ok { return nil }
+		if err = rl.Add(offset+8,buf.B) ; err!=nil { return err }
+		n++
+		if rl.Pending()<resealBatch { return nil }
+		return commit()
+	})
+	if err==nil { err = commit() }
+	return
+}
+
+// replayReseal finishes a reseal of the dayfile name, that a crash interrupted.
+func replayReseal(folder, name string) (int,error) {
+	logPath := filepath.Join(folder,name+resealSuffix)
+	f,err := os.OpenFile(filepath.Join(folder,name),os.O_RDWR,0)
+	if os.IsNotExist(err) { return 0,os.Remove(logPath) }
+	if err!=nil { return 0,err }
+	defer f.Close()
+	return storage.ReplayRedoLog(logPath,func(off int64, data []byte) error {
+		_,err := f.WriteAt(data,off)
+		return err
+	},f.Sync)
 }
 
 
-func aofAppendDirect(a *aoFile, b *bytebufferpool.ByteBuffer) (int64,int,bool) {
+func aofAppendDirect(a *aoFile, b *bytebufferpool.ByteBuffer) (int64,int,error) {
 	defer blobPool.Put(b)
 	a.elem.Incr(); defer a.elem.Decr()
-	if err := a.total.Open(a.elem) ; err!=nil { return 0,0,false }
+	if err := a.total.Open(a.elem) ; err!=nil { return 0,0,err }
 	a.mutex.Lock(); defer a.mutex.Unlock()
 	pos,err := a.file.Seek(0,2)
-	if err!=nil { return 0,0,false }
+	if err!=nil { return 0,0,err }
 	_,err = a.file.Write(b.B)
-	if err!=nil { return 0,0,false }
-	return pos,b.Len(),true
+	if err!=nil { return 0,0,err }
+	return pos,b.Len(),nil
 }
 
-func aofAppendWriteAt(a *aoFile, b *bytebufferpool.ByteBuffer) (int64,int,bool) {
+func aofAppendWriteAt(a *aoFile, b *bytebufferpool.ByteBuffer) (int64,int,error) {
 	defer blobPool.Put(b)
 	a.elem.Incr(); defer a.elem.Decr()
-	if err := a.total.Open(a.elem) ; err!=nil { return 0,0,false }
+	if err := a.total.Open(a.elem) ; err!=nil { return 0,0,err }
 	
 	if pos := atomic.LoadInt64(a.count) ; pos<=0 {
 		a.mutex.Lock()
 		npos,err := a.file.Seek(0,2)
 		a.mutex.Unlock()
 		atomic.CompareAndSwapInt64(a.count,pos,npos)
-		if err!=nil { return 0,0,false }
+		if err!=nil { return 0,0,err }
 	}
 	
 	l := len(b.B)
@@ -151,9 +236,9 @@ func aofAppendWriteAt(a *aoFile, b *bytebufferpool.ByteBuffer) (int64,int,bool)
 	if err!=nil {
 		// Revert increment, if possible
 		atomic.CompareAndSwapInt64(a.count,neof,beg)
-		return 0,0,false
+		return 0,0,err
 	}
-	return beg,b.Len(),true
+	return beg,b.Len(),nil
 }
 
 
@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package filebased
+
+import "github.com/valyala/bytebufferpool"
+import "github.com/maxymania/blobserver/istorage"
+import "context"
+import "encoding/binary"
+import "io"
+import "time"
+
+/*
+Record layout:
+	[4] uncompressed size (0 = stored raw) | istorage.SumFlag | istorage.CodecFlag
+	[4] payload length
+	[4] CRC-32C of the uncompressed blob (only if SumFlag is set)
+	[1] codec ID (only if CodecFlag is set)
+	[*] payload
+
+Sealed record layout:
+	[4] istorage.SealField
+	[4] envelope length
+	[*] envelope (see istorage.Keyring) of a record written by istorage.PutHead
+*/
+const maxHead = 13
+
+func compress(ctx context.Context, blob []byte, c *istorage.Compressor, k istorage.Sealer, day time.Time) (*bytebufferpool.ByteBuffer,error) {
+	buf := blobPool.Get()
+	if k!=nil { return seal(ctx,blob,c,k,day,buf) }
+	b,meta := c.Compress(ctx,expand(buf.B,maxHead),blob)
+	binary.BigEndian.PutUint32(b[ :4],meta.SizeField())
+	binary.BigEndian.PutUint32(b[4:8],uint32(len(b)-maxHead))
+	binary.BigEndian.PutUint32(b[8:12],meta.Sum)
+	b[12] = meta.Codec
+	buf.B = b
+	return buf,nil
+}
+func seal(ctx context.Context, blob []byte, c *istorage.Compressor, k istorage.Sealer, day time.Time, buf *bytebufferpool.ByteBuffer) (*bytebufferpool.ByteBuffer,error) {
+	defer blobPool.Put(buf)
+	b,meta := c.Compress(ctx,expand(buf.B,istorage.HeadLen),blob)
+	istorage.PutHead(b,meta)
+	buf.B = b
+	out := blobPool.Get()
+	e,err := k.Seal(expand(out.B,8),b,day)
+	if err!=nil {
+		blobPool.Put(out)
+		return nil,err
+	}
+	binary.BigEndian.PutUint32(e[ :4],istorage.SealField)
+	binary.BigEndian.PutUint32(e[4:8],uint32(len(e)-8))
+	out.B = e
+	return out,nil
+}
+func headLen(f uint32) int {
+	if f==istorage.SealField { return 8 }
+	hl := 8
+	if (f&istorage.SumFlag)!=0 { hl += 4 }
+	if (f&istorage.CodecFlag)!=0 { hl++ }
+	return hl
+}
+// recordLen reads the record header at offset and returns the total length
+// of the record, header included.
+func recordLen(rat io.ReaderAt,offset int64) (int,error) {
+	var buf [8]byte
+	n,err := rat.ReadAt(buf[:],offset)
+	if n!=8 {
+		if err==nil { err = io.ErrUnexpectedEOF }
+		return 0,err
+	}
+	return headLen(binary.BigEndian.Uint32(buf[ :4]))+int(binary.BigEndian.Uint32(buf[4:8])),nil
+}
+// unsealed reads the sealed record at offset, whose envelope is j bytes long.
+func unsealed(rat io.ReaderAt,offset int64, j int, targ *bytebufferpool.ByteBuffer, k istorage.Sealer) (meta istorage.Meta,err error) {
+	if k==nil { return meta,istorage.ErrSealed }
+	targ.B = expand(targ.B,j)
+	n,err := rat.ReadAt(targ.B,offset+8)
+	if n!=j && err!=nil { return }
+	rec,err := k.Open(targ.B)
+	if err!=nil { return }
+	meta,data,ok := istorage.ParseHead(rec)
+	if !ok { return meta,errCorruptRecord }
+	targ.B = targ.B[:copy(targ.B,data)]
+	return meta,nil
+}
+func unpacked(rat io.ReaderAt,offset int64, lng int, targ *bytebufferpool.ByteBuffer, k istorage.Sealer) (meta istorage.Meta,err error) {
+	var buf [maxHead]byte
+	n,err := rat.ReadAt(buf[:8],offset)
+	if n!=8 && err!=nil { return }
+	
+	f := binary.BigEndian.Uint32(buf[ :4])
+	j := int(binary.BigEndian.Uint32(buf[4:8]))
+	if f==istorage.SealField {
+		if (j+8)>lng { return meta,errCorruptRecord }
+		return unsealed(rat,offset,j,targ,k)
+	}
+	hl := headLen(f)
+	if hl>8 {
+		n,err = rat.ReadAt(buf[8:hl],offset+8)
+		if n!=hl-8 && err!=nil { return }
+	}
+	meta,codec := istorage.ParseSizeField(f)
+	h := buf[8:hl]
+	if meta.HasSum {
+		meta.Sum = binary.BigEndian.Uint32(h)
+		h = h[4:]
+	}
+	if codec { meta.Codec = h[0] }
+	if (j+hl)>lng { return meta,errCorruptRecord }
+	targ.B  = expand(targ.B,j)
+	n,err = rat.ReadAt(targ.B,offset+int64(hl))
+	if n!=j && err!=nil { return }
+	err = nil
+	return
+}
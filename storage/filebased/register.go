@@ -27,5 +27,6 @@ import "github.com/maxymania/blobserver/storage"
 
 func init() {
 	storage.Backends["dayfile"] = dayfileLoader
+	storage.Specs["dayfile"] = &storage.BackendSpec{Options:[]string{"pwrite"},Capacity:true,Disk:true,MaxOpen:true,Seal:true}
 }
 
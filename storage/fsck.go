@@ -0,0 +1,54 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package storage
+
+import "github.com/maxymania/blobserver/istorage"
+import "errors"
+import "fmt"
+
+var ErrRepairUnsupported = errors.New("repair is not supported by this backend")
+
+// CheckReport is the outcome of an offline consistency check.
+type CheckReport struct{
+	Blobs    int64 // Blobs, that could be read and verified.
+	Bytes    int64 // Uncompressed size of these blobs.
+	Sealed   int64 // Sealed blobs, whose content can't be checked without the keys.
+	Orphaned int64 // Bytes, that are not reachable from any blob.
+	Repaired int64 // Bytes, that were reclaimed or fixed.
+	
+	Problems []string
+	Notes    []string
+}
+func (r *CheckReport) Problemf(format string, args ...interface{}) {
+	r.Problems = append(r.Problems,fmt.Sprintf(format,args...))
+}
+func (r *CheckReport) Notef(format string, args ...interface{}) {
+	r.Notes = append(r.Notes,fmt.Sprintf(format,args...))
+}
+
+// A Checker validates the storage directory at path, without a running
+// server. It must not modify the storage unless repair is set.
+type Checker func(path string, repair bool, logger istorage.Logger) (*CheckReport,error)
+
+var  Checkers = make(map[string]Checker)
@@ -25,23 +25,26 @@ package gobasedb
 
 // Standard Library imports
 import (
+	"context"
 	"time"
 	"path/filepath"
 	"fmt"
 	"os"
 	"encoding/binary"
 	"bytes"
+	"sync"
+	"sync/atomic"
 )
 
 // Blobserver imports
 import (
 	"github.com/maxymania/blobserver/storage"
 	"github.com/maxymania/blobserver/istorage"
+	"github.com/maxymania/blobserver/trace"
 )
 
 // Blobserver-related imports
 import "github.com/valyala/bytebufferpool"
-import "github.com/pierrec/lz4"
 
 // Gobase-Imports
 import (
@@ -70,32 +73,46 @@ func expand(buf []byte,i int) []byte {
 
 var blobPool bytebufferpool.Pool
 
-func compress(blob []byte) *bytebufferpool.ByteBuffer {
-	lblob := len(blob)
-	i := lz4.CompressBlockBound(lblob)
-	buf   := blobPool.Get()
-	buf.B  = expand(buf.B,i+4)
-	
-	j,e := lz4.CompressBlock(blob,buf.B[4:],0)
-	if e!=nil || j==0 {
-		buf.B = buf.B[:4+lblob]
-		copy(buf.B[4:],blob)
-		lblob = 0
-	} else {
-		buf.B = buf.B[:4+j]
+// compress returns the record head (see istorage.PutHead) and the payload,
+// sealed by k, if it is not nil.
+func compress(ctx context.Context, blob []byte, c *istorage.Compressor, k istorage.Sealer, day time.Time) (*bytebufferpool.ByteBuffer,error) {
+	buf := blobPool.Get()
+	b,meta := c.Compress(ctx,expand(buf.B,istorage.HeadLen),blob)
+	istorage.PutHead(b,meta)
+	buf.B = b
+	if k==nil { return buf,nil }
+	defer blobPool.Put(buf)
+	out := blobPool.Get()
+	e,err := istorage.SealRecord(out.B[:0],k,b,day)
+	if err!=nil {
+		blobPool.Put(out)
+		return nil,err
 	}
-	binary.BigEndian.PutUint32(buf.B[ :4],uint32(lblob))
-	return buf
+	out.B = e
+	return out,nil
 }
 
 type baseStorage struct{
+	minTime   int64 // Unix time of the expiry barrier, the end of a day. Accessed atomically, first for alignment.
 	dm        *dataman.DataManagerLocked
 	dayIdx    int64
 	trackOff  int64 // Storage tracking record.
 	blockList *blocklist.BLManager // FreeBlockList
-	minTime   time.Time
 	freed     int64
 	maxSpace  int64
+	file      *os.File
+	log       istorage.Logger
+	comp      *istorage.Compressor
+	
+	seal      istorage.Sealer
+	days      *istorage.DayKeys
+	index     *recordIndex // nil, if it is opened read-only and has none.
+	
+	// Held for reading by stores, until their blocks are written; WalkBlobs
+	// holds it, while it reads a day list.
+	writes    sync.RWMutex
+	maint     sync.Mutex // Held by Expire and Reseal.
+	ro        bool
 }
 
 func (s *baseStorage) persistFreed() error {
@@ -150,6 +167,7 @@ func (s *baseStorage) allocStorage(categ []byte, bl int) ([]blocklist.BufAddr,er
 	return lst,nil
 }
 func (s *baseStorage) store(categ, bb []byte) (int64,error) {
+	s.writes.RLock(); defer s.writes.RUnlock()
 	lst,err := s.allocStorage(categ,len(bb))
 	if err!=nil { return 0,err }
 	if len(lst)==0 { return 0,fmt.Errorf("Empty List") }
@@ -170,13 +188,16 @@ func (s *baseStorage) store(categ, bb []byte) (int64,error) {
 	
 	return lst[0].Off,nil
 }
-func (s *baseStorage) load(off int64) (buf *bytebufferpool.ByteBuffer) {
+func (s *baseStorage) load(ctx context.Context, off int64) (buf *bytebufferpool.ByteBuffer, err error) {
 	var dbgbuf [16]byte
+	var lng int
+	var eol bool
 	buf  = blobPool.Get()
 	df  := s.dm.DirectFile()
 	
 	for {
-		lng,eol,err := blocklist.GetExtendedLen(df,off)
+		if err = ctx.Err() ; err!=nil { goto cut }
+		lng,eol,err = blocklist.GetExtendedLen(df,off)
 		df.ReadAt(dbgbuf[:],off)
 		if err!=nil { goto cut }
 		oln := len(buf.B)
@@ -191,40 +212,79 @@ func (s *baseStorage) load(off int64) (buf *bytebufferpool.ByteBuffer) {
 		if off==0 { break } // Just in case/ Safety first.
 	}
 	
-	return buf
+	return buf,nil
 	
 	cut:
 	blobPool.Put(buf)
-	return nil
+	return nil,err
 }
 
-func (s *baseStorage) StoreBlob(blob []byte, t time.Time) ([]byte, bool) {
+func (s *baseStorage) StoreBlob(ctx context.Context, blob []byte, t time.Time) ([]byte, bool) {
+	if err := ctx.Err() ; err!=nil {
+		s.log.Log("event","store_failed","trace",trace.ID(ctx),"err",err)
+		return nil,false
+	}
 	{
 		// Don't pass the time-barrier.
-		ot := s.minTime
-		if ot.After(t) { return nil,false }
+		if atomic.LoadInt64(&s.minTime)>t.Unix() {
+			s.log.Log("event","store_failed","trace",trace.ID(ctx),"time",t,"err","time is before the expiry barrier")
+			return nil,false
+		}
+		// WalkBlobs doesn't find other days.
+		if y := t.UTC().Year() ; y<firstYear || y>lastYear {
+			s.log.Log("event","store_failed","trace",trace.ID(ctx),"time",t,"err","time is out of range")
+			return nil,false
+		}
+		if s.ro {
+			s.log.Log("event","store_failed","trace",trace.ID(ctx),"err",istorage.ErrReadOnly)
+			return nil,false
+		}
 	}
 	var key [8]byte
 	tk := t.UTC().AppendFormat(key[:0],dayTime)
-	buf := compress(blob)
+	buf,err := compress(ctx,blob,s.comp,s.seal,t)
+	if err!=nil {
+		s.log.Log("event","store_failed","trace",trace.ID(ctx),"day",string(tk),"size",len(blob),"err",err)
+		return nil,false
+	}
 	defer blobPool.Put(buf)
 	k,err := s.store(tk,buf.B)
-	if err!=nil { return nil,false }
+	if err!=nil {
+		s.log.Log("event","store_failed","trace",trace.ID(ctx),"day",string(tk),"size",len(blob),"err",err)
+		return nil,false
+	}
+	if err = s.index.add(tk,k) ; err!=nil {
+		s.log.Log("event","index_failed","trace",trace.ID(ctx),"day",string(tk),"offset",k,"err",err)
+	}
 	b := make([]byte,8)
 	binary.BigEndian.PutUint64(b,uint64(k))
 	return b,true
 }
 
-func (s *baseStorage) LoadBlob(key []byte, target *bytebufferpool.ByteBuffer) (lz4l int, ok bool) {
-	if len(key)!=8 { return }
+func (s *baseStorage) LoadBlob(ctx context.Context, key []byte, target *bytebufferpool.ByteBuffer) (meta istorage.Meta, ok bool) {
+	tid := trace.ID(ctx)
+	if len(key)!=8 {
+		s.log.Log("event","load_failed","trace",tid,"key",key,"err","invalid key length")
+		return
+	}
 	off := int64(binary.BigEndian.Uint64(key))
-	buf := s.load(off)
-	if buf==nil { return }
+	buf,err := s.load(ctx,off)
+	if err!=nil {
+		s.log.Log("event","load_failed","trace",tid,"offset",off,"err",err)
+		return
+	}
 	defer blobPool.Put(buf)
-	if len(buf.B)<4 { return }
-	lz4l = int(binary.BigEndian.Uint32(buf.B))
-	target.Set(buf.B[4:])
-	ok = true
+	rec,err := istorage.OpenRecord(s.seal,buf.B)
+	if err!=nil {
+		s.log.Log("event","load_failed","trace",tid,"offset",off,"err",err)
+		return
+	}
+	meta,data,ok := istorage.ParseHead(rec)
+	if !ok {
+		s.log.Log("event","load_failed","trace",tid,"offset",off,"err","short record")
+		return
+	}
+	target.Set(data)
 	return
 }
 func (s *baseStorage) obtain(categ []byte) func(dm dataman.DataManager)(int64,error) {
@@ -237,20 +297,229 @@ func (s *baseStorage) obtain(categ []byte) func(dm dataman.DataManager)(int64,er
 	}
 }
 
-func (s *baseStorage) Expire(t time.Time) {
+func (s *baseStorage) Expire(ctx context.Context, t time.Time) {
+	if s.ro { return }
+	s.maint.Lock(); defer s.maint.Unlock()
 	var key [8]byte
-	s.minTime = t
+	// The day of t expires as a whole, as the day index drops it.
+	ex := t.UTC().Truncate(time.Hour*24).Add(time.Hour*24).Unix()
+	for {
+		old := atomic.LoadInt64(&s.minTime)
+		if ex<=old || atomic.CompareAndSwapInt64(&s.minTime,old,ex) { break }
+	}
 	tk := t.UTC().AppendFormat(key[:0],dayTime)
+	tid := trace.ID(ctx)
 	obtain := s.obtain(tk)
+	before := s.freed
+	days,shredded := 0,0
+	if s.days!=nil {
+		// The keys go first; freed blocks keep their content.
+		n,err := s.days.Expire(t)
+		if err!=nil { s.log.Log("event","expire_failed","trace",tid,"before",string(tk),"err",err) }
+		shredded = n
+	}
 	// Redo this, until all daynodes earlier than tk are deleted.
 	for {
+		if err := ctx.Err() ; err!=nil {
+			s.log.Log("event","expire_failed","trace",tid,"before",string(tk),"err",err)
+			break
+		}
 		consumed,err := s.blockList.AppendNodeAndConsume(obtain)
-		if err!=nil { break }
-		if !consumed { break }
+		if err!=nil {
+			s.log.Log("event","expire_failed","trace",tid,"before",string(tk),"err",err)
+			break
+		}
+		if !consumed {
+			if days==0 { break }
+			if err = s.index.drop(tk) ; err!=nil {
+				s.log.Log("event","expire_failed","trace",tid,"before",string(tk),"err",err)
+			}
+			break
+		}
+		days++
+	}
+	s.log.Log("event","expire","trace",tid,"before",string(tk),"days",days,"reclaimed",s.freed-before,"shredded",shredded)
+}
+// ShredDay destroys the key of day. Its blocks are not freed before it
+// expires: the day index can only give up its oldest days.
+func (s *baseStorage) ShredDay(ctx context.Context, day time.Time) error {
+	if s.days==nil { return istorage.ErrNoDayKeys }
+	if err := s.days.Shred(day) ; err!=nil { return err }
+	s.log.Log("event","shred_day","trace",trace.ID(ctx),"day",day.UTC().Format(dayTime))
+	return nil
+}
+// Resealed records are written through a redo log in batches of this size.
+const resealBatch = 4<<20
+
+// The redo log of an interrupted reseal, next to gobasedb.dat.
+const resealLog = "gobasedb.reseal"
+
+/*
+Reseal reseals the records, that were sealed with an older key (see
+WalkBlobs), in place. The new bytes go through a redo log (see
+storage.RedoLog), so that a crash leaves every record either old or new; the
+next open finishes an interrupted reseal. Expire waits for Reseal, so that no
+block is freed and reused, while its new bytes wait in the log.
+*/
+func (s *baseStorage) Reseal(ctx context.Context) (int,error) {
+	if s.seal==nil { return 0,istorage.ErrNoKeyfile }
+	if s.ro { return 0,istorage.ErrReadOnly }
+	s.maint.Lock(); defer s.maint.Unlock()
+	rl,err := storage.CreateRedoLog(filepath.Join(filepath.Dir(s.file.Name()),resealLog))
+	if err!=nil { return 0,err }
+	defer rl.Close()
+	n := 0
+	commit := func() error {
+		s.dm.Lock(); defer s.dm.Unlock()
+		return rl.Commit(s.writeDirect,s.file.Sync)
+	}
+	err = s.WalkBlobs(ctx,func(key []byte, day time.Time) error {
+		off := int64(binary.BigEndian.Uint64(key))
+		ok,err := s.reseal(off,rl)
+		if err!=nil { return fmt.Errorf("record at %d: %v",off,err) }
+		if !ok { return nil }
+		n++
+		if rl.Pending()<resealBatch { return nil }
+		return commit()
+	})
+	if e := commit() ; err==nil { err = e }
+	if err!=nil {
+		s.log.Log("event","reseal_failed","records",n,"err",err)
+		return n,err
+	}
+	s.log.Log("event","reseal","records",n)
+	return n,nil
+}
+
+// reseal adds the resealed record at off to rl. It reports false, if it
+// wasn't sealed with an older key.
+func (s *baseStorage) reseal(off int64, rl *storage.RedoLog) (bool,error) {
+	s.dm.Lock(); defer s.dm.Unlock()
+	var chunks []blocklist.BufAddr
+	var rec []byte
+	df := s.dm.DirectFile()
+	for off!=0 {
+		lng,eol,err := blocklist.GetExtendedLen(df,off)
+		if err!=nil { return false,err }
+		chunks = append(chunks,blocklist.BufAddr{Off:off,Len:lng})
+		oln := len(rec)
+		rec = append(rec,make([]byte,lng)...)
+		if _,err = df.ReadAt(rec[oln:],off+16) ; err!=nil { return false,err }
+		if eol { break }
+		if off,err = blocklist.GetNext(df,off) ; err!=nil { return false,err }
 	}
+	if !istorage.IsSealed(rec) { return false,nil }
+	ok,err := s.seal.Reseal(rec[4:])
+	if err!=nil || !ok { return false,err }
+	for _,c := range chunks {
+		if err = rl.Add(c.Off+16,rec[:c.Len]) ; err!=nil { return false,err }
+		rec = rec[c.Len:]
+	}
+	return true,nil
+}
+
+// writeDirect writes data at off of the data area, bypassing the journal.
+func (s *baseStorage) writeDirect(off int64, data []byte) error {
+	_,err := s.dm.DirectFile().WriteAt(data,off)
+	return err
+}
+
+// replayReseal finishes a reseal, that a crash interrupted. It returns the
+// number of chunks written.
+func (s *baseStorage) replayReseal(logPath string) (int,error) {
+	return storage.ReplayRedoLog(logPath,s.writeDirect,s.file.Sync)
+}
+
+// hasDay reports, whether the day index still holds categ.
+func (s *baseStorage) hasDay(categ []byte) (bool,error) {
+	s.dm.Lock(); defer s.dm.Unlock()
+	slm := skiplist.NodeMaster.Open(s.dm,false)
+	defer slm.Flush()
+	_,ok,err := skiplist.Lookup(slm,s.dayIdx,categ)
+	return ok,err
+}
+// dataSize returns the size of the data area, the file without the journal.
+func (s *baseStorage) dataSize() (int64,error) {
+	fi,err := s.file.Stat()
+	if err!=nil { return 0,err }
+	return fi.Size()-journalSize,nil
+}
+// dayRecords returns the offsets of the records of d, none, if it expired.
+func (s *baseStorage) dayRecords(d dayList) ([]int64,error) {
+	s.writes.Lock(); defer s.writes.Unlock()
+	s.dm.Lock(); defer s.dm.Unlock()
+	slm := skiplist.NodeMaster.Open(s.dm,false)
+	lh,ok,err := skiplist.Lookup(slm,s.dayIdx,[]byte(d.day))
+	slm.Flush()
+	if err!=nil || !ok || lh!=d.head { return nil,err }
+	size,err := s.dataSize()
+	if err!=nil { return nil,err }
+	return records(s.dm.DirectFile(),size,d.head)
+}
+/*
+WalkBlobs walks the day lists of the day index. Within a day, the records come
+in the order they were stored. The records listed in the side file (see
+recordIndex) must be found: otherwise, the lists aren't read as gobase wrote
+them, and the walk fails rather than missing blobs.
+*/
+func (s *baseStorage) WalkBlobs(ctx context.Context, fn func(key []byte, day time.Time) error) error {
+	listed := make(map[string][]int64)
+	if s.index!=nil {
+		idays,err := s.index.days()
+		if err!=nil { return err }
+		for _,d := range idays { listed[d.day] = d.offs }
+	}
+	days,err := listDays(ctx,s.dm,s.dayIdx,s.dm.Lock,s.dm.Unlock)
+	if err!=nil { return err }
+	for _,d := range days {
+		offs,err := s.dayRecords(d)
+		if err!=nil { return fmt.Errorf("day %s: %v",d.day,err) }
+		found := make(map[int64]bool,len(offs))
+		for _,off := range offs { found[off] = true }
+		for _,off := range listed[d.day] {
+			if !found[off] { return fmt.Errorf("day %s: record %d of the side file is not in the day list",d.day,off) }
+		}
+		for _,off := range offs {
+			if err = ctx.Err() ; err!=nil { return err }
+			key := make([]byte,8)
+			binary.BigEndian.PutUint64(key,uint64(off))
+			if err = fn(key,d.t) ; err!=nil { return err }
+		}
+	}
+	return nil
+}
+// pruneIndex drops the days from the side file, that the day index lacks,
+// such as after a crash during Expire.
+func (s *baseStorage) pruneIndex() error {
+	days,err := s.index.days()
+	if err!=nil { return err }
+	gone := make(map[string]bool)
+	for _,d := range days {
+		live,err := s.hasDay([]byte(d.day))
+		if err!=nil { return err }
+		if !live { gone[d.day] = true }
+	}
+	if len(gone)==0 { return nil }
+	return s.index.rewrite(func(day []byte) bool { return !gone[string(day)] })
+}
+func (s *baseStorage) UsedStorage() int64 {
+	stat,err := s.dm.DirectFile().Stat()
+	if err!=nil { return 0 }
+	used := stat.Size()-s.freed
+	if used<0 { used = 0 }
+	return used
+}
+func (s *baseStorage) CompressStats() istorage.CompressCounts { return s.comp.Counts() }
+func (s *baseStorage) SetCapacity(capacity int64) {
+	atomic.StoreInt64(&s.maxSpace,capacity)
+}
+func (s *baseStorage) Close() error {
+	s.dm.Lock(); defer s.dm.Unlock()
+	if s.index!=nil { s.index.close() }
+	return s.file.Close()
 }
 func (s *baseStorage) FreeStorage() int64 {
-	fspace := s.maxSpace
+	fspace := atomic.LoadInt64(&s.maxSpace)
 	stat,err := s.dm.DirectFile().Stat()
 	if err!=nil { return 0 }
 	fspace -= stat.Size()
@@ -278,31 +547,38 @@ func (m *masterRecord) SetBytes(b []byte) {
 
 const journalSize = (1<<24)
 
-func open_baseStorage(fn string, maxSpace int64) (*baseStorage,error) {
+// open_baseStorage opens the database fn, or creates it. With ro, it is only
+// opened, read-only, and fails, if the journal must be replayed.
+func open_baseStorage(fn string, maxSpace int64, ro bool, logger istorage.Logger) (*baseStorage,error) {
 	var i64 blocklist.Int64
 	var zero8 [8]byte
 	var zero16 [16]byte
 	for i := range zero8 { zero8[i] = 0 }
 	for i := range zero16 { zero16[i] = 0 }
 	
-	f,e := os.OpenFile(fn,os.O_CREATE|os.O_RDWR,0600)
+	flag := os.O_CREATE|os.O_RDWR
+	if ro { flag = os.O_RDONLY }
+	f,e := os.OpenFile(fn,flag,0600)
 	if e!=nil { return nil,e }
 	
 	stat,e := f.Stat()
 	if e!=nil { f.Close(); return nil,e }
 	
 	isFresh := stat.Size()<=journalSize
+	if isFresh && ro { f.Close(); return nil,fmt.Errorf("%s: empty database",fn) }
 	
 	ipw := journal.NewInplaceWAL_File(&journal.OffsetFile{f, 8}, journalSize-8)
 	osf := &journal.OffsetFile{f, journalSize}
 	
 	jf,err := journal.NewJournalDataManager(osf, ipw)
-	if err!=nil { return nil,err }
+	if err!=nil && ro { err = fmt.Errorf("%s: %v (the journal may need to be replayed, open the storage writable)",fn,err) }
+	if err!=nil { f.Close(); return nil,err }
 	
 	st := new(baseStorage)
 	mr := new(masterRecord)
 	
 	if isFresh {
+		logger.Log("event","init","file",fn)
 		
 		mri,err := jf.Alloc(32) // masterRecord
 		if err!=nil { return nil,err }
@@ -353,19 +629,46 @@ func open_baseStorage(fn string, maxSpace int64) (*baseStorage,error) {
 	st.blockList = &blocklist.BLManager{ DM:st.dm, Off: mr.FreeBlockList }
 	st.freed     = i64.Int64()
 	st.maxSpace  = maxSpace
+	st.file      = f
+	st.log       = logger
+	st.ro        = ro
 	
+	logger.Log("event","open","file",fn,"freed",st.freed,"capacity",maxSpace)
 	return st,nil
 }
 
 func init() {
 	storage.Backends["basedb"] = gobasedbLoader
+	storage.Specs["basedb"] = &storage.BackendSpec{Capacity:true,Disk:true,Seal:true}
 }
 
-func gobasedbLoader(path string, cfg *storage.StorageConfig) (string,istorage.Storage,error) {
-	uuid,err := storage.GetOrCreateUUID(path)
+func gobasedbLoader(path string, cfg *storage.StorageConfig, logger istorage.Logger) (string,istorage.Storage,error) {
+	uuid,err := cfg.UUID(path,logger)
 	if err!=nil { return "",nil,err }
-	bs,err := open_baseStorage(filepath.Join(path,"gobasedb.dat"),cfg.Capacity.Int64())
+	logger = istorage.With(logger,"uuid",uuid.String())
+	bs,err := open_baseStorage(filepath.Join(path,"gobasedb.dat"),cfg.Capacity.Int64(),cfg.ReadOnly,logger)
 	if err!=nil { return "",nil,err }
+	if logPath := filepath.Join(path,resealLog) ; cfg.ReadOnly {
+		if _,err = os.Stat(logPath) ; err==nil { err = fmt.Errorf("%s: an interrupted reseal must be finished, open the storage writable",resealLog) }
+		if os.IsNotExist(err) { err = nil }
+	} else if n,e := bs.replayReseal(logPath) ; e!=nil {
+		err = e
+	} else if n>0 {
+		logger.Log("event","reseal_replayed","entries",n)
+	}
+	if err!=nil { bs.Close(); return "",nil,err }
+	bs.comp = istorage.NewCompressor(cfg.GetCodec())
+	bs.seal,bs.days,err = cfg.Sealer(path)
+	if err==nil && cfg.ReadOnly {
+		bs.index,err = readRecordIndex(filepath.Join(path,indexName))
+	} else if err==nil {
+		bs.index,err = openRecordIndex(filepath.Join(path,indexName))
+		if err==nil { err = bs.pruneIndex() }
+	}
+	if err!=nil {
+		bs.Close()
+		return "",nil,err
+	}
 	
 	return string(uuid[:]),bs,nil
 }
@@ -0,0 +1,261 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package gobasedb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"os"
+)
+
+import (
+	"github.com/maxymania/blobserver/storage"
+	"github.com/maxymania/blobserver/istorage"
+)
+
+import (
+	"github.com/maxymania/gobase/blocklist"
+)
+
+func init() {
+	storage.Checkers["basedb"] = gobasedbCheck
+}
+
+// errBadList stops the walk of a list, whose problem is reported already.
+var errBadList = errors.New("bad list")
+
+/*
+gobasedbCheck checks the journal, the master and tracking records, the day
+index with the block chains of its days, and the free block list.
+
+The journal is replayed on a copy of the database in the temp directory, which
+needs room for it, and everything else is checked on the copy. A journal, that
+can't be replayed, is a problem; changes, that it holds, but were not applied
+yet, are noted. With repair, the storage itself is opened like the server does
+it, which replays its journal and finishes an interrupted reseal, and the side
+index loses the days, that the day index lacks.
+
+A block must be in one list at most: in a day list or the free list. The
+records of the side index (see recordIndex) must be found in the lists, or
+they are reachable from neither. The allocations of gobase itself, such as
+the nodes of the day index, are not listed anywhere; the bytes, that are in
+no list, are noted.
+*/
+func gobasedbCheck(path string, repair bool, logger istorage.Logger) (*storage.CheckReport,error) {
+	fn := filepath.Join(path,"gobasedb.dat")
+	rep := new(storage.CheckReport)
+	if repair {
+		n,err := gobasedbPrune(path,rep,logger)
+		if err!=nil {
+			rep.Problemf("journal: %v",err)
+			return rep,nil
+		}
+		rep.Notef("journal replayed, %d expired days dropped from the side index",n)
+	} else if _,err := os.Stat(filepath.Join(path,resealLog)) ; err==nil {
+		rep.Notef("%s: an interrupted reseal, that is finished on the next open or repair; its records may be torn until then",resealLog)
+	}
+	fi,err := os.Stat(fn)
+	if err!=nil { return nil,err }
+	if fi.Size()<=journalSize {
+		rep.Problemf("%s: %d bytes, too short to hold a database",fn,fi.Size())
+		return rep,nil
+	}
+	cp,err := copyFile(fn)
+	if err!=nil { return nil,err }
+	defer os.Remove(cp)
+	s,err := open_baseStorage(cp,0,false,istorage.OrNop(nil))
+	if err!=nil {
+		rep.Problemf("journal: can't be replayed: %v",err)
+		return rep,nil
+	}
+	defer s.Close()
+	if n,err := diffPages(fn,cp) ; err!=nil {
+		return nil,err
+	} else if n>0 {
+		rep.Notef("journal: %d pages hold changes, that were logged, but not applied yet",n)
+	}
+	size,err := s.dataSize()
+	if err!=nil { return nil,err }
+	df := s.dm.DirectFile()
+	
+	check := func(what string, off int64) bool {
+		if off<=0 || off>=size {
+			rep.Problemf("%s at %d is outside of the file (%d bytes)",what,off,size)
+			return false
+		}
+		return true
+	}
+	var i64 blocklist.Int64
+	if _,err = s.file.ReadAt(i64[:],0) ; err!=nil { return nil,err }
+	if !check("master record",i64.Int64()) { return rep,nil }
+	if !check("master record: day index",s.dayIdx) { return rep,nil }
+	if !check("master record: free block list",s.blockList.Off) { return rep,nil }
+	if check("master record: tracking record",s.trackOff) {
+		if s.freed<0 || s.freed>size { rep.Problemf("tracking record: %d freed bytes in a file of %d bytes",s.freed,size) }
+	}
+	
+	// owner tells the list of each block: a day or "the free list".
+	owner := make(map[int64]string)
+	claim := func(list string, off int64) bool {
+		if o,ok := owner[off] ; ok {
+			if o==list {
+				rep.Problemf("%s: block %d is linked twice",list,off)
+			} else {
+				rep.Problemf("block %d is in %s and in %s",off,o,list)
+			}
+			return false
+		}
+		owner[off] = list
+		return true
+	}
+	days,err := listDays(context.Background(),s.dm,s.dayIdx,func() {},func() {})
+	if err!=nil {
+		rep.Problemf("%v",err)
+		return rep,nil
+	}
+	records,used := 0,int64(0)
+	var rec,ubuf []byte
+	start := int64(0)
+	for _,d := range days {
+		list := "day "+d.day
+		rec = rec[:0]
+		err = walkList(df,size,d.head,func(off int64, lng int, eol bool) error {
+			if !claim(list,off) { return errBadList }
+			if len(rec)==0 { start = off }
+			used += 16+int64(lng)
+			n := len(rec)
+			rec = append(rec,make([]byte,lng)...)
+			if _,err := df.ReadAt(rec[n:],off+16) ; err!=nil { return err }
+			if !eol { return nil }
+			records++
+			if istorage.IsSealed(rec) {
+				rep.Sealed++ // The content can't be checked without the keys.
+			} else if meta,data,ok := istorage.ParseHead(rec) ; !ok {
+				rep.Problemf("%s: record %d: short head record",list,start)
+			} else if blob,err := istorage.Unpack(meta,data,ubuf) ; err!=nil {
+				rep.Problemf("%s: record %d: %v",list,start,err)
+			} else {
+				if meta.Size>0 { ubuf = blob }
+				rep.Blobs++
+				rep.Bytes += int64(len(blob))
+			}
+			rec = rec[:0]
+			return nil
+		})
+		if err==nil && len(rec)>0 { rep.Problemf("%s: the last record %d has no end mark",list,start) }
+		if err!=nil && err!=errBadList { rep.Problemf("%s: %v",list,err) }
+	}
+	
+	freeBlocks,freeBytes := 0,int64(0)
+	err = walkList(df,size,s.blockList.Off,func(off int64, lng int, eol bool) error {
+		if !claim("the free list",off) { return errBadList }
+		freeBlocks++
+		freeBytes += 16+int64(lng)
+		return nil
+	})
+	if err!=nil && err!=errBadList { rep.Problemf("free list: %v",err) }
+	
+	b,err := ioutil.ReadFile(filepath.Join(path,indexName))
+	if err!=nil && !os.IsNotExist(err) { return nil,err }
+	for _,d := range parseIndex(b) {
+		for _,off := range d.offs {
+			switch o := owner[off] ; o {
+			case "day "+d.day:
+			case "":
+				rep.Problemf("day %s: record %d of the side index is reachable from neither the day index nor the free list",d.day,off)
+			default:
+				rep.Problemf("day %s: record %d of the side index is in %s",d.day,off,o)
+			}
+		}
+	}
+	
+	rep.Notef("%d days, %d records in %d bytes, %d free blocks in %d bytes (%d freed bytes tracked)",len(days),records,used,freeBlocks,freeBytes,s.freed)
+	if rest := size-used-freeBytes ; rest>0 {
+		rep.Notef("%d bytes are in no list: the day index, list heads, records and block slack",rest)
+	}
+	logger.Log("event","fsck","days",len(days),"blobs",rep.Blobs,"problems",len(rep.Problems))
+	return rep,nil
+}
+
+// gobasedbPrune opens the storage, which replays the journal, finishes an
+// interrupted reseal, and drops the days from the side index, that the day
+// index lacks.
+func gobasedbPrune(path string, rep *storage.CheckReport, logger istorage.Logger) (int,error) {
+	s,err := open_baseStorage(filepath.Join(path,"gobasedb.dat"),0,false,logger)
+	if err!=nil { return 0,err }
+	defer s.Close()
+	n,err := s.replayReseal(filepath.Join(path,resealLog))
+	if err!=nil { return 0,fmt.Errorf("%s: %v",resealLog,err) }
+	if n>0 { rep.Notef("%s: finished an interrupted reseal of %d chunks",resealLog,n) }
+	if s.index,err = openRecordIndex(filepath.Join(path,indexName)) ; err!=nil { return 0,err }
+	before,err := s.index.days()
+	if err!=nil { return 0,err }
+	if err = s.pruneIndex() ; err!=nil { return 0,err }
+	after,err := s.index.days()
+	return len(before)-len(after),err
+}
+
+// copyFile copies fn into the temp directory, and returns the name of the copy.
+func copyFile(fn string) (string,error) {
+	src,err := os.Open(fn)
+	if err!=nil { return "",err }
+	defer src.Close()
+	dst,err := ioutil.TempFile("","gobasedb-fsck")
+	if err!=nil { return "",err }
+	_,err = io.Copy(dst,src)
+	if e := dst.Close() ; err==nil { err = e }
+	if err!=nil { os.Remove(dst.Name()); return "",err }
+	return dst.Name(),nil
+}
+
+// diffPages counts the 4 KiB pages of the data areas of a and b, that differ.
+func diffPages(a, b string) (int,error) {
+	fa,err := os.Open(a)
+	if err!=nil { return 0,err }
+	defer fa.Close()
+	fb,err := os.Open(b)
+	if err!=nil { return 0,err }
+	defer fb.Close()
+	ra := io.NewSectionReader(fa,journalSize,1<<62)
+	rb := io.NewSectionReader(fb,journalSize,1<<62)
+	pa,pb := make([]byte,4096),make([]byte,4096)
+	n := 0
+	for {
+		na,ea := io.ReadFull(ra,pa)
+		nb,eb := io.ReadFull(rb,pb)
+		if !bytes.Equal(pa[:na],pb[:nb]) { n++ }
+		if ea!=nil || eb!=nil {
+			if ea==io.EOF || ea==io.ErrUnexpectedEOF { ea = nil }
+			if eb==io.EOF || eb==io.ErrUnexpectedEOF { eb = nil }
+			if ea==nil { ea = eb }
+			return n,ea
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package gobasedb
+
+import "bytes"
+import "encoding/binary"
+import "io/ioutil"
+import "os"
+import "sort"
+import "sync"
+
+/*
+The records are also listed in a side file, that is appended to after each
+store, so that the walk of the day lists can be checked (see WalkBlobs). An
+entry is the day (as dayTime) followed by the offset of the record, 16 bytes
+in total. Expire rewrites the file without the expired days. Blobs stored
+before the file existed are not listed.
+*/
+const (
+	indexName  = "gobasedb.idx"
+	indexEntry = 16
+)
+
+type recordIndex struct{
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+// indexDay holds the records of one day, in the order they were stored.
+type indexDay struct{
+	day  string
+	offs []int64
+}
+
+func openRecordIndex(path string) (*recordIndex,error) {
+	f,err := os.OpenFile(path,os.O_CREATE|os.O_RDWR|os.O_APPEND,0600)
+	if err!=nil { return nil,err }
+	fi,err := f.Stat()
+	if err!=nil { f.Close(); return nil,err }
+	// Cut off a torn entry.
+	if n := fi.Size()%indexEntry ; n!=0 {
+		if err = f.Truncate(fi.Size()-n) ; err!=nil { f.Close(); return nil,err }
+	}
+	return &recordIndex{path:path,file:f},nil
+}
+
+// readRecordIndex opens the side file read-only. It is nil, if there is none.
+func readRecordIndex(path string) (*recordIndex,error) {
+	f,err := os.Open(path)
+	if os.IsNotExist(err) { return nil,nil }
+	if err!=nil { return nil,err }
+	return &recordIndex{path:path,file:f},nil
+}
+
+func (x *recordIndex) add(day []byte, off int64) error {
+	var e [indexEntry]byte
+	copy(e[:8],day)
+	binary.BigEndian.PutUint64(e[8:],uint64(off))
+	x.mutex.Lock(); defer x.mutex.Unlock()
+	_,err := x.file.Write(e[:])
+	return err
+}
+
+func (x *recordIndex) read() ([]byte,error) {
+	x.mutex.Lock(); defer x.mutex.Unlock()
+	return ioutil.ReadFile(x.path)
+}
+
+// days returns the listed records, day by day in ascending order.
+func (x *recordIndex) days() ([]indexDay,error) {
+	b,err := x.read()
+	if err!=nil { return nil,err }
+	return parseIndex(b),nil
+}
+
+func parseIndex(b []byte) (days []indexDay) {
+	m := make(map[string]int)
+	for ; len(b)>=indexEntry ; b = b[indexEntry:] {
+		day := string(b[:8])
+		i,ok := m[day]
+		if !ok {
+			i = len(days)
+			m[day] = i
+			days = append(days,indexDay{day:day})
+		}
+		days[i].offs = append(days[i].offs,int64(binary.BigEndian.Uint64(b[8:])))
+	}
+	sort.Slice(days,func(i,j int) bool { return days[i].day<days[j].day })
+	return
+}
+
+// rewrite keeps the entries, whose day keep returns true for. The file is
+// replaced atomically.
+func (x *recordIndex) rewrite(keep func(day []byte) bool) error {
+	x.mutex.Lock(); defer x.mutex.Unlock()
+	b,err := ioutil.ReadFile(x.path)
+	if err!=nil { return err }
+	kept := b[:0]
+	for ; len(b)>=indexEntry ; b = b[indexEntry:] {
+		if keep(b[:8]) { kept = append(kept,b[:indexEntry]...) }
+	}
+	tmp := x.path+".tmp"
+	f,err := os.OpenFile(tmp,os.O_CREATE|os.O_TRUNC|os.O_WRONLY,0600)
+	if err!=nil { return err }
+	_,err = f.Write(kept)
+	if err==nil { err = f.Sync() }
+	if e := f.Close() ; err==nil { err = e }
+	if err==nil { err = os.Rename(tmp,x.path) }
+	if err!=nil { os.Remove(tmp); return err }
+	nf,err := os.OpenFile(x.path,os.O_RDWR|os.O_APPEND,0600)
+	if err!=nil { return err }
+	x.file.Close()
+	x.file = nf
+	return nil
+}
+
+// drop removes the days up to and including last.
+func (x *recordIndex) drop(last []byte) error {
+	return x.rewrite(func(day []byte) bool { return bytes.Compare(day,last)>0 })
+}
+
+func (x *recordIndex) close() error {
+	x.mutex.Lock(); defer x.mutex.Unlock()
+	return x.file.Close()
+}
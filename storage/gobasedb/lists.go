@@ -0,0 +1,131 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package gobasedb
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+import (
+	"github.com/maxymania/gobase/blocklist"
+	"github.com/maxymania/gobase/dataman"
+	"github.com/maxymania/gobase/skiplist"
+)
+
+/*
+A list head, such as the ones of the day index and the free block list, holds
+the offsets of the first and the last block of its list, 8 bytes each. The
+blocks are linked by their heads: the blocks of a record, and the last block
+of a record, which carries the end mark, to the first block of the next one.
+
+Which of the two offsets is the first one, is told by the last block, that
+links to nothing. A walk, that doesn't end at the last block, fails, so that
+a list, that can't be followed, is never mistaken for a shorter one.
+*/
+
+// walkList calls fn for every block of the list at lh, in order. size is the
+// size of the data area, and bounds the offsets.
+func walkList(f dataman.File, size, lh int64, fn func(off int64, lng int, eol bool) error) error {
+	var a,b blocklist.Int64
+	if _,err := f.ReadAt(a[:],lh) ; err!=nil { return err }
+	if _,err := f.ReadAt(b[:],lh+8) ; err!=nil { return err }
+	first,last := a.Int64(),b.Int64()
+	if first==0 && last==0 { return nil }
+	if first!=last {
+		nf,err := nextOf(f,size,first)
+		if err!=nil { return err }
+		nl,err := nextOf(f,size,last)
+		if err!=nil { return err }
+		if nf==0 && nl!=0 { first,last = last,first }
+	}
+	for n,off := int64(0),first ; ; n++ {
+		if n>size/16 { return fmt.Errorf("list %d loops",lh) }
+		if off<=0 || off+16>size { return fmt.Errorf("list %d: block %d is outside of the file",lh,off) }
+		lng,eol,err := blocklist.GetExtendedLen(f,off)
+		if err!=nil { return fmt.Errorf("list %d: block %d: %v",lh,off,err) }
+		if lng<0 || off+16+int64(lng)>size { return fmt.Errorf("list %d: block %d: length %d exceeds the file",lh,off,lng) }
+		if err = fn(off,lng,eol) ; err!=nil { return err }
+		if off==last { return nil }
+		if off,err = blocklist.GetNext(f,off) ; err!=nil { return fmt.Errorf("list %d: %v",lh,err) }
+		if off==0 { return fmt.Errorf("list %d ends before its last block %d",lh,last) }
+	}
+}
+
+func nextOf(f dataman.File, size, off int64) (int64,error) {
+	if off<=0 || off+16>size { return 0,fmt.Errorf("block %d is outside of the file",off) }
+	return blocklist.GetNext(f,off)
+}
+
+// records returns the offsets of the records of the list at lh, the ones of
+// their first blocks.
+func records(f dataman.File, size, lh int64) (offs []int64,err error) {
+	start := true
+	err = walkList(f,size,lh,func(off int64, lng int, eol bool) error {
+		if start { offs = append(offs,off) }
+		start = eol
+		return nil
+	})
+	if err==nil && !start { err = fmt.Errorf("list %d: the last record has no end mark",lh) }
+	return
+}
+
+// The day index has no cursor; it is walked by looking up every day, that
+// StoreBlob accepts.
+const (
+	firstYear = 1970
+	lastYear  = 2099
+)
+
+// dayList is a day of the day index, and its list head.
+type dayList struct{
+	day  string
+	t    time.Time
+	head int64
+}
+
+// listDays returns the days of the day index, in ascending order. lock and
+// unlock guard dm, a year at a time.
+func listDays(ctx context.Context, dm dataman.DataManager, dayIdx int64, lock, unlock func()) ([]dayList,error) {
+	var days []dayList
+	var key [8]byte
+	t := time.Date(firstYear,1,1,0,0,0,0,time.UTC)
+	for t.Year()<=lastYear {
+		if err := ctx.Err() ; err!=nil { return nil,err }
+		lock()
+		slm := skiplist.NodeMaster.Open(dm,false)
+		for y := t.Year() ; t.Year()==y ; t = t.AddDate(0,0,1) {
+			tk := t.AppendFormat(key[:0],dayTime)
+			lh,ok,err := skiplist.Lookup(slm,dayIdx,tk)
+			if err!=nil { unlock(); return nil,fmt.Errorf("day index: %s: %v",tk,err) }
+			if ok { days = append(days,dayList{string(tk),t,lh}) }
+		}
+		slm.Flush()
+		unlock()
+	}
+	return days,nil
+}
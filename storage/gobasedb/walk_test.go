@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+
+package gobasedb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/maxymania/blobserver/storage"
+	"github.com/maxymania/blobserver/istorage"
+)
+
+// TestWalkWithoutIndex walks a storage, whose records predate the side file.
+func TestWalkWithoutIndex(t *testing.T) {
+	dir,err := ioutil.TempDir("","basedb")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	cfg := &storage.StorageConfig{Method:"basedb",Capacity:&storage.Size{G:1}}
+	_,st,err := gobasedbLoader(dir,cfg,nil)
+	if err!=nil { t.Fatal(err) }
+	ctx := context.Background()
+	day := time.Now().UTC().Truncate(24*time.Hour)
+	keys := make(map[string]bool)
+	for i := 0 ; i<6 ; i++ {
+		key,ok := st.StoreBlob(ctx,make([]byte,100<<(i*2)),day.Add(-time.Duration(i%3)*24*time.Hour))
+		if !ok { t.Fatalf("store %d failed",i) }
+		keys[string(key)] = true
+	}
+	st.(*baseStorage).Close()
+	if err = os.Remove(filepath.Join(dir,indexName)) ; err!=nil { t.Fatal(err) }
+	
+	ro := *cfg
+	ro.ReadOnly = true
+	_,st,err = gobasedbLoader(dir,&ro,istorage.OrNop(nil))
+	if err!=nil { t.Fatal(err) }
+	defer st.(*baseStorage).Close()
+	err = st.(*baseStorage).WalkBlobs(ctx,func(key []byte, d time.Time) error {
+		if !keys[string(key)] { t.Errorf("unknown record %x of %v",key,d) }
+		delete(keys,string(key))
+		return nil
+	})
+	if err!=nil { t.Fatal(err) }
+	if len(keys)>0 { t.Errorf("%d records not walked",len(keys)) }
+}
+
+// TestCheck checks a storage, some of whose days expired.
+func TestCheck(t *testing.T) {
+	dir,err := ioutil.TempDir("","basedb")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	cfg := &storage.StorageConfig{Method:"basedb",Capacity:&storage.Size{G:1}}
+	_,st,err := gobasedbLoader(dir,cfg,nil)
+	if err!=nil { t.Fatal(err) }
+	ctx := context.Background()
+	day := time.Now().UTC().Truncate(24*time.Hour)
+	for i := 0 ; i<8 ; i++ {
+		if _,ok := st.StoreBlob(ctx,make([]byte,1000<<i),day.Add(-time.Duration(i%4)*24*time.Hour)) ; !ok { t.Fatalf("store %d failed",i) }
+	}
+	st.Expire(ctx,day.Add(-2*24*time.Hour))
+	st.(*baseStorage).Close()
+	rep,err := gobasedbCheck(dir,false,istorage.OrNop(nil))
+	if err!=nil { t.Fatal(err) }
+	if len(rep.Problems)>0 { t.Errorf("problems: %q",rep.Problems) }
+	if rep.Blobs!=4 { t.Errorf("%d blobs checked, want 4",rep.Blobs) }
+}
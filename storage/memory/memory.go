@@ -0,0 +1,257 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Package memory implements a volatile storage backend, that keeps all blobs in
+main memory. It is registered as method "memory".
+
+It is meant as a fast cache tier, for tests, and as the reference
+implementation of the istorage.Storage contract:
+
+	- Blobs are grouped into day buckets by the UTC day of their timestamp.
+	- Expire(t) drops every bucket up to and including the day of t. Storing
+	  into such a day afterwards fails.
+	- The capacity is taken from the configuration. A store, that would
+	  exceed it, fails. FreeStorage reports the remaining bytes.
+*/
+package memory
+
+import "github.com/valyala/bytebufferpool"
+import "github.com/tideland/golib/identifier"
+import "github.com/maxymania/blobserver/storage"
+import "github.com/maxymania/blobserver/istorage"
+import "github.com/maxymania/blobserver/trace"
+import "encoding/binary"
+import "context"
+import "sort"
+import "sync"
+import "time"
+
+const daySeconds = 60*60*24
+
+type record struct{
+	meta istorage.Meta
+	data []byte
+}
+
+type bucket struct{
+	records []*record // nil, once dropped.
+	dropped bool
+}
+
+type memStorage struct{
+	mutex    sync.RWMutex
+	days     map[int64]*bucket
+	expired  int64 // Days <= expired are gone.
+	used     int64
+	capacity int64
+	comp     *istorage.Compressor
+	log      istorage.Logger
+}
+
+// New creates an empty in-memory storage with the given capacity in bytes.
+func New(capacity int64, logger istorage.Logger) istorage.Storage {
+	return newStorage(capacity,logger)
+}
+func newStorage(capacity int64, logger istorage.Logger) *memStorage {
+	return &memStorage{
+		days    : make(map[int64]*bucket),
+		expired : -1<<62,
+		capacity: capacity,
+		comp    : istorage.NewCompressor(istorage.DefaultCodec),
+		log     : istorage.OrNop(logger),
+	}
+}
+
+func dayOf(t time.Time) int64 {
+	u := t.Unix()
+	d := u/daySeconds
+	if u<0 && u%daySeconds!=0 { d-- } // Round towards -inf.
+	return d
+}
+
+func compress(ctx context.Context, blob []byte, c *istorage.Compressor) *record {
+	r := &record{}
+	r.data,r.meta = c.Compress(ctx,nil,blob)
+	r.data = r.data[:len(r.data):len(r.data)]
+	return r
+}
+
+func (m *memStorage) StoreBlob(ctx context.Context, blob []byte, t time.Time) ([]byte,bool) {
+	var key [binary.MaxVarintLen64*2]byte
+	if err := ctx.Err() ; err!=nil {
+		m.log.Log("event","store_failed","trace",trace.ID(ctx),"err",err)
+		return nil,false
+	}
+	day := dayOf(t)
+	r := compress(ctx,blob,m.comp)
+	size := int64(len(r.data))
+	
+	m.mutex.Lock(); defer m.mutex.Unlock()
+	if day<=m.expired {
+		m.log.Log("event","store_failed","trace",trace.ID(ctx),"day",day,"err","day already expired")
+		return nil,false
+	}
+	if m.used+size>m.capacity {
+		m.log.Log("event","store_failed","trace",trace.ID(ctx),"size",size,"used",m.used,"capacity",m.capacity,"err","capacity exceeded")
+		return nil,false
+	}
+	b := m.days[day]
+	if b==nil {
+		b = new(bucket)
+		m.days[day] = b
+	}
+	if b.dropped {
+		m.log.Log("event","store_failed","trace",trace.ID(ctx),"day",day,"err","day dropped")
+		return nil,false
+	}
+	i := binary.PutVarint(key[:],day)
+	i += binary.PutUvarint(key[i:],uint64(len(b.records)))
+	b.records = append(b.records,r)
+	m.used += size
+	return append([]byte(nil),key[:i]...),true
+}
+
+func (m *memStorage) LoadBlob(ctx context.Context, key []byte, target *bytebufferpool.ByteBuffer) (meta istorage.Meta,ok bool) {
+	if err := ctx.Err() ; err!=nil {
+		m.log.Log("event","load_failed","trace",trace.ID(ctx),"err",err)
+		return
+	}
+	day,i := binary.Varint(key)
+	if i<=0 { return }
+	idx,j := binary.Uvarint(key[i:])
+	if j<=0 || i+j!=len(key) { return }
+	
+	m.mutex.RLock(); defer m.mutex.RUnlock()
+	b := m.days[day]
+	if b==nil || idx>=uint64(len(b.records)) { return }
+	r := b.records[idx]
+	if r==nil { return }
+	target.Set(r.data)
+	return r.meta,true
+}
+
+func (m *memStorage) Expire(ctx context.Context, t time.Time) {
+	day := dayOf(t)
+	m.mutex.Lock(); defer m.mutex.Unlock()
+	if day<=m.expired { return }
+	days,reclaimed := 0,int64(0)
+	for d,b := range m.days {
+		if d>day { continue }
+		for _,r := range b.records {
+			if r!=nil { reclaimed += int64(len(r.data)) }
+		}
+		delete(m.days,d)
+		days++
+	}
+	m.expired = day
+	m.used -= reclaimed
+	m.log.Log("event","expire","trace",trace.ID(ctx),"before",t.UTC().Format("20060102"),"days",days,"reclaimed",reclaimed)
+}
+
+// DropDay frees the blobs of a day, but keeps its slots, so that the keys
+// of the dropped blobs are not handed out again.
+func (m *memStorage) DropDay(ctx context.Context, t time.Time) error {
+	day := dayOf(t)
+	m.mutex.Lock(); defer m.mutex.Unlock()
+	b := m.days[day]
+	if b==nil {
+		b = new(bucket)
+		m.days[day] = b
+	}
+	reclaimed := int64(0)
+	for i,r := range b.records {
+		if r==nil { continue }
+		reclaimed += int64(len(r.data))
+		b.records[i] = nil
+	}
+	b.dropped = true
+	m.used -= reclaimed
+	m.log.Log("event","drop_day","trace",trace.ID(ctx),"day",t.UTC().Format("20060102"),"reclaimed",reclaimed)
+	return nil
+}
+
+func (m *memStorage) WalkBlobs(ctx context.Context, fn func(key []byte, day time.Time) error) error {
+	var key [binary.MaxVarintLen64*2]byte
+	m.mutex.RLock()
+	days := make([]int64,0,len(m.days))
+	counts := make(map[int64]int,len(m.days))
+	for d,b := range m.days {
+		if b.dropped { continue }
+		days = append(days,d)
+		counts[d] = len(b.records)
+	}
+	m.mutex.RUnlock()
+	sort.Slice(days,func(i,j int) bool { return days[i]<days[j] })
+	
+	for _,d := range days {
+		t := time.Unix(d*daySeconds,0).UTC()
+		for idx := 0 ; idx<counts[d] ; idx++ {
+			if err := ctx.Err() ; err!=nil { return err }
+			i := binary.PutVarint(key[:],d)
+			i += binary.PutUvarint(key[i:],uint64(idx))
+			if err := fn(append([]byte(nil),key[:i]...),t) ; err!=nil { return err }
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) UsedStorage() int64 {
+	m.mutex.RLock(); defer m.mutex.RUnlock()
+	return m.used
+}
+func (m *memStorage) CompressStats() istorage.CompressCounts { return m.comp.Counts() }
+func (m *memStorage) SetCapacity(capacity int64) {
+	m.mutex.Lock(); defer m.mutex.Unlock()
+	m.capacity = capacity
+}
+func (m *memStorage) Volatile() bool { return true }
+func (m *memStorage) Close() error {
+	m.mutex.Lock(); defer m.mutex.Unlock()
+	m.days = make(map[int64]*bucket)
+	m.used = 0
+	return nil
+}
+
+func (m *memStorage) FreeStorage() int64 {
+	m.mutex.RLock(); defer m.mutex.RUnlock()
+	return m.capacity-m.used
+}
+
+func init() {
+	storage.Backends["memory"] = memoryLoader
+	storage.Specs["memory"] = &storage.BackendSpec{Capacity:true}
+}
+
+// memoryLoader does not touch path. Since the content does not survive a
+// restart, every load gets a fresh UUID.
+func memoryLoader(path string, cfg *storage.StorageConfig, logger istorage.Logger) (string,istorage.Storage,error) {
+	uuid,err := identifier.NewUUIDv4()
+	if err!=nil { return "",nil,err }
+	logger = istorage.With(logger,"uuid",uuid.String())
+	m := newStorage(cfg.Capacity.Int64(),logger)
+	m.comp = istorage.NewCompressor(cfg.GetCodec())
+	logger.Log("event","open","capacity",m.capacity)
+	return string(uuid[:]),m,nil
+}
+
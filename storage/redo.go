@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package storage
+
+import "bufio"
+import "encoding/binary"
+import "hash/crc32"
+import "io/ioutil"
+import "os"
+
+var redoTable = crc32.MakeTable(crc32.Castagnoli)
+
+type redoEntry struct{
+	off  int64
+	data []byte
+}
+
+/*
+RedoLog makes in-place rewrites of a file crash-safe. The new bytes are
+logged and synced first, then written to the file, which is synced before
+the log is emptied. After a crash, ReplayRedoLog writes them again.
+
+The log is a sequence of entries:
+	{ 8 byte offset, 4 byte length, data, 4 byte CRC-32C of the preceding }
+A torn entry at the end was never applied, so it is ignored.
+*/
+type RedoLog struct{
+	path  string
+	file  *os.File
+	w     *bufio.Writer
+	ents  []redoEntry
+	bytes int
+	dirty bool // A Commit failed after syncing the log.
+}
+
+// CreateRedoLog creates an empty log at path, replacing an old one.
+func CreateRedoLog(path string) (*RedoLog,error) {
+	f,err := os.OpenFile(path,os.O_CREATE|os.O_TRUNC|os.O_WRONLY,0600)
+	if err!=nil { return nil,err }
+	return &RedoLog{path:path,file:f,w:bufio.NewWriter(f)},nil
+}
+
+// Add logs, that data is to be written at off. data is copied.
+func (r *RedoLog) Add(off int64, data []byte) error {
+	var h [12]byte
+	binary.BigEndian.PutUint64(h[:],uint64(off))
+	binary.BigEndian.PutUint32(h[8:],uint32(len(data)))
+	crc := crc32.Update(crc32.Checksum(h[:],redoTable),redoTable,data)
+	r.w.Write(h[:])
+	r.w.Write(data)
+	binary.BigEndian.PutUint32(h[:4],crc)
+	if _,err := r.w.Write(h[:4]) ; err!=nil { return err }
+	r.ents = append(r.ents,redoEntry{off,append([]byte(nil),data...)})
+	r.bytes += len(data)
+	return nil
+}
+
+// Pending returns the number of bytes added since the last Commit.
+func (r *RedoLog) Pending() int { return r.bytes }
+
+// Commit syncs the log, calls apply for every entry, then sync, and empties
+// the log. If it fails, the entries stay in the log, to be replayed.
+func (r *RedoLog) Commit(apply func(off int64, data []byte) error, sync func() error) (err error) {
+	if len(r.ents)==0 { return nil }
+	if err = r.w.Flush() ; err!=nil { return }
+	if err = r.file.Sync() ; err!=nil { return }
+	r.dirty = true
+	for _,e := range r.ents {
+		if err = apply(e.off,e.data) ; err!=nil { return }
+	}
+	if err = sync() ; err!=nil { return }
+	r.ents,r.bytes,r.dirty = r.ents[:0],0,false
+	if err = r.file.Truncate(0) ; err!=nil { return }
+	if _,err = r.file.Seek(0,0) ; err!=nil { return }
+	return r.file.Sync()
+}
+
+// Close closes the log and removes it, unless a Commit failed. Entries added
+// since the last Commit are dropped; nothing of them was written yet.
+func (r *RedoLog) Close() error {
+	err := r.file.Close()
+	if !r.dirty { os.Remove(r.path) }
+	return err
+}
+
+// ReplayRedoLog applies the entries of the log at path, if there is one,
+// then calls sync and removes the log. It returns the number of entries.
+func ReplayRedoLog(path string, apply func(off int64, data []byte) error, sync func() error) (n int,err error) {
+	b,err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) { return 0,nil }
+	if err!=nil { return }
+	for len(b)>=16 {
+		l := int(binary.BigEndian.Uint32(b[8:]))
+		if l<0 || len(b)<16+l { break }
+		crc := binary.BigEndian.Uint32(b[12+l:])
+		if crc32.Checksum(b[:12+l],redoTable)!=crc { break }
+		if err = apply(int64(binary.BigEndian.Uint64(b)),b[12:12+l]) ; err!=nil { return }
+		b = b[16+l:]
+		n++
+	}
+	if n>0 {
+		if err = sync() ; err!=nil { return }
+	}
+	return n,os.Remove(path)
+}
+
@@ -0,0 +1,76 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package storage
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+// A Commit, that fails while applying, leaves the log to be replayed.
+func TestRedoLogReplay(t *testing.T) {
+	dir,err := ioutil.TempDir("","redo")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	f,err := os.Create(filepath.Join(dir,"data"))
+	if err!=nil { t.Fatal(err) }
+	defer f.Close()
+	f.Write(make([]byte,64))
+	apply := func(off int64, data []byte) error {
+		_,err := f.WriteAt(data,off)
+		return err
+	}
+	
+	path := filepath.Join(dir,"log")
+	rl,err := CreateRedoLog(path)
+	if err!=nil { t.Fatal(err) }
+	rl.Add(8,[]byte("hello"))
+	rl.Add(32,[]byte("world"))
+	if err = rl.Commit(func(int64,[]byte) error { return fmt.Errorf("crash") },f.Sync) ; err==nil { t.Fatal("commit didn't fail") }
+	rl.Close()
+	
+	n,err := ReplayRedoLog(path,apply,f.Sync)
+	if n!=2 || err!=nil { t.Fatalf("replayed %d entries: %v",n,err) }
+	b,_ := ioutil.ReadFile(f.Name())
+	if string(b[8:13])!="hello" || string(b[32:37])!="world" { t.Fatalf("not replayed: %q",b) }
+	if _,err = os.Stat(path) ; !os.IsNotExist(err) { t.Fatal("log not removed") }
+}
+
+// A torn entry was never applied, so it is ignored.
+func TestRedoLogTorn(t *testing.T) {
+	dir,err := ioutil.TempDir("","redo")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir,"log")
+	rl,err := CreateRedoLog(path)
+	if err!=nil { t.Fatal(err) }
+	rl.Add(8,[]byte("hello"))
+	rl.w.Flush()
+	fi,_ := os.Stat(path)
+	rl.file.Truncate(fi.Size()-1)
+	rl.file.Close()
+	
+	n,err := ReplayRedoLog(path,func(int64,[]byte) error { t.Fatal("torn entry applied"); return nil },nil)
+	if n!=0 || err!=nil { t.Fatalf("replayed %d entries: %v",n,err) }
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package storage
+
+import "fmt"
+import "math"
+import "strconv"
+import "strings"
+
+var sizeUnits = map[string]float64{
+	""   : 1,
+	"B"  : 1,
+	"K"  : 1<<10, "KIB": 1<<10, "KB": 1e3,
+	"M"  : 1<<20, "MIB": 1<<20, "MB": 1e6,
+	"G"  : 1<<30, "GIB": 1<<30, "GB": 1e9,
+	"T"  : 1<<40, "TIB": 1<<40, "TB": 1e12,
+	"P"  : 1<<50, "PIB": 1<<50, "PB": 1e15,
+}
+
+// ParseSize parses sizes like "500GiB", "2TB" or "1.5 T". The single letter
+// units are binary, like the fields of Size.
+func ParseSize(s string) (*Size,error) {
+	str := strings.TrimSpace(s)
+	i := len(str)
+	for i>0 && (str[i-1]<'0' || '9'<str[i-1]) && str[i-1]!='.' { i-- }
+	mul,ok := sizeUnits[strings.ToUpper(strings.TrimSpace(str[i:]))]
+	if !ok { return nil,fmt.Errorf("invalid size %q: unknown unit",s) }
+	num,err := strconv.ParseFloat(strings.TrimSpace(str[:i]),64)
+	if err!=nil || num<0 { return nil,fmt.Errorf("invalid size %q",s) }
+	b := num*mul
+	if b>=math.MaxInt64 { return nil,fmt.Errorf("invalid size %q: too large",s) }
+	return &Size{Bytes:int64(b)},nil
+}
+
+// sizeOf converts a decoded capacity value, either a string or a table
+// like { G: 500 }, into a Size.
+func sizeOf(v interface{}) (*Size,error) {
+	switch t := v.(type) {
+	case nil: return nil,nil
+	case string: return ParseSize(t)
+	case int64: return &Size{Bytes:t},nil
+	case map[string]interface{}:
+		s := new(Size)
+		for k,e := range t {
+			n,ok := e.(int64)
+			if !ok || n<0 || n>math.MaxUint16 { return nil,fmt.Errorf("%s: expected an integer between 0 and %d",k,math.MaxUint16) }
+			switch strings.ToUpper(k) {
+			case "K": s.K = uint16(n)
+			case "M": s.M = uint16(n)
+			case "G": s.G = uint16(n)
+			case "T": s.T = uint16(n)
+			case "P": s.P = uint16(n)
+			default: return nil,fmt.Errorf("unknown unit %q",k)
+			}
+		}
+		return s,nil
+	}
+	return nil,fmt.Errorf("expected a size string or a table, got %T",v)
+}
@@ -24,6 +24,7 @@ SOFTWARE.
 package storage
 
 import "github.com/lytics/confl"
+import "github.com/maxymania/blobserver/istorage"
 import "path/filepath"
 import "github.com/tideland/golib/identifier"
 import "fmt"
@@ -61,7 +62,20 @@ type backendIdentifier struct{
 	Uuid string `confl:"uuid"`
 }
 
-func GetOrCreateUUID(path string) (identifier.UUID,error){
+// ReadUUID reads the UUID of the storage at path. ok is false, if it has
+// none yet, or it is unreadable; opening the storage creates a new one then.
+func ReadUUID(path string) (uuid identifier.UUID,ok bool) {
+	bi := new(backendIdentifier)
+	f,err := os.Open(filepath.Join(path,"id.conf"))
+	if err!=nil { return }
+	defer f.Close()
+	if err = confl.NewDecoder(f).Decode(bi) ; err!=nil { return }
+	uuid,err = parseUUID(bi.Uuid)
+	return uuid,err==nil
+}
+
+func GetOrCreateUUID(path string, logger istorage.Logger) (identifier.UUID,error){
+	logger = istorage.OrNop(logger)
 	bi := new(backendIdentifier)
 	cf := filepath.Join(path,"id.conf")
 	{
@@ -69,9 +83,15 @@ func GetOrCreateUUID(path string) (identifier.UUID,error){
 		if e!=nil { goto otherwise } // No file.
 		defer f.Close()
 		e = confl.NewDecoder(f).Decode(bi)
-		if e!=nil { goto otherwise } // unreadable.
+		if e!=nil { // unreadable.
+			logger.Log("event","recovery","action","regenerate_uuid","file",cf,"err",e)
+			goto otherwise
+		}
 		id,e := parseUUID(bi.Uuid)
-		if e!=nil { goto otherwise }
+		if e!=nil {
+			logger.Log("event","recovery","action","regenerate_uuid","file",cf,"err",e)
+			goto otherwise
+		}
 		return id,nil
 	}
 	otherwise:
@@ -83,6 +103,7 @@ func GetOrCreateUUID(path string) (identifier.UUID,error){
 		defer f.Close()
 		bi.Uuid = id.String()
 		e = confl.NewEncoder(f).Encode(bi)
+		logger.Log("event","uuid_created","file",cf,"uuid",bi.Uuid,"err",e)
 		return id,e
 	}
 }
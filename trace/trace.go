@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package trace
+
+import "context"
+import "crypto/rand"
+import "encoding/hex"
+import "time"
+
+// Header names used to propagate a trace over notrest.
+const (
+	HeaderTraceID = "trace-id"
+	HeaderTimeout = "timeout-ms"
+)
+
+type traceKey struct{}
+
+// WithID returns a copy of ctx, that carries the trace ID id.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx,traceKey{},id)
+}
+
+// ID returns the trace ID carried by ctx, or "" if there is none.
+func ID(ctx context.Context) string {
+	id,_ := ctx.Value(traceKey{}).(string)
+	return id
+}
+
+// NewID generates a random 128-bit trace ID in hex.
+func NewID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Ensure returns ctx, if it already carries a trace ID, or a copy of ctx
+// with a freshly generated one otherwise.
+func Ensure(ctx context.Context) context.Context {
+	if ID(ctx)!="" { return ctx }
+	return WithID(ctx,NewID())
+}
+
+// Detach returns a context, that carries the trace ID of ctx, but is
+// neither canceled nor bound to the deadline of ctx.
+func Detach(ctx context.Context) context.Context {
+	if id := ID(ctx) ; id!="" { return WithID(context.Background(),id) }
+	return context.Background()
+}
+
+// A Span records the timing of one unit of work.
+type Span struct{
+	TraceID  string
+	Name     string
+	Node     string // Storage UUID, if the span covers a single backend.
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// A Tracer receives finished spans.
+type Tracer interface{
+	Record(s *Span)
+}
+
+// Start begins a span named name within the trace carried by ctx.
+func Start(ctx context.Context, name string) *Span {
+	return &Span{TraceID:ID(ctx),Name:name,Start:time.Now()}
+}
+
+// Finish sets the duration and error of s and hands it to t. t may be nil.
+func (s *Span) Finish(t Tracer, err error) {
+	s.Duration = time.Since(s.Start)
+	s.Err = err
+	if t!=nil { t.Record(s) }
+}
+